@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var createTrackers []string
+var createWebSeeds []string
+var createOutput string
+var createComment string
+var createCreatedBy string
+var createSource string
+var createName string
+var createPieceLength int
+var createPrivate bool
+var createDate int64
+
+// NewCreateCmd represents the create command
+func NewCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create <path>",
+		Short: "create a torrent from a file or directory",
+		Long: `Hash a file or every file under a directory into a new torrent. The same content
+and flags always produce the same torrent, the creation date is only written when
+--date or SOURCE_DATE_EPOCH is set. For example:
+
+bitctl create ./dist -t http://tracker/announce -o dist.torrent`,
+		Args: cobra.ExactArgs(1),
+		Run:  CreateFunc,
+	}
+	var date int64
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		date = epoch
+	}
+	cmd.Flags().StringArrayVarP(&createTrackers, "tracker", "t", nil, "announce url, repeat for another tier or separate urls of one tier by comma")
+	cmd.Flags().StringArrayVarP(&createWebSeeds, "webseed", "w", nil, "web seed url, may be repeated")
+	cmd.Flags().StringVarP(&createOutput, "output", "o", "", "the torrent file to write, defaults to <name>.torrent")
+	cmd.Flags().StringVar(&createComment, "comment", "", "comment stored in the torrent")
+	cmd.Flags().StringVar(&createCreatedBy, "created-by", "torcore", "created by field of the torrent")
+	cmd.Flags().StringVarP(&createSource, "source", "s", "", "source field of the info dictionary")
+	cmd.Flags().StringVarP(&createName, "name", "n", "", "name of the torrent, defaults to the base name of path")
+	cmd.Flags().IntVarP(&createPieceLength, "piece-length", "l", 0, "piece length in bytes, chosen automatically when 0")
+	cmd.Flags().BoolVarP(&createPrivate, "private", "p", false, "mark the torrent private")
+	cmd.Flags().Int64Var(&createDate, "date", date, "creation date as unix seconds, left out when 0")
+	return cmd
+}
+func init() {
+	rootCmd.AddCommand(NewCreateCmd())
+}
+func CreateFunc(cmd *cobra.Command, args []string) {
+	b := &metainfo.Builder{
+		WebSeeds:    createWebSeeds,
+		Comment:     createComment,
+		CreatedBy:   createCreatedBy,
+		Private:     createPrivate,
+		Source:      createSource,
+		Name:        createName,
+		PieceLength: createPieceLength,
+	}
+	for _, tier := range createTrackers {
+		b.Trackers = append(b.Trackers, strings.Split(tier, ","))
+	}
+	if createDate != 0 {
+		b.CreationDate = time.Unix(createDate, 0)
+	}
+	mi, err := b.Build(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	output := createOutput
+	if len(output) == 0 {
+		output = filepath.Base(mi.Info.Name) + ".torrent"
+	}
+	err = mi.WriteFile(output)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("created %s, info hash %x\n", output, mi.InfoHash())
+}
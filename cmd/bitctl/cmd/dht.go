@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"github.com/shoggothforever/torcore/pkg/bencode/dht"
+	"github.com/spf13/cobra"
+)
+
+var useDHT bool
+var dhtAddr string
+var dhtState string
+
+// 为需要查找peer的命令添加DHT相关参数
+func addDHTFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&useDHT, "dht", false, "also find peers on the mainline DHT")
+	addDHTNodeFlags(cmd)
+}
+
+// DHT节点的监听地址和状态文件
+func addDHTNodeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&dhtAddr, "dht-addr", dht.DefaultAddr, "the UDP address the DHT node listens on")
+	cmd.Flags().StringVar(&dhtState, "dht-state", "", "file keeping the DHT node id and routing table between runs")
+}
+
+// 按参数启动DHT节点，未启用时返回nil
+func startDHT() (*dht.Server, error) {
+	if !useDHT {
+		return nil, nil
+	}
+	return dht.NewServer(dht.Config{Addr: dhtAddr, StateFile: dhtState})
+}
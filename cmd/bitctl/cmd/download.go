@@ -5,10 +5,20 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/dht"
+	"github.com/shoggothforever/torcore/pkg/bencode/magnet"
 	mt "github.com/shoggothforever/torcore/pkg/bencode/net"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
 	"github.com/spf13/cobra"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,9 +26,20 @@ var fileName string
 var outputPath string
 var deadline int
 var pre bool
+var magnetURI string
+var follow string
+var followSalt string
+var uploadSlots int
+var peerTimeout time.Duration
+var resume bool
+var sequential bool
+var selectFiles string
+var excludeFiles []string
+var downloadPort int
 
 // NewMarshalCmd represents the marshal command
 func NewDownloadCmd() *cobra.Command {
+	port, _ := strconv.Atoi(mt.PeerPort)
 	cmd := &cobra.Command{
 		Use:   "download",
 		Short: "input the torrent file,",
@@ -35,32 +56,224 @@ to quickly create a Cobra application.`,
 	cmd.Flags().StringVarP(&outputPath, "output", "o", "./output", "the path where files downloaded into")
 	cmd.Flags().IntVarP(&deadline, "deadline", "d", -1, "limit max download time ")
 	cmd.Flags().BoolVarP(&pre, "prelude", "p", false, "get a glimpse of torrent")
+	cmd.Flags().StringVarP(&magnetURI, "magnet", "m", "", "download from a magnet link instead of a torrent file")
+	cmd.Flags().StringVar(&follow, "follow", "", "download the torrent a public key currently points at on the DHT (BEP 46), given in hex or as a magnet link")
+	cmd.Flags().StringVar(&followSalt, "salt", "", "the salt of the followed public key")
+	cmd.Flags().IntVar(&uploadSlots, "upload-slots", mt.DefaultUploadSlots, "the number of peers uploaded to at the same time")
+	cmd.Flags().DurationVar(&peerTimeout, "peer-timeout", mt.DefaultPeerTimeout, "close connections to peers silent for longer than this")
+	cmd.Flags().BoolVar(&resume, "resume", true, "save progress next to the downloaded files and continue from it when started again")
+	cmd.Flags().StringVar(&selectFiles, "select", "", "download only these files of a multi-file torrent, given as indexes and ranges such as 0,3-5")
+	cmd.Flags().StringSliceVar(&excludeFiles, "exclude", nil, "skip files whose path or name matches one of these glob patterns, such as '*.nfo'")
+	cmd.Flags().IntVar(&downloadPort, "port", port, "the port to accept peer connections on while downloading, 0 picks a free one")
+	cmd.Flags().BoolVar(&sequential, "sequential", false, "download pieces in order, so that media can be played before the download completes")
+	addDHTFlags(cmd)
+	addLSDFlags(cmd)
 	return cmd
 }
 func init() {
 	rootCmd.AddCommand(NewDownloadCmd())
 }
 func DownloadFunc(cmd *cobra.Command, args []string) {
-	fd, err := os.OpenFile(fileName, os.O_RDONLY, 0666)
+	if len(follow) != 0 {
+		useDHT = true
+	}
+	node, err := startDHT()
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		return
 	}
-	fmt.Println("open file:", fileName, " successfully")
-	r := bufio.NewReader(fd)
-	t, err := mt.UnmarshalTorrentFile(r)
+	if node != nil {
+		defer node.Close()
+	}
+	t, err := loadTorrent(node)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	t.UploadSlots = uploadSlots
+	t.PeerTimeout = peerTimeout
+	t.Port = downloadPort
+	if resume {
+		err = os.MkdirAll(outputPath, 0755)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		t.ResumeFile = filepath.Join(outputPath, t.FileName+".resume")
+	}
+	t.LSD, err = startLSD()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	if t.LSD != nil {
+		defer t.LSD.Close()
+	}
 	fmt.Println("get torrent file, length: ", t.FileLen)
 	fmt.Println("get pre bool ", pre)
 	fmt.Println(t.InfoSHA)
 	if !pre {
-		dur := (time.Duration)(deadline) * time.Second
-		err = t.DownloadToFile(outputPath, dur)
+		torrent, err := t.NewTorrent()
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		err = chooseFiles(torrent, selectFiles, excludeFiles)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if sequential {
+			torrent.SetSequential(true)
+		}
+		ctx := context.Background()
+		if deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(deadline)*time.Second)
+			defer cancel()
+		}
+		err = torrent.Download(ctx, outputPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+// 从种子文件读取，或者通过magnet链接向peers获取种子信息
+func loadTorrent(node *dht.Server) (*mt.TorrentFile, error) {
+	if len(magnetURI) != 0 || len(follow) != 0 {
+		m, err := parseMagnet()
+		if err != nil {
+			return nil, err
+		}
+		ctx := context.Background()
+		if deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(deadline)*time.Second)
+			defer cancel()
+		}
+		// 可变种子先在DHT上查找当前指向的info hash
+		if m.HasPublicKey && !m.HasInfoHash {
+			if node == nil {
+				return nil, errors.New("following a public key needs the DHT, add --dht")
+			}
+			infoHash, seq, err := node.FollowTorrent(ctx, m.PublicKey[:], m.Salt)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("public key points at %s (seq %d)\n", infoHash, seq)
+			m.InfoHash, m.HasInfoHash = infoHash, true
+		}
+		fmt.Println("fetching metadata of", m)
+		return mt.FetchMetadata(ctx, m, util.GeneratePeerID("dsm"), node)
+	}
+	fd, err := os.OpenFile(fileName, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	fmt.Println("open file:", fileName, " successfully")
+	t, err := mt.UnmarshalTorrentFile(bufio.NewReader(fd))
+	if err != nil {
+		return nil, err
+	}
+	t.DHT = node
+	return t, nil
+}
+
+// 解析-m给出的magnet链接，--follow可以是十六进制公钥或者带xs=urn:btpk的magnet链接
+func parseMagnet() (*magnet.Magnet, error) {
+	if len(follow) == 0 {
+		return magnet.Parse(magnetURI)
+	}
+	if strings.HasPrefix(follow, magnet.Scheme+":") {
+		m, err := magnet.Parse(follow)
+		if err != nil {
+			return nil, err
+		}
+		if !m.HasPublicKey {
+			return nil, errors.New("magnet link has no public key to follow")
+		}
+		return m, nil
+	}
+	key, err := hex.DecodeString(follow)
+	if err != nil || len(key) != magnet.KeyLen {
+		return nil, magnet.ErrKey
+	}
+	m := &magnet.Magnet{HasPublicKey: true, Salt: followSalt}
+	copy(m.PublicKey[:], key)
+	return m, nil
+}
+
+// 按--select和--exclude跳过不需要的文件。默认跳过magnet链接的so参数没有列出的文件，
+// --select代替so参数，--exclude在此基础上再跳过匹配的文件
+func chooseFiles(torrent *mt.Torrent, selected string, exclude []string) error {
+	files := torrent.Files()
+	skip := make([]bool, len(files))
+	for i, f := range files {
+		skip[i] = f.Priority == mt.PrioritySkip
+	}
+	if len(selected) != 0 {
+		keep, err := parseFileIndexes(selected, len(files))
+		if err != nil {
+			return err
+		}
+		for i := range skip {
+			skip[i] = !keep[i]
+		}
+	}
+	for _, pattern := range exclude {
+		for i, f := range files {
+			matchPath, err := path.Match(pattern, f.Path)
+			if err != nil {
+				return fmt.Errorf("bad --exclude pattern %q: %w", pattern, err)
+			}
+			matchName, _ := path.Match(pattern, path.Base(f.Path))
+			if matchPath || matchName {
+				skip[i] = true
+			}
+		}
+	}
+	for i, f := range files {
+		priority := mt.PriorityNormal
+		if skip[i] {
+			fmt.Println("skip", f.Path)
+			priority = mt.PrioritySkip
+		}
+		if priority == f.Priority {
+			continue
+		}
+		err := torrent.SetFilePriority(i, priority)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解析以逗号分隔的文件序号和范围，例如0,3-5
+func parseFileIndexes(s string, numFiles int) ([]bool, error) {
+	keep := make([]bool, numFiles)
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		begin, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("bad --select %q: %w", part, err)
+		}
+		end := begin
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil {
+				return nil, fmt.Errorf("bad --select %q: %w", part, err)
+			}
+		}
+		if begin < 0 || end < begin || end >= numFiles {
+			return nil, fmt.Errorf("bad --select %q: the torrent has files 0-%d", part, numFiles-1)
+		}
+		for i := begin; i <= end; i++ {
+			keep[i] = true
+		}
 	}
+	return keep, nil
 }
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/shoggothforever/torcore/pkg/bencode/lsd"
+	"github.com/spf13/cobra"
+)
+
+var useLSD bool
+
+// 为需要查找peer的命令添加本地发现参数
+func addLSDFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&useLSD, "lsd", false, "also find peers on the local network")
+}
+
+// 按参数启动本地发现，未启用时返回nil
+func startLSD() (*lsd.Service, error) {
+	if !useLSD {
+		return nil, nil
+	}
+	return lsd.New(lsd.Config{})
+}
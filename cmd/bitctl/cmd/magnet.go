@@ -0,0 +1,69 @@
+/*
+Copyright © 2024 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/magnet"
+	mt "github.com/shoggothforever/torcore/pkg/bencode/net"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var magnetFile string
+
+// NewMagnetCmd represents the magnet command
+func NewMagnetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "magnet [uri]",
+		Short: "generate a magnet link from a torrent or inspect a magnet link",
+		Long: `Print the magnet link of the torrent given by -f, or print the parameters of the
+magnet link given as argument. For example:
+
+bitctl magnet -f x.torrent
+bitctl magnet 'magnet:?xt=urn:btih:...'`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  MagnetFunc,
+	}
+	cmd.Flags().StringVarP(&magnetFile, "file", "f", "", "input torrent file to generate the magnet link of")
+	return cmd
+}
+func init() {
+	rootCmd.AddCommand(NewMagnetCmd())
+}
+func MagnetFunc(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		t, err := mt.Open(magnetFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(t.Magnet())
+		return
+	}
+	m, err := magnet.Parse(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if m.HasInfoHash {
+		fmt.Printf("info hash:    %x\n", m.InfoHash)
+	}
+	if m.HasInfoHashV2 {
+		fmt.Printf("info hash v2: %x\n", m.InfoHashV2)
+	}
+	fmt.Println("name:        ", m.Name)
+	for _, tr := range m.Trackers {
+		fmt.Println("tracker:     ", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		fmt.Println("web seed:    ", ws)
+	}
+	for _, pe := range m.Peers {
+		fmt.Println("peer:        ", pe)
+	}
+	if len(m.Select) != 0 {
+		fmt.Println("select:      ", m.Select)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2024 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/magnet"
+	mt "github.com/shoggothforever/torcore/pkg/bencode/net"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var publishFile string
+var publishKey string
+var publishSalt string
+
+// NewPublishCmd represents the publish command
+func NewPublishCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "publish",
+		Short: "point a mutable torrent at the latest torrent on the DHT",
+		Long: `Store a signed DHT item pointing the public key of the key file at the info hash
+of the torrent (BEP 46), so that followers always find the latest version. The key
+file holds a hex encoded ed25519 seed and is created when missing. For example:
+
+bitctl publish -f nightly.torrent -k nightly.key
+bitctl download --follow <public key>`,
+		Run: PublishFunc,
+	}
+	cmd.Flags().StringVarP(&publishFile, "file", "f", "filename", "the torrent to point at")
+	cmd.Flags().StringVarP(&publishKey, "key", "k", "publish.key", "file holding the ed25519 key")
+	cmd.Flags().StringVar(&publishSalt, "salt", "", "salt to publish several torrents under one key")
+	addDHTNodeFlags(cmd)
+	return cmd
+}
+func init() {
+	rootCmd.AddCommand(NewPublishCmd())
+}
+func PublishFunc(cmd *cobra.Command, args []string) {
+	t, err := mt.Open(publishFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	key, err := loadOrCreateKey(publishKey)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	useDHT = true
+	node, err := startDHT()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer node.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	seq, err := node.PublishTorrent(ctx, key, publishSalt, t.InfoSHA)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	m := &magnet.Magnet{HasPublicKey: true, Salt: publishSalt}
+	copy(m.PublicKey[:], key.Public().(ed25519.PublicKey))
+	fmt.Printf("published %x with seq %d\n", t.InfoSHA, seq)
+	fmt.Println(hex.EncodeToString(m.PublicKey[:]))
+	fmt.Println(m)
+}
+
+// 读取十六进制编码的ed25519种子，文件不存在时生成新的密钥
+func loadOrCreateKey(name string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		err = os.WriteFile(name, []byte(hex.EncodeToString(seed)+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("created new key", name)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not hold a hex encoded ed25519 seed", name)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2024 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	mt "github.com/shoggothforever/torcore/pkg/bencode/net"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"strconv"
+)
+
+var seedFile string
+var seedDir string
+var seedPort int
+
+// NewSeedCmd represents the seed command
+func NewSeedCmd() *cobra.Command {
+	port, _ := strconv.Atoi(mt.PeerPort)
+	cmd := &cobra.Command{
+		Use:   "seed",
+		Short: "seed the already complete content of a torrent",
+		Long: `Verify every piece of the content found in the data directory against the torrent,
+announce completion to the trackers and serve other peers until interrupted. For example:
+
+bitctl seed -f x.torrent -d ./data`,
+		Run: SeedFunc,
+	}
+	cmd.Flags().StringVarP(&seedFile, "file", "f", "filename", "input torrent file to seed")
+	cmd.Flags().StringVarP(&seedDir, "dir", "d", "./", "the directory holding the complete content")
+	cmd.Flags().IntVarP(&seedPort, "port", "p", port, "the port to accept peer connections on")
+	cmd.Flags().IntVar(&uploadSlots, "upload-slots", mt.DefaultUploadSlots, "the number of peers uploaded to at the same time")
+	cmd.Flags().DurationVar(&peerTimeout, "peer-timeout", mt.DefaultPeerTimeout, "close connections to peers silent for longer than this")
+	addDHTFlags(cmd)
+	addLSDFlags(cmd)
+	return cmd
+}
+func init() {
+	rootCmd.AddCommand(NewSeedCmd())
+}
+func SeedFunc(cmd *cobra.Command, args []string) {
+	t, err := mt.Open(seedFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("get torrent file, length: ", t.FileLen)
+	t.UploadSlots = uploadSlots
+	t.PeerTimeout = peerTimeout
+	t.DHT, err = startDHT()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if t.DHT != nil {
+		defer t.DHT.Close()
+	}
+	t.LSD, err = startLSD()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if t.LSD != nil {
+		defer t.LSD.Close()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = t.Seed(ctx, seedDir, seedPort)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+}
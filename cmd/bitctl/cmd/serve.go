@@ -0,0 +1,98 @@
+/*
+Copyright © 2024 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mt "github.com/shoggothforever/torcore/pkg/bencode/net"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+var serveFile string
+var serveOutput string
+var serveListen string
+
+// NewServeCmd represents the serve command
+func NewServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "download a torrent and stream its files over HTTP",
+		Long: `Download a torrent and serve each of its files over HTTP while it downloads, so that
+media players and browsers can stream them. Range requests download the pieces they
+need first. Files stay served after the download completes, until interrupted. For example:
+
+bitctl serve -f x.torrent --listen :8080`,
+		Run: ServeFunc,
+	}
+	cmd.Flags().StringVarP(&serveFile, "file", "f", "filename", "input torrent file to serve")
+	cmd.Flags().StringVarP(&serveOutput, "output", "o", "./output", "the path where files downloaded into")
+	cmd.Flags().StringVar(&serveListen, "listen", ":8080", "the address to serve HTTP on")
+	cmd.Flags().DurationVar(&peerTimeout, "peer-timeout", mt.DefaultPeerTimeout, "close connections to peers silent for longer than this")
+	addDHTFlags(cmd)
+	addLSDFlags(cmd)
+	return cmd
+}
+func init() {
+	rootCmd.AddCommand(NewServeCmd())
+}
+func ServeFunc(cmd *cobra.Command, args []string) {
+	t, err := mt.Open(serveFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	t.PeerTimeout = peerTimeout
+	t.DHT, err = startDHT()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if t.DHT != nil {
+		defer t.DHT.Close()
+	}
+	t.LSD, err = startLSD()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if t.LSD != nil {
+		defer t.LSD.Close()
+	}
+	torrent, err := t.NewTorrent()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	h, err := mt.NewHandler(torrent)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer h.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		err := torrent.Download(ctx, serveOutput)
+		if err != nil && ctx.Err() == nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("download complete, still serving")
+	}()
+	srv := &http.Server{Addr: serveListen, Handler: h}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Println("serving", t.FileName, "on", serveListen)
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println(err)
+	}
+}
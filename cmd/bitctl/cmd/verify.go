@@ -0,0 +1,81 @@
+/*
+Copyright © 2024 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	mt "github.com/shoggothforever/torcore/pkg/bencode/net"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"path/filepath"
+)
+
+var verifyFile string
+var verifyDir string
+var verifyWorkers int
+var verifyResume bool
+
+// NewVerifyCmd represents the verify command
+func NewVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "check existing content against a torrent",
+		Long: `Hash every piece of the content found in the data directory against the torrent and
+report how complete each file is. Exits with status 1 when any piece does not match. For example:
+
+bitctl verify -f x.torrent -d ./data`,
+		Run: VerifyFunc,
+	}
+	cmd.Flags().StringVarP(&verifyFile, "file", "f", "filename", "input torrent file to verify against")
+	cmd.Flags().StringVarP(&verifyDir, "dir", "d", "./", "the directory holding the content")
+	cmd.Flags().IntVarP(&verifyWorkers, "workers", "w", 0, "the number of pieces hashed at the same time, 0 means one per CPU")
+	cmd.Flags().BoolVar(&verifyResume, "resume", false, "save the matched pieces as a resume file, so that download continues from them")
+	return cmd
+}
+func init() {
+	rootCmd.AddCommand(NewVerifyCmd())
+}
+func VerifyFunc(cmd *cobra.Command, args []string) {
+	t, err := mt.Open(verifyFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	percent := -1
+	r, err := t.Verify(ctx, verifyDir, verifyWorkers, func(checked, total int) {
+		if p := checked * 100 / total; p != percent {
+			percent = p
+			fmt.Printf("\rchecked %d/%d pieces (%d%%)", checked, total, p)
+		}
+	})
+	fmt.Println()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, f := range r.Files {
+		status := "ok"
+		if !f.Complete() {
+			status = "BAD"
+		}
+		fmt.Printf("%-4s %s (%d/%d pieces)\n", status, f.Path, f.Good, f.Pieces)
+	}
+	fmt.Printf("%d of %d pieces match\n", len(t.PieceSHA)-r.Bad, len(t.PieceSHA))
+	if verifyResume {
+		path := filepath.Join(verifyDir, t.FileName+".resume")
+		err = r.SaveResume(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("saved resume file", path)
+	}
+	if !r.Complete() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"github.com/shoggothforever/torcore/pkg/bencode/model"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxValueLen bounds the bencoded value of an item (BEP 44)
+const MaxValueLen = 1000
+
+// MaxSaltLen bounds the salt of a mutable item
+const MaxSaltLen = 64
+
+// ItemTTL is how long a stored item is kept without being put again
+const ItemTTL = 2 * time.Hour
+
+// MaxItems bounds the number of items a node stores for others
+const MaxItems = 4096
+
+// BEP 44 错误码
+const (
+	ErrValueTooBig     = 205
+	ErrInvalidSig      = 206
+	ErrSaltTooBig      = 207
+	ErrCasMismatch     = 301
+	ErrSeqLessThanCurr = 302
+)
+
+var (
+	ErrItemNotFound = errors.New("dht item not found")
+	ErrItemInvalid  = errors.New("dht item failed verification")
+)
+
+// Item is an immutable or mutable data item stored in the DHT (BEP 44).
+// Immutable items are addressed by the SHA-1 of their value, mutable items
+// by the public key and salt and carry a signature over salt, seq and value.
+type Item struct {
+	// V is the bencoded value
+	V    model.RawMessage
+	K    ed25519.PublicKey
+	Salt string
+	Seq  int
+	Sig  []byte
+}
+
+// NewImmutableItem encodes v into an immutable item
+func NewImmutableItem(v interface{}) (*Item, error) {
+	var buf bytes.Buffer
+	model.MarshalBen(&buf, v)
+	it := &Item{V: buf.Bytes()}
+	if len(it.V) == 0 || len(it.V) > MaxValueLen {
+		return nil, errors.New("invalid item value size")
+	}
+	return it, nil
+}
+
+// NewMutableItem encodes v into a mutable item signed with key
+func NewMutableItem(key ed25519.PrivateKey, v interface{}, salt string, seq int) (*Item, error) {
+	it, err := NewImmutableItem(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) > MaxSaltLen {
+		return nil, errors.New("salt too big")
+	}
+	it.K = key.Public().(ed25519.PublicKey)
+	it.Salt = salt
+	it.Seq = seq
+	it.Sig = ed25519.Sign(key, signBuf(salt, seq, it.V))
+	return it, nil
+}
+
+// MutableTarget is the DHT key of the mutable items of a public key and salt
+func MutableTarget(k ed25519.PublicKey, salt string) ID {
+	return sha1.Sum(append(append([]byte{}, k...), salt...))
+}
+
+// Mutable reports whether the item is a mutable item
+func (it *Item) Mutable() bool {
+	return len(it.K) != 0
+}
+
+// Target is the DHT key the item is stored under
+func (it *Item) Target() ID {
+	if it.Mutable() {
+		return MutableTarget(it.K, it.Salt)
+	}
+	return sha1.Sum(it.V)
+}
+
+// Decode unmarshals the value of the item into v
+func (it *Item) Decode(v interface{}) error {
+	return model.UnmarshalBen(bytes.NewReader(it.V), v)
+}
+
+// 签名的内容：salt（若有）、seq和v的bencode编码
+func signBuf(salt string, seq int, v []byte) []byte {
+	var buf bytes.Buffer
+	if salt != "" {
+		buf.WriteString("4:salt")
+		buf.WriteString(strconv.Itoa(len(salt)))
+		buf.WriteString(":")
+		buf.WriteString(salt)
+	}
+	buf.WriteString("3:seqi")
+	buf.WriteString(strconv.Itoa(seq))
+	buf.WriteString("e1:v")
+	buf.Write(v)
+	return buf.Bytes()
+}
+
+// 校验数据大小和可变数据的签名，返回失败时对应的KRPC错误
+func (it *Item) verify() *Error {
+	if len(it.V) == 0 || len(it.V) > MaxValueLen {
+		return &Error{ErrValueTooBig, "message (v field) too big"}
+	}
+	if !it.Mutable() {
+		return nil
+	}
+	if len(it.Salt) > MaxSaltLen {
+		return &Error{ErrSaltTooBig, "salt (salt field) too big"}
+	}
+	if len(it.K) != ed25519.PublicKeySize || len(it.Sig) != ed25519.SignatureSize ||
+		!ed25519.Verify(it.K, signBuf(it.Salt, it.Seq, it.V), it.Sig) {
+		return &Error{ErrInvalidSig, "invalid signature"}
+	}
+	return nil
+}
+
+type storedItem struct {
+	item *Item
+	put  time.Time
+}
+
+// 其他节点通过put存储的数据
+type itemStore struct {
+	mu    sync.Mutex
+	items map[ID]storedItem
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[ID]storedItem)}
+}
+
+func (is *itemStore) get(target ID) *Item {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	st, ok := is.items[target]
+	if !ok {
+		return nil
+	}
+	if time.Since(st.put) > ItemTTL {
+		delete(is.items, target)
+		return nil
+	}
+	return st.item
+}
+
+// 存储已校验的数据，可变数据按seq和cas规则替换旧值
+func (is *itemStore) put(it *Item, cas *int) *Error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	target := it.Target()
+	old, ok := is.items[target]
+	if ok && time.Since(old.put) > ItemTTL {
+		ok = false
+	}
+	if ok && it.Mutable() {
+		if cas != nil && *cas != old.item.Seq {
+			return &Error{ErrCasMismatch, "CAS mismatch, re-read value and try again"}
+		}
+		if it.Seq < old.item.Seq || (it.Seq == old.item.Seq && !bytes.Equal(it.V, old.item.V)) {
+			return &Error{ErrSeqLessThanCurr, "sequence number less than current"}
+		}
+	}
+	if !ok && len(is.items) >= MaxItems {
+		for t, st := range is.items {
+			if time.Since(st.put) > ItemTTL {
+				delete(is.items, t)
+			}
+		}
+		if len(is.items) >= MaxItems {
+			return &Error{ErrServer, "storage full"}
+		}
+	}
+	is.items[target] = storedItem{it, time.Now()}
+	return nil
+}
@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMutableItemSignature(t *testing.T) {
+	// BEP 44 中给出的测试向量
+	pub, _ := hex.DecodeString("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	assert.Equal(t, "4a533d47ec9c7d95b1ad75f576cffc641853b750", MutableTarget(pub, "").String())
+	assert.Equal(t, "411eba73b6f087ca51a3795d9c8c938d365e32c1", MutableTarget(pub, "foobar").String())
+	v := []byte("12:Hello World!")
+	assert.Equal(t, "3:seqi1e1:v12:Hello World!", string(signBuf("", 1, v)))
+	assert.Equal(t, "4:salt6:foobar3:seqi1e1:v12:Hello World!", string(signBuf("foobar", 1, v)))
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	it, err := NewMutableItem(key, "Hello World!", "foobar", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, string(v), string(it.V))
+	assert.Equal(t, MutableTarget(it.K, "foobar"), it.Target())
+	assert.Nil(t, it.verify())
+
+	it.Seq = 2
+	if kerr := it.verify(); assert.NotNil(t, kerr) {
+		assert.Equal(t, ErrInvalidSig, kerr.Code)
+	}
+	_, err = NewMutableItem(key, "x", string(make([]byte, MaxSaltLen+1)), 1)
+	assert.Error(t, err)
+}
+
+func TestItemStoreSeqAndCas(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	is := newItemStore()
+	v1, _ := NewMutableItem(key, "v1", "", 1)
+	v2, _ := NewMutableItem(key, "v2", "", 2)
+	other, _ := NewMutableItem(key, "other", "", 2)
+	assert.Nil(t, is.put(v2, nil))
+	// 相同的数据可以重新存储以刷新过期时间
+	assert.Nil(t, is.put(v2, nil))
+	assert.Equal(t, ErrSeqLessThanCurr, is.put(v1, nil).Code)
+	assert.Equal(t, ErrSeqLessThanCurr, is.put(other, nil).Code)
+	v3, _ := NewMutableItem(key, "v3", "", 3)
+	assert.Equal(t, ErrCasMismatch, is.put(v3, &v1.Seq).Code)
+	assert.Nil(t, is.put(v3, &v2.Seq))
+	assert.Equal(t, "2:v3", string(is.get(v3.Target()).V))
+}
+
+func TestImmutableItem(t *testing.T) {
+	it, err := NewImmutableItem("Hello World!")
+	assert.NoError(t, err)
+	assert.Equal(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb", it.Target().String())
+	assert.False(t, it.Mutable())
+	_, err = NewImmutableItem(string(make([]byte, MaxValueLen)))
+	assert.Error(t, err)
+}
+
+func TestPutGetItems(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	servers := newTestNetwork(t, ctx, 16)
+
+	it, err := NewImmutableItem([]string{"release", "notes"})
+	assert.NoError(t, err)
+	n, err := servers[2].Put(ctx, it)
+	assert.NoError(t, err)
+	assert.Greater(t, n, 0)
+	got, err := servers[11].GetImmutable(ctx, it.Target())
+	assert.NoError(t, err)
+	var value []string
+	assert.NoError(t, got.Decode(&value))
+	assert.Equal(t, []string{"release", "notes"}, value)
+	_, err = servers[11].GetImmutable(ctx, sha1.Sum([]byte("missing")))
+	assert.ErrorIs(t, err, ErrItemNotFound)
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	pub := key.Public().(ed25519.PublicKey)
+	v1, _ := NewMutableItem(key, "v1", "salt", 1)
+	_, err = servers[4].Put(ctx, v1)
+	assert.NoError(t, err)
+	v2, _ := NewMutableItem(key, "v2", "salt", 2)
+	_, err = servers[5].PutCAS(ctx, v2, 1)
+	assert.NoError(t, err)
+	got, err = servers[13].GetMutable(ctx, pub, "salt")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, got.Seq)
+	assert.Equal(t, "2:v2", string(got.V))
+
+	// 旧的数据不会覆盖最新的数据
+	servers[6].Put(ctx, v1)
+	got, err = servers[13].GetMutable(ctx, pub, "salt")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, got.Seq)
+	_, err = servers[13].GetMutable(ctx, pub, "other salt")
+	assert.ErrorIs(t, err, ErrItemNotFound)
+}
+
+func TestFollowTorrent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	servers := newTestNetwork(t, ctx, 12)
+	_, key, _ := ed25519.GenerateKey(nil)
+	pub := key.Public().(ed25519.PublicKey)
+
+	first, second := RandomID(), RandomID()
+	seq, err := servers[1].PublishTorrent(ctx, key, "", first)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, seq)
+	infoHash, seq, err := servers[8].FollowTorrent(ctx, pub, "")
+	assert.NoError(t, err)
+	assert.Equal(t, first, infoHash)
+	assert.Equal(t, 0, seq)
+
+	seq, err = servers[2].PublishTorrent(ctx, key, "", second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, seq)
+	infoHash, seq, err = servers[9].FollowTorrent(ctx, pub, "")
+	assert.NoError(t, err)
+	assert.Equal(t, second, infoHash)
+	assert.Equal(t, 1, seq)
+}
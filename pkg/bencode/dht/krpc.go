@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/model"
+)
+
+// KRPC 消息类型
+const (
+	krpcQuery    = "q"
+	krpcResponse = "r"
+	krpcError    = "e"
+)
+
+// KRPC 方法
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+	methodGet          = "get"
+	methodPut          = "put"
+)
+
+// KRPC 错误码
+const (
+	ErrGeneric  = 201
+	ErrServer   = 202
+	ErrProtocol = 203
+	ErrMethod   = 204
+)
+
+// Error is a KRPC error returned by a remote node
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Msg)
+}
+
+// 字段按键名排序声明，保证编码结果有序
+// seq和cas可以为0，用指针区分是否存在
+type krpcArgs struct {
+	Cas         *int             `bencode:"cas,omitempty"`
+	ID          string           `bencode:"id"`
+	ImpliedPort int              `bencode:"implied_port,omitempty"`
+	InfoHash    string           `bencode:"info_hash,omitempty"`
+	K           string           `bencode:"k,omitempty"`
+	Port        int              `bencode:"port,omitempty"`
+	Salt        string           `bencode:"salt,omitempty"`
+	Seq         *int             `bencode:"seq,omitempty"`
+	Sig         string           `bencode:"sig,omitempty"`
+	Target      string           `bencode:"target,omitempty"`
+	Token       string           `bencode:"token,omitempty"`
+	V           model.RawMessage `bencode:"v,omitempty"`
+}
+
+type krpcReturn struct {
+	ID     string           `bencode:"id"`
+	K      string           `bencode:"k,omitempty"`
+	Nodes  string           `bencode:"nodes,omitempty"`
+	Nodes6 string           `bencode:"nodes6,omitempty"`
+	Seq    *int             `bencode:"seq,omitempty"`
+	Sig    string           `bencode:"sig,omitempty"`
+	Token  string           `bencode:"token,omitempty"`
+	V      model.RawMessage `bencode:"v,omitempty"`
+	Values []string         `bencode:"values,omitempty"`
+}
+
+type krpcMsg struct {
+	A krpcArgs      `bencode:"a,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+	Q string        `bencode:"q,omitempty"`
+	R krpcReturn    `bencode:"r,omitempty"`
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+}
+
+func (m *krpcMsg) encode() []byte {
+	var buf bytes.Buffer
+	model.MarshalBen(&buf, m)
+	return buf.Bytes()
+}
+
+func decodeMsg(b []byte) (*krpcMsg, error) {
+	m := new(krpcMsg)
+	err := model.UnmarshalBen(bytes.NewReader(b), m)
+	if err != nil {
+		return nil, err
+	}
+	if m.T == "" {
+		return nil, fmt.Errorf("krpc message without transaction id")
+	}
+	return m, nil
+}
+
+// 错误响应中的错误，格式不正确时作为一般错误处理
+func (m *krpcMsg) err() error {
+	e := &Error{Code: ErrGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int); ok {
+			e.Code = code
+		}
+	}
+	if len(m.E) > 1 {
+		if msg, ok := m.E[1].(string); ok {
+			e.Msg = msg
+		}
+	}
+	return e
+}
+
+// 解析20字节的ID
+func parseID(s string) (ID, error) {
+	var id ID
+	if len(s) != IDLen {
+		return id, fmt.Errorf("invalid id length %d", len(s))
+	}
+	copy(id[:], s)
+	return id, nil
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"context"
+	"slices"
+)
+
+// Alpha is the number of concurrent queries of an iterative lookup
+const Alpha = 3
+
+// 迭代查询中的候选节点
+type candidate struct {
+	node    *Node
+	queried bool
+	failed  bool
+	// get_peers响应中的token，用于announce_peer
+	token string
+}
+
+type lookupResult struct {
+	peers []Peer
+	// 所有节点的响应
+	replies []*krpcReturn
+	// 回应了查询的最近K个节点
+	closest []*candidate
+}
+
+type lookupReply struct {
+	c   *candidate
+	msg *krpcMsg
+	err error
+}
+
+// 迭代地向离target最近的节点发起q查询，直到最近的K个节点都已查询过
+func (s *Server) lookup(ctx context.Context, target ID, q string) *lookupResult {
+	var list []*candidate
+	seen := make(map[string]bool)
+	add := func(n *Node) {
+		key := n.Addr.String()
+		if n.ID == s.id || seen[key] {
+			return
+		}
+		seen[key] = true
+		list = append(list, &candidate{node: n})
+	}
+	for _, n := range s.table.Closest(target, K) {
+		add(n)
+	}
+	sortCandidates(list, target)
+
+	res := &lookupResult{}
+	peerSeen := make(map[string]bool)
+	replies := make(chan lookupReply, Alpha)
+	inflight := 0
+	args := krpcArgs{Target: string(target[:])}
+	if q == methodGetPeers {
+		args = krpcArgs{InfoHash: string(target[:])}
+	}
+	for ctx.Err() == nil {
+		// 在最近的K个可用节点中选择尚未查询的节点
+		considered := 0
+		for _, c := range list {
+			if inflight >= Alpha || considered >= K {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			considered++
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inflight++
+			go func(c *candidate) {
+				msg, err := s.queryNode(ctx, c.node, q, args)
+				replies <- lookupReply{c, msg, err}
+			}(c)
+		}
+		if inflight == 0 {
+			break
+		}
+		var r lookupReply
+		select {
+		case r = <-replies:
+		case <-ctx.Done():
+			return res
+		}
+		inflight--
+		if r.err != nil {
+			r.c.failed = true
+			continue
+		}
+		r.c.token = r.msg.R.Token
+		res.replies = append(res.replies, &r.msg.R)
+		for _, n := range responseNodes(&r.msg.R) {
+			add(n)
+		}
+		for _, v := range r.msg.R.Values {
+			p, err := parseCompactPeer(v)
+			if err != nil || peerSeen[v] {
+				continue
+			}
+			peerSeen[v] = true
+			res.peers = append(res.peers, p)
+		}
+		sortCandidates(list, target)
+	}
+	for _, c := range list {
+		if len(res.closest) == K {
+			break
+		}
+		if c.queried && !c.failed {
+			res.closest = append(res.closest, c)
+		}
+	}
+	return res
+}
+
+func sortCandidates(list []*candidate, target ID) {
+	slices.SortFunc(list, func(a, b *candidate) int {
+		return compareDistance(target, a.node.ID, b.node.ID)
+	})
+}
@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+)
+
+// 可变种子在DHT中的值，ih指向最新的info hash (BEP 46)
+type torrentPointer struct {
+	IH string `bencode:"ih"`
+}
+
+// PublishTorrent points the mutable item of the key and salt at the info hash
+// (BEP 46), using the sequence number after the one currently published.
+// It returns the sequence number of the new item.
+func (s *Server) PublishTorrent(ctx context.Context, key ed25519.PrivateKey, salt string, infoHash ID) (int, error) {
+	seq := 0
+	var cas *int
+	cur, err := s.GetMutable(ctx, key.Public().(ed25519.PublicKey), salt)
+	switch {
+	case err == nil:
+		seq = cur.Seq + 1
+		cas = &cur.Seq
+	case !errors.Is(err, ErrItemNotFound):
+		return 0, err
+	}
+	it, err := NewMutableItem(key, torrentPointer{IH: string(infoHash[:])}, salt, seq)
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.put(ctx, it, cas)
+	return seq, err
+}
+
+// FollowTorrent resolves the info hash the public key and salt currently
+// point at (BEP 46), along with the sequence number of the pointer
+func (s *Server) FollowTorrent(ctx context.Context, k ed25519.PublicKey, salt string) (ID, int, error) {
+	it, err := s.GetMutable(ctx, k, salt)
+	if err != nil {
+		return ID{}, 0, err
+	}
+	p := new(torrentPointer)
+	err = it.Decode(p)
+	if err != nil {
+		return ID{}, 0, err
+	}
+	infoHash, err := parseID(p.IH)
+	if err != nil {
+		return ID{}, 0, err
+	}
+	return infoHash, it.Seq, nil
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"net"
+	"strconv"
+	"time"
+)
+
+// IDLen is the length of node IDs and info hashes
+const IDLen = 20
+
+// 紧凑格式的节点信息：20字节ID加IP和端口
+const (
+	compactNodeLen  = IDLen + net.IPv4len + 2
+	compactNode6Len = IDLen + net.IPv6len + 2
+)
+
+// ID is a node ID or an info hash, both live in the same 160 bit space
+type ID [IDLen]byte
+
+// RandomID generates a random node ID
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// 两个ID的异或距离
+func (id ID) xor(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// 两个ID共同前缀的比特数，决定节点落在哪个k桶
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IDLen * 8
+}
+
+// 比较a和b到target的距离，a更近时为负数
+func compareDistance(target, a, b ID) int {
+	da, db := target.xor(a), target.xor(b)
+	return bytes.Compare(da[:], db[:])
+}
+
+// Node is a DHT node known to the routing table
+type Node struct {
+	ID   ID
+	Addr *net.UDPAddr
+	// 最近一次收到该节点消息的时间，以及之后连续未回应的查询次数
+	lastSeen time.Time
+	failures int
+}
+
+// 节点是否已经不可用，可以被新节点替换
+func (n *Node) bad() bool {
+	return n.failures >= MaxFailures || time.Since(n.lastSeen) > BadNodeAge
+}
+
+// Peer is a BitTorrent peer announced for an info hash
+type Peer struct {
+	IP   net.IP
+	Port uint16
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// 紧凑格式的peer，IPv4为6字节，IPv6为18字节
+func compactAddr(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], uint16(port))
+	return string(buf)
+}
+
+func parseCompactPeer(s string) (Peer, error) {
+	if len(s) != net.IPv4len+2 && len(s) != net.IPv6len+2 {
+		return Peer{}, errors.New("malformed compact peer")
+	}
+	ipLen := len(s) - 2
+	return Peer{
+		IP:   net.IP([]byte(s[:ipLen])),
+		Port: binary.BigEndian.Uint16([]byte(s[ipLen:])),
+	}, nil
+}
+
+// 将节点编码为紧凑格式，IPv4节点放在nodes中，IPv6节点放在nodes6中
+func encodeNodes(nodes []*Node) (nodes4, nodes6 string) {
+	var b4, b6 bytes.Buffer
+	for _, n := range nodes {
+		if n.Addr.IP.To4() != nil {
+			b4.Write(n.ID[:])
+			b4.WriteString(compactAddr(n.Addr.IP, n.Addr.Port))
+		} else {
+			b6.Write(n.ID[:])
+			b6.WriteString(compactAddr(n.Addr.IP, n.Addr.Port))
+		}
+	}
+	return b4.String(), b6.String()
+}
+
+// 解析紧凑格式的节点列表，size为每个节点的长度
+func decodeNodes(s string, size int) ([]*Node, error) {
+	if len(s)%size != 0 {
+		return nil, errors.New("malformed compact node list")
+	}
+	nodes := make([]*Node, 0, len(s)/size)
+	for i := 0; i < len(s); i += size {
+		entry := []byte(s[i : i+size])
+		n := &Node{Addr: &net.UDPAddr{
+			IP:   net.IP(entry[IDLen : size-2]),
+			Port: int(binary.BigEndian.Uint16(entry[size-2:])),
+		}}
+		copy(n.ID[:], entry[:IDLen])
+		if n.Addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
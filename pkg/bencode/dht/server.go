@@ -0,0 +1,599 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultAddr is the UDP address a node listens on when none is configured
+const DefaultAddr = ":6881"
+
+// QueryTimeout is how long to wait for a response to a query
+const QueryTimeout = 5 * time.Second
+
+// RefreshInterval is how often the routing table is refreshed
+const RefreshInterval = 15 * time.Minute
+
+// DefaultBootstrapNodes are well known routers used to join the DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// ErrTimeout is returned when a node does not answer a query in time
+var ErrTimeout = errors.New("dht query timed out")
+
+// ErrClosed is returned by queries on a closed server
+var ErrClosed = errors.New("dht server closed")
+
+// Config configures a DHT node, zero values select the defaults
+type Config struct {
+	// ID of the node, random unless configured or restored from StateFile
+	ID ID
+	// Addr is the UDP address to listen on, ignored when Conn is set
+	Addr string
+	// Conn is an already open packet connection to use instead of listening on Addr
+	Conn net.PacketConn
+	// BootstrapNodes are host:port addresses used to join the DHT
+	BootstrapNodes []string
+	QueryTimeout   time.Duration
+	// StateFile persists the node ID and routing table across runs
+	StateFile string
+}
+
+// Server is a mainline DHT node (BEP 5)
+type Server struct {
+	id        ID
+	conn      net.PacketConn
+	table     *RoutingTable
+	tokens    *tokenManager
+	peers     *peerStore
+	items     *itemStore
+	bootstrap []string
+	timeout   time.Duration
+	stateFile string
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	tid     uint16
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// 等待响应的查询
+type transaction struct {
+	addr *net.UDPAddr
+	res  chan *krpcMsg
+}
+
+// NewServer starts a DHT node. The routing table starts empty unless it is
+// restored from Config.StateFile; call Bootstrap to join the network.
+func NewServer(cfg Config) (*Server, error) {
+	s := &Server{
+		id:        cfg.ID,
+		conn:      cfg.Conn,
+		tokens:    newTokenManager(),
+		peers:     newPeerStore(),
+		items:     newItemStore(),
+		bootstrap: cfg.BootstrapNodes,
+		timeout:   cfg.QueryTimeout,
+		stateFile: cfg.StateFile,
+		pending:   make(map[string]*transaction),
+		done:      make(chan struct{}),
+	}
+	if s.bootstrap == nil {
+		s.bootstrap = DefaultBootstrapNodes
+	}
+	if s.timeout <= 0 {
+		s.timeout = QueryTimeout
+	}
+	var saved *State
+	if s.stateFile != "" {
+		st, err := LoadStateFile(s.stateFile)
+		if err == nil {
+			saved = st
+		} else {
+			log.Println("dht: ignore state file:", err)
+		}
+	}
+	if s.id == (ID{}) && saved != nil {
+		s.id = saved.ID
+	}
+	if s.id == (ID{}) {
+		s.id = RandomID()
+	}
+	s.table = NewRoutingTable(s.id)
+	if saved != nil {
+		for _, n := range saved.Nodes {
+			s.table.Insert(n)
+		}
+	}
+	if s.conn == nil {
+		addr := cfg.Addr
+		if addr == "" {
+			addr = DefaultAddr
+		}
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	go s.serve()
+	go s.refresh()
+	return s, nil
+}
+
+// ID is the node ID of the server
+func (s *Server) ID() ID {
+	return s.id
+}
+
+// Addr is the local UDP address of the server
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Table is the routing table of the server
+func (s *Server) Table() *RoutingTable {
+	return s.table
+}
+
+// Close stops the server, saving its state when a state file is configured
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.stateFile != "" {
+			err = s.SaveFile(s.stateFile)
+		}
+		cerr := s.conn.Close()
+		if err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// 读取UDP报文，查询交给handleQuery，响应交给等待中的查询
+func (s *Server) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Y {
+		case krpcQuery:
+			s.handleQuery(udp, msg)
+		case krpcResponse, krpcError:
+			s.deliver(udp, msg)
+		}
+	}
+}
+
+func (s *Server) send(addr *net.UDPAddr, msg *krpcMsg) error {
+	_, err := s.conn.WriteTo(msg.encode(), addr)
+	return err
+}
+
+func (s *Server) reply(addr *net.UDPAddr, t string, r krpcReturn) {
+	r.ID = string(s.id[:])
+	s.send(addr, &krpcMsg{T: t, Y: krpcResponse, R: r})
+}
+
+func (s *Server) replyError(addr *net.UDPAddr, t string, code int, msg string) {
+	s.send(addr, &krpcMsg{T: t, Y: krpcError, E: []interface{}{code, msg}})
+}
+
+// 回应其他节点的查询，发送查询的节点被加入路由表
+func (s *Server) handleQuery(addr *net.UDPAddr, msg *krpcMsg) {
+	id, err := parseID(msg.A.ID)
+	if err != nil {
+		s.replyError(addr, msg.T, ErrProtocol, "invalid id")
+		return
+	}
+	s.table.Insert(&Node{ID: id, Addr: addr, lastSeen: time.Now()})
+	switch msg.Q {
+	case methodPing:
+		s.reply(addr, msg.T, krpcReturn{})
+	case methodFindNode:
+		target, err := parseID(msg.A.Target)
+		if err != nil {
+			s.replyError(addr, msg.T, ErrProtocol, "invalid target")
+			return
+		}
+		r := krpcReturn{}
+		r.Nodes, r.Nodes6 = encodeNodes(s.table.Closest(target, K))
+		s.reply(addr, msg.T, r)
+	case methodGetPeers:
+		infoHash, err := parseID(msg.A.InfoHash)
+		if err != nil {
+			s.replyError(addr, msg.T, ErrProtocol, "invalid info_hash")
+			return
+		}
+		r := krpcReturn{Token: s.tokens.token(addr.IP)}
+		r.Values = s.peers.get(infoHash)
+		if len(r.Values) == 0 {
+			r.Nodes, r.Nodes6 = encodeNodes(s.table.Closest(infoHash, K))
+		}
+		s.reply(addr, msg.T, r)
+	case methodAnnouncePeer:
+		infoHash, err := parseID(msg.A.InfoHash)
+		if err != nil {
+			s.replyError(addr, msg.T, ErrProtocol, "invalid info_hash")
+			return
+		}
+		if !s.tokens.valid(msg.A.Token, addr.IP) {
+			s.replyError(addr, msg.T, ErrProtocol, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 0xffff {
+			s.replyError(addr, msg.T, ErrProtocol, "invalid port")
+			return
+		}
+		s.peers.add(infoHash, compactAddr(addr.IP, port))
+		s.reply(addr, msg.T, krpcReturn{})
+	case methodGet:
+		target, err := parseID(msg.A.Target)
+		if err != nil {
+			s.replyError(addr, msg.T, ErrProtocol, "invalid target")
+			return
+		}
+		r := krpcReturn{Token: s.tokens.token(addr.IP)}
+		r.Nodes, r.Nodes6 = encodeNodes(s.table.Closest(target, K))
+		if it := s.items.get(target); it != nil {
+			r.V = it.V
+			if it.Mutable() {
+				seq := it.Seq
+				r.K, r.Seq, r.Sig = string(it.K), &seq, string(it.Sig)
+				// 对方已有不旧于seq的数据时不返回v
+				if msg.A.Seq != nil && it.Seq <= *msg.A.Seq {
+					r.V = nil
+				}
+			}
+		}
+		s.reply(addr, msg.T, r)
+	case methodPut:
+		if !s.tokens.valid(msg.A.Token, addr.IP) {
+			s.replyError(addr, msg.T, ErrProtocol, "bad token")
+			return
+		}
+		it := &Item{V: msg.A.V, K: ed25519.PublicKey(msg.A.K), Salt: msg.A.Salt, Sig: []byte(msg.A.Sig)}
+		if it.Mutable() {
+			if msg.A.Seq == nil {
+				s.replyError(addr, msg.T, ErrProtocol, "missing seq")
+				return
+			}
+			it.Seq = *msg.A.Seq
+		}
+		if kerr := it.verify(); kerr != nil {
+			s.replyError(addr, msg.T, kerr.Code, kerr.Msg)
+			return
+		}
+		if kerr := s.items.put(it, msg.A.Cas); kerr != nil {
+			s.replyError(addr, msg.T, kerr.Code, kerr.Msg)
+			return
+		}
+		s.reply(addr, msg.T, krpcReturn{})
+	default:
+		s.replyError(addr, msg.T, ErrMethod, "method unknown")
+	}
+}
+
+// 将响应交给对应的查询，来源地址不符的响应被忽略
+func (s *Server) deliver(addr *net.UDPAddr, msg *krpcMsg) {
+	s.mu.Lock()
+	tx, ok := s.pending[msg.T]
+	if ok && tx.addr.IP.Equal(addr.IP) && tx.addr.Port == addr.Port {
+		delete(s.pending, msg.T)
+	} else {
+		ok = false
+	}
+	s.mu.Unlock()
+	if ok {
+		tx.res <- msg
+	}
+}
+
+// 向addr发送查询并等待响应，回应的节点被加入路由表
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, q string, args krpcArgs) (*krpcMsg, error) {
+	args.ID = string(s.id[:])
+	tx := &transaction{addr: addr, res: make(chan *krpcMsg, 1)}
+	s.mu.Lock()
+	s.tid++
+	t := make([]byte, 2)
+	binary.BigEndian.PutUint16(t, s.tid)
+	s.pending[string(t)] = tx
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, string(t))
+		s.mu.Unlock()
+	}()
+
+	err := s.send(addr, &krpcMsg{T: string(t), Y: krpcQuery, Q: q, A: args})
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-tx.res:
+		if res.Y == krpcError {
+			return nil, res.err()
+		}
+		id, err := parseID(res.R.ID)
+		if err != nil {
+			return nil, err
+		}
+		s.table.Insert(&Node{ID: id, Addr: addr, lastSeen: time.Now()})
+		return res, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, ErrClosed
+	}
+}
+
+// 查询路由表中已知的节点，超时记为一次失败
+func (s *Server) queryNode(ctx context.Context, n *Node, q string, args krpcArgs) (*krpcMsg, error) {
+	res, err := s.query(ctx, n.Addr, q, args)
+	if errors.Is(err, ErrTimeout) {
+		s.table.Failed(n.ID)
+	}
+	return res, err
+}
+
+// Ping checks that the node at addr is alive and adds it to the routing table
+func (s *Server) Ping(ctx context.Context, addr string) (ID, error) {
+	udp, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return ID{}, err
+	}
+	res, err := s.query(ctx, udp, methodPing, krpcArgs{})
+	if err != nil {
+		return ID{}, err
+	}
+	return parseID(res.R.ID)
+}
+
+// 响应中的所有节点
+func responseNodes(r *krpcReturn) []*Node {
+	nodes, _ := decodeNodes(r.Nodes, compactNodeLen)
+	nodes6, _ := decodeNodes(r.Nodes6, compactNode6Len)
+	return append(nodes, nodes6...)
+}
+
+// Bootstrap joins the DHT through the bootstrap nodes and the nodes already
+// in the routing table by looking up the server's own ID
+func (s *Server) Bootstrap(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, addr := range s.bootstrap {
+		udp, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Println("dht: resolve bootstrap node:", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.query(ctx, udp, methodFindNode, krpcArgs{Target: string(s.id[:])})
+			if err != nil {
+				return
+			}
+			for _, n := range responseNodes(&res.R) {
+				n.lastSeen = time.Now()
+				s.table.Insert(n)
+			}
+		}()
+	}
+	wg.Wait()
+	s.lookup(ctx, s.id, methodFindNode)
+	if s.table.Len() == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return errors.New("dht bootstrap found no nodes")
+	}
+	return nil
+}
+
+// 定期刷新路由表，节点过少时重新加入网络
+func (s *Server) refresh() {
+	tk := time.NewTicker(RefreshInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-s.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), RefreshInterval/2)
+		if s.table.Len() < K {
+			s.Bootstrap(ctx)
+		} else {
+			s.lookup(ctx, RandomID(), methodFindNode)
+		}
+		cancel()
+	}
+}
+
+// 路由表为空时先加入网络
+func (s *Server) ensureBootstrapped(ctx context.Context) error {
+	if s.table.Len() != 0 {
+		return nil
+	}
+	return s.Bootstrap(ctx)
+}
+
+// GetPeers looks up peers of the info hash, bootstrapping first when the
+// routing table is empty
+func (s *Server) GetPeers(ctx context.Context, infoHash ID) ([]Peer, error) {
+	err := s.ensureBootstrapped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.lookup(ctx, infoHash, methodGetPeers).peers, ctx.Err()
+}
+
+// Announce looks up peers of the info hash and announces that we accept
+// peer connections on port to the closest nodes. Port 0 asks them to use
+// the source port of our UDP packets instead (implied_port).
+func (s *Server) Announce(ctx context.Context, infoHash ID, port int) ([]Peer, error) {
+	err := s.ensureBootstrapped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := s.lookup(ctx, infoHash, methodGetPeers)
+	args := krpcArgs{InfoHash: string(infoHash[:]), Port: port}
+	if port == 0 {
+		args.ImpliedPort = 1
+	}
+	_, err = s.store(ctx, res, methodAnnouncePeer, args)
+	return res.peers, err
+}
+
+// 向查找到的最近节点发送带token的announce_peer或put，返回接受的节点数。
+// 没有节点接受时返回最后一个错误
+func (s *Server) store(ctx context.Context, res *lookupResult, q string, args krpcArgs) (int, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	var lastErr error
+	for _, c := range res.closest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n *Node, token string) {
+			defer wg.Done()
+			a := args
+			a.Token = token
+			_, err := s.queryNode(ctx, n, q, a)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			stored++
+		}(c.node, c.token)
+	}
+	wg.Wait()
+	if stored > 0 {
+		return stored, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no dht node to store at")
+	}
+	return 0, lastErr
+}
+
+// Put stores the item on the nodes closest to its target and returns the
+// number of nodes that accepted it
+func (s *Server) Put(ctx context.Context, it *Item) (int, error) {
+	return s.put(ctx, it, nil)
+}
+
+// PutCAS stores a mutable item only where the current sequence number is cas
+func (s *Server) PutCAS(ctx context.Context, it *Item, cas int) (int, error) {
+	return s.put(ctx, it, &cas)
+}
+
+func (s *Server) put(ctx context.Context, it *Item, cas *int) (int, error) {
+	if kerr := it.verify(); kerr != nil {
+		return 0, kerr
+	}
+	err := s.ensureBootstrapped(ctx)
+	if err != nil {
+		return 0, err
+	}
+	res := s.lookup(ctx, it.Target(), methodGet)
+	args := krpcArgs{Cas: cas, K: string(it.K), Salt: it.Salt, Sig: string(it.Sig), V: it.V}
+	if it.Mutable() {
+		seq := it.Seq
+		args.Seq = &seq
+	}
+	return s.store(ctx, res, methodPut, args)
+}
+
+// GetImmutable looks up the immutable item with the target, the SHA-1 of its value
+func (s *Server) GetImmutable(ctx context.Context, target ID) (*Item, error) {
+	err := s.ensureBootstrapped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range s.lookup(ctx, target, methodGet).replies {
+		it := &Item{V: r.V}
+		if len(r.V) != 0 && it.Target() == target {
+			return it, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrItemNotFound
+}
+
+// GetMutable looks up the mutable item of the public key and salt, returning
+// the correctly signed value with the highest sequence number
+func (s *Server) GetMutable(ctx context.Context, k ed25519.PublicKey, salt string) (*Item, error) {
+	err := s.ensureBootstrapped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var best *Item
+	for _, r := range s.lookup(ctx, MutableTarget(k, salt), methodGet).replies {
+		if len(r.V) == 0 || r.Seq == nil || r.K != string(k) {
+			continue
+		}
+		it := &Item{V: r.V, K: k, Salt: salt, Seq: *r.Seq, Sig: []byte(r.Sig)}
+		if it.verify() != nil {
+			continue
+		}
+		if best == nil || it.Seq > best.Seq {
+			best = it
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrItemNotFound
+}
@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, bootstrap ...string) *Server {
+	s, err := NewServer(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: append([]string{}, bootstrap...),
+		QueryTimeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// 启动n个节点，均通过第一个节点加入网络
+func newTestNetwork(t *testing.T, ctx context.Context, n int) []*Server {
+	first := newTestServer(t)
+	servers := []*Server{first}
+	for i := 1; i < n; i++ {
+		s := newTestServer(t, first.Addr().String())
+		assert.NoError(t, s.Bootstrap(ctx))
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, b := newTestServer(t), newTestServer(t)
+	id, err := a.Ping(ctx, b.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID(), id)
+	// 双方都将对方加入路由表
+	assert.Equal(t, 1, a.Table().Len())
+	assert.Equal(t, 1, b.Table().Len())
+
+	b.Close()
+	_, err = a.Ping(ctx, b.Addr().String())
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestQueryErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, b := newTestServer(t), newTestServer(t)
+	addr := b.Addr().(*net.UDPAddr)
+
+	_, err := a.query(ctx, addr, "vote", krpcArgs{})
+	var kerr *Error
+	if assert.ErrorAs(t, err, &kerr) {
+		assert.Equal(t, ErrMethod, kerr.Code)
+	}
+	infoHash := RandomID()
+	_, err = a.query(ctx, addr, methodAnnouncePeer, krpcArgs{InfoHash: string(infoHash[:]), Port: 6881, Token: "forged"})
+	if assert.ErrorAs(t, err, &kerr) {
+		assert.Equal(t, ErrProtocol, kerr.Code)
+	}
+
+	// 无法解析的报文被忽略，节点仍然正常工作
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, junk := range []string{"", "garbage", "d1:t", "d1:ad2:idi3ee1:q4:ping1:t2:aa1:y1:qe", "d1:eli201ee1:t2:zz1:y1:ee"} {
+		conn.Write([]byte(junk))
+	}
+	_, err = a.Ping(ctx, addr.String())
+	assert.NoError(t, err)
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	servers := newTestNetwork(t, ctx, 24)
+	for _, s := range servers {
+		assert.Greater(t, s.Table().Len(), 1)
+	}
+
+	infoHash := RandomID()
+	peers, err := servers[3].GetPeers(ctx, infoHash)
+	assert.NoError(t, err)
+	assert.Empty(t, peers)
+
+	_, err = servers[5].Announce(ctx, infoHash, 6881)
+	assert.NoError(t, err)
+	_, err = servers[9].Announce(ctx, infoHash, 0)
+	assert.NoError(t, err)
+
+	peers, err = servers[17].GetPeers(ctx, infoHash)
+	assert.NoError(t, err)
+	var got []string
+	for _, p := range peers {
+		got = append(got, p.String())
+	}
+	implied := servers[9].Addr().(*net.UDPAddr).Port
+	assert.ElementsMatch(t, []string{"127.0.0.1:6881", net.JoinHostPort("127.0.0.1", strconv.Itoa(implied))}, got)
+}
+
+func TestStatePersistence(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	servers := newTestNetwork(t, ctx, 6)
+	s := servers[1]
+
+	var buf bytes.Buffer
+	assert.NoError(t, s.Save(&buf))
+	st, err := LoadState(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, s.ID(), st.ID)
+	assert.Len(t, st.Nodes, s.Table().Len())
+
+	name := filepath.Join(t.TempDir(), "dht.dat")
+	assert.NoError(t, s.SaveFile(name))
+	restored, err := NewServer(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{}, StateFile: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	assert.Equal(t, s.ID(), restored.ID())
+	assert.Equal(t, s.Table().Len(), restored.Table().Len())
+	// 没有引导节点时仍能通过恢复的路由表加入网络
+	assert.NoError(t, restored.Bootstrap(ctx))
+}
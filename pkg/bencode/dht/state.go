@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"bufio"
+	"errors"
+	"github.com/shoggothforever/torcore/pkg/bencode/model"
+	"io"
+	"os"
+)
+
+// State is the persisted identity and routing table of a node
+type State struct {
+	ID    ID
+	Nodes []*Node
+}
+
+// 状态文件的bencode格式，节点为紧凑格式
+type savedState struct {
+	ID     string `bencode:"id"`
+	Nodes  string `bencode:"nodes,omitempty"`
+	Nodes6 string `bencode:"nodes6,omitempty"`
+}
+
+// Save writes the node ID and the nodes of the routing table to w
+func (s *Server) Save(w io.Writer) error {
+	st := savedState{ID: string(s.id[:])}
+	st.Nodes, st.Nodes6 = encodeNodes(s.table.Nodes())
+	bw := bufio.NewWriter(w)
+	if model.MarshalBen(bw, st) <= 0 {
+		return errors.New("encode dht state failed")
+	}
+	return bw.Flush()
+}
+
+// SaveFile writes the state to the named file, replacing it atomically
+func (s *Server) SaveFile(name string) error {
+	tmp := name + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = s.Save(fd)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// LoadState reads a state written by Save
+func LoadState(r io.Reader) (*State, error) {
+	st := new(savedState)
+	err := model.UnmarshalBen(bufio.NewReader(r), st)
+	if err != nil {
+		return nil, err
+	}
+	id, err := parseID(st.ID)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := decodeNodes(st.Nodes, compactNodeLen)
+	if err != nil {
+		return nil, err
+	}
+	nodes6, err := decodeNodes(st.Nodes6, compactNode6Len)
+	if err != nil {
+		return nil, err
+	}
+	return &State{ID: id, Nodes: append(nodes, nodes6...)}, nil
+}
+
+// LoadStateFile reads the state saved in the named file
+func LoadStateFile(name string) (*State, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return LoadState(fd)
+}
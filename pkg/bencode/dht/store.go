@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// PeerTTL is how long an announced peer is kept without re-announcing
+const PeerTTL = 30 * time.Minute
+
+// MaxPeersPerHash bounds the peers stored for one info hash
+const MaxPeersPerHash = 200
+
+// MaxValues bounds the peers returned in one get_peers response so it fits
+// into a single UDP packet
+const MaxValues = 50
+
+// 其他节点通过announce_peer登记的peer
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]map[string]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[ID]map[string]time.Time)}
+}
+
+// 记录一个peer，键为其紧凑格式
+func (ps *peerStore) add(infoHash ID, compact string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	m := ps.peers[infoHash]
+	if m == nil {
+		m = make(map[string]time.Time)
+		ps.peers[infoHash] = m
+	}
+	ps.expire(m)
+	if _, ok := m[compact]; !ok && len(m) >= MaxPeersPerHash {
+		return
+	}
+	m[compact] = time.Now()
+}
+
+// 返回最多MaxValues个紧凑格式的peer
+func (ps *peerStore) get(infoHash ID) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	m := ps.peers[infoHash]
+	ps.expire(m)
+	if len(m) == 0 {
+		delete(ps.peers, infoHash)
+		return nil
+	}
+	values := make([]string, 0, min(len(m), MaxValues))
+	for compact := range m {
+		if len(values) == MaxValues {
+			break
+		}
+		values = append(values, compact)
+	}
+	return values
+}
+
+func (ps *peerStore) expire(m map[string]time.Time) {
+	for compact, t := range m {
+		if time.Since(t) > PeerTTL {
+			delete(m, compact)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// K is the bucket size and the number of closest nodes a lookup converges on
+const K = 8
+
+// MaxFailures is the number of unanswered queries after which a node is bad
+const MaxFailures = 2
+
+// BadNodeAge is how long a node may stay silent before it can be replaced
+const BadNodeAge = 15 * time.Minute
+
+// RoutingTable is a Kademlia routing table with one k-bucket per shared
+// prefix length with the local ID
+type RoutingTable struct {
+	mu      sync.Mutex
+	self    ID
+	buckets [IDLen*8 + 1][]*Node
+}
+
+func NewRoutingTable(self ID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+func (rt *RoutingTable) bucket(id ID) int {
+	return commonPrefixLen(rt.self, id)
+}
+
+// Insert records that we heard from the node. A full bucket only accepts the
+// node in place of a bad one; Insert reports whether the node is in the table.
+func (rt *RoutingTable) Insert(n *Node) bool {
+	if n.ID == rt.self || n.Addr == nil {
+		return false
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	i := rt.bucket(n.ID)
+	b := rt.buckets[i]
+	for _, old := range b {
+		if old.ID == n.ID {
+			old.Addr = n.Addr
+			old.lastSeen = n.lastSeen
+			old.failures = 0
+			return true
+		}
+	}
+	if len(b) < K {
+		rt.buckets[i] = append(b, n)
+		return true
+	}
+	for j, old := range b {
+		if old.bad() {
+			b[j] = n
+			return true
+		}
+	}
+	return false
+}
+
+// Failed records an unanswered query, bad nodes are dropped once their
+// bucket needs the room
+func (rt *RoutingTable) Failed(id ID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, n := range rt.buckets[rt.bucket(id)] {
+		if n.ID == id {
+			n.failures++
+		}
+	}
+}
+
+// Closest returns up to count known nodes closest to target, bad nodes excluded
+func (rt *RoutingTable) Closest(target ID, count int) []*Node {
+	rt.mu.Lock()
+	var nodes []*Node
+	for _, b := range rt.buckets {
+		for _, n := range b {
+			if n.failures < MaxFailures {
+				cp := *n
+				nodes = append(nodes, &cp)
+			}
+		}
+	}
+	rt.mu.Unlock()
+	sortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Len is the number of nodes in the table
+func (rt *RoutingTable) Len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	l := 0
+	for _, b := range rt.buckets {
+		l += len(b)
+	}
+	return l
+}
+
+// Nodes returns a copy of every node in the table that has not failed
+func (rt *RoutingTable) Nodes() []*Node {
+	return rt.Closest(rt.self, rt.Len())
+}
+
+func sortByDistance(nodes []*Node, target ID) {
+	slices.SortFunc(nodes, func(a, b *Node) int {
+		return compareDistance(target, a.ID, b.ID)
+	})
+}
@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func idWithPrefix(b ...byte) ID {
+	var id ID
+	copy(id[:], b)
+	return id
+}
+
+func testNode(id ID, port int) *Node {
+	return &Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, lastSeen: time.Now()}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	assert.Equal(t, 0, commonPrefixLen(idWithPrefix(0x80), idWithPrefix(0x00)))
+	assert.Equal(t, 7, commonPrefixLen(idWithPrefix(0x01), idWithPrefix(0x00)))
+	assert.Equal(t, 12, commonPrefixLen(idWithPrefix(0xab, 0xc0), idWithPrefix(0xab, 0xc8)))
+	assert.Equal(t, IDLen*8, commonPrefixLen(idWithPrefix(0xab), idWithPrefix(0xab)))
+}
+
+func TestRoutingTableBucketFull(t *testing.T) {
+	rt := NewRoutingTable(ID{})
+	// 全部落在共同前缀为0的桶中
+	for i := 0; i < K; i++ {
+		assert.True(t, rt.Insert(testNode(idWithPrefix(0x80, byte(i)), 1000+i)))
+	}
+	extra := testNode(idWithPrefix(0x80, 0xff), 2000)
+	assert.False(t, rt.Insert(extra))
+	assert.Equal(t, K, rt.Len())
+
+	// 已有节点更新地址，不占用新的位置
+	assert.True(t, rt.Insert(testNode(idWithPrefix(0x80, 0), 3000)))
+	assert.Equal(t, K, rt.Len())
+
+	// 连续失败的节点被新节点替换
+	for i := 0; i < MaxFailures; i++ {
+		rt.Failed(idWithPrefix(0x80, 1))
+	}
+	assert.True(t, rt.Insert(extra))
+	assert.Equal(t, K, rt.Len())
+	for _, n := range rt.Nodes() {
+		assert.NotEqual(t, idWithPrefix(0x80, 1), n.ID)
+	}
+	assert.False(t, rt.Insert(testNode(ID{}, 1)), "own id")
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := NewRoutingTable(RandomID())
+	for i := 0; i < 200; i++ {
+		rt.Insert(testNode(RandomID(), 1000+i))
+	}
+	target := RandomID()
+	closest := rt.Closest(target, K)
+	assert.Len(t, closest, K)
+	for i := 1; i < len(closest); i++ {
+		assert.Negative(t, compareDistance(target, closest[i-1].ID, closest[i].ID))
+	}
+	for _, n := range rt.Nodes() {
+		assert.False(t, compareDistance(target, n.ID, closest[K-1].ID) < 0 && !containsNode(closest, n.ID))
+	}
+}
+
+func containsNode(nodes []*Node, id ID) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCompactNodes(t *testing.T) {
+	n4 := testNode(RandomID(), 6881)
+	n6 := &Node{ID: RandomID(), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}}
+	nodes4, nodes6 := encodeNodes([]*Node{n4, n6})
+	assert.Len(t, nodes4, compactNodeLen)
+	assert.Len(t, nodes6, compactNode6Len)
+
+	got, err := decodeNodes(nodes4, compactNodeLen)
+	assert.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, n4.ID, got[0].ID)
+		assert.Equal(t, n4.Addr.String(), got[0].Addr.String())
+	}
+	got, err = decodeNodes(nodes6, compactNode6Len)
+	assert.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, n6.Addr.String(), got[0].Addr.String())
+	}
+	_, err = decodeNodes(nodes4[1:], compactNodeLen)
+	assert.Error(t, err)
+
+	p, err := parseCompactPeer(compactAddr(net.IPv4(10, 1, 2, 3), 6881))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.2.3:6881", p.String())
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenRotation is how often the token secret changes, tokens stay valid
+// for up to twice as long (BEP 5)
+const TokenRotation = 5 * time.Minute
+
+// get_peers返回的token由请求方IP和定期更换的密钥计算，announce_peer时校验
+type tokenManager struct {
+	mu      sync.Mutex
+	secret  [8]byte
+	prev    [8]byte
+	rotated time.Time
+}
+
+func newTokenManager() *tokenManager {
+	tm := &tokenManager{rotated: time.Now()}
+	rand.Read(tm.secret[:])
+	tm.prev = tm.secret
+	return tm
+}
+
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotated) < TokenRotation {
+		return
+	}
+	tm.prev = tm.secret
+	rand.Read(tm.secret[:])
+	tm.rotated = time.Now()
+}
+
+func tokenFor(secret [8]byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.New()
+	h.Write(ip)
+	h.Write(secret[:])
+	return string(h.Sum(nil)[:8])
+}
+
+func (tm *tokenManager) token(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate()
+	return tokenFor(tm.secret, ip)
+}
+
+// 当前或上一个密钥生成的token均有效
+func (tm *tokenManager) valid(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate()
+	return token == tokenFor(tm.secret, ip) || token == tokenFor(tm.prev, ip)
+}
@@ -0,0 +1,287 @@
+package lsd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnnounceInterval is how often the watched info hashes are announced
+const AnnounceInterval = 5 * time.Minute
+
+// MinAnnounceInterval rate limits announces of one info hash
+const MinAnnounceInterval = time.Minute
+
+// MaxHashesPerPacket bounds the Infohash headers of one announce
+const MaxHashesPerPacket = 16
+
+const searchLine = "BT-SEARCH * HTTP/1.1"
+
+// Peer is a peer found on the local network
+type Peer struct {
+	IP   net.IP
+	Port uint16
+}
+
+// Announce is a parsed BT-SEARCH packet
+type Announce struct {
+	Host       string
+	Port       int
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+// Marshal encodes the announce as a BT-SEARCH packet
+func (a *Announce) Marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(searchLine + "\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", a.Host)
+	fmt.Fprintf(&buf, "Port: %d\r\n", a.Port)
+	for _, ih := range a.InfoHashes {
+		fmt.Fprintf(&buf, "Infohash: %s\r\n", hex.EncodeToString(ih[:]))
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", a.Cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// ParseAnnounce parses a BT-SEARCH packet, header names are case insensitive
+// and unknown headers are ignored
+func ParseAnnounce(b []byte) (*Announce, error) {
+	lines := strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != searchLine {
+		return nil, errors.New("not a BT-SEARCH packet")
+	}
+	a := new(Announce)
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "host":
+			a.Host = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 0xffff {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			a.Port = port
+		case "infohash":
+			buf, err := hex.DecodeString(value)
+			if err != nil || len(buf) != 20 {
+				continue
+			}
+			if len(a.InfoHashes) < MaxHashesPerPacket {
+				a.InfoHashes = append(a.InfoHashes, [20]byte(buf))
+			}
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+	if a.Port == 0 || len(a.InfoHashes) == 0 {
+		return nil, errors.New("BT-SEARCH without port or info hash")
+	}
+	return a, nil
+}
+
+// Config configures the discovery service
+type Config struct {
+	// Transports default to the IPv4 and the IPv6 multicast groups, a group
+	// that cannot be joined is skipped
+	Transports []Transport
+	Interval   time.Duration
+}
+
+type watch struct {
+	port     int
+	handlers map[int]func(Peer)
+	lastSent time.Time
+}
+
+// Service announces the info hashes being watched on the local network and
+// reports the peers announcing them (BEP 14)
+type Service struct {
+	transports []Transport
+	interval   time.Duration
+	// 随机cookie，用于忽略自己发出的报文
+	cookie string
+
+	mu      sync.Mutex
+	watches map[[20]byte]*watch
+	nextID  int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New starts local service discovery
+func New(cfg Config) (*Service, error) {
+	s := &Service{
+		transports: cfg.Transports,
+		interval:   cfg.Interval,
+		watches:    make(map[[20]byte]*watch),
+		done:       make(chan struct{}),
+	}
+	if s.interval <= 0 {
+		s.interval = AnnounceInterval
+	}
+	if s.transports == nil {
+		for _, g := range []struct{ network, group string }{{"udp4", IPv4Group}, {"udp6", IPv6Group}} {
+			t, err := NewMulticastTransport(g.network, g.group)
+			if err != nil {
+				log.Println("lsd: skip", g.group, err)
+				continue
+			}
+			s.transports = append(s.transports, t)
+		}
+	}
+	if len(s.transports) == 0 {
+		return nil, errors.New("no multicast group could be joined")
+	}
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	s.cookie = hex.EncodeToString(cookie)
+	for _, t := range s.transports {
+		go s.receive(t)
+	}
+	go s.announceLoop()
+	return s, nil
+}
+
+// Close leaves the multicast groups
+func (s *Service) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, t := range s.transports {
+			if cerr := t.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Watch reports the peers announcing the info hash to fn until the returned
+// function is called. When port is not 0 the info hash is also announced,
+// telling others that we accept peer connections on port.
+func (s *Service) Watch(infoHash [20]byte, port int, fn func(Peer)) func() {
+	s.mu.Lock()
+	w, ok := s.watches[infoHash]
+	if !ok {
+		w = &watch{handlers: make(map[int]func(Peer))}
+		s.watches[infoHash] = w
+	}
+	if port != 0 {
+		w.port = port
+	}
+	id := s.nextID
+	s.nextID++
+	w.handlers[id] = fn
+	s.mu.Unlock()
+
+	s.announce()
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(w.handlers, id)
+		if len(w.handlers) == 0 && s.watches[infoHash] == w {
+			delete(s.watches, infoHash)
+		}
+	}
+}
+
+// 每隔interval重新announce一次所有需要announce的info hash
+func (s *Service) announceLoop() {
+	tk := time.NewTicker(s.interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			s.announce()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// 发送距上次announce超过MinAnnounceInterval的info hash，按端口分组
+func (s *Service) announce() {
+	s.mu.Lock()
+	byPort := make(map[int][][20]byte)
+	now := time.Now()
+	for ih, w := range s.watches {
+		if w.port == 0 || now.Sub(w.lastSent) < min(MinAnnounceInterval, s.interval) {
+			continue
+		}
+		w.lastSent = now
+		byPort[w.port] = append(byPort[w.port], ih)
+	}
+	s.mu.Unlock()
+	for port, hashes := range byPort {
+		for len(hashes) > 0 {
+			n := min(len(hashes), MaxHashesPerPacket)
+			for _, t := range s.transports {
+				a := &Announce{Host: t.Host(), Port: port, InfoHashes: hashes[:n], Cookie: s.cookie}
+				err := t.Send(a.Marshal())
+				if err != nil {
+					log.Println("lsd: announce on", t.Host(), "failed:", err)
+				}
+			}
+			hashes = hashes[n:]
+		}
+	}
+}
+
+// 接收其他peer的announce，交给对应info hash的处理函数
+func (s *Service) receive(t Transport) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := t.Receive(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		a, err := ParseAnnounce(buf[:n])
+		if err != nil || a.Cookie == s.cookie {
+			continue
+		}
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		peer := Peer{IP: udp.IP, Port: uint16(a.Port)}
+		for _, ih := range a.InfoHashes {
+			s.mu.Lock()
+			var handlers []func(Peer)
+			if w, ok := s.watches[ih]; ok {
+				for _, fn := range w.handlers {
+					handlers = append(handlers, fn)
+				}
+			}
+			s.mu.Unlock()
+			for _, fn := range handlers {
+				fn(peer)
+			}
+		}
+	}
+}
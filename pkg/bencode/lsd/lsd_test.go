@@ -0,0 +1,182 @@
+package lsd
+
+import (
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type packet struct {
+	b    []byte
+	from net.Addr
+}
+
+// 内存中的组播组，发送的报文投递给所有成员（包括发送者自己）
+type hub struct {
+	mu      sync.Mutex
+	members []*memTransport
+}
+
+type memTransport struct {
+	h    *hub
+	addr *net.UDPAddr
+	in   chan packet
+	done chan struct{}
+	once sync.Once
+}
+
+func (h *hub) join(ip string) *memTransport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	mt := &memTransport{
+		h:    h,
+		addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771},
+		in:   make(chan packet, 16),
+		done: make(chan struct{}),
+	}
+	h.members = append(h.members, mt)
+	return mt
+}
+
+func (mt *memTransport) Host() string { return IPv4Group }
+
+func (mt *memTransport) Send(b []byte) error {
+	mt.h.mu.Lock()
+	defer mt.h.mu.Unlock()
+	for _, m := range mt.h.members {
+		select {
+		case m.in <- packet{append([]byte{}, b...), mt.addr}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (mt *memTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-mt.in:
+		return copy(b, p.b), p.from, nil
+	case <-mt.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (mt *memTransport) Close() error {
+	mt.once.Do(func() { close(mt.done) })
+	return nil
+}
+
+func newTestService(t *testing.T, tr Transport) *Service {
+	s, err := New(Config{Transports: []Transport{tr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	a := &Announce{
+		Host:       IPv4Group,
+		Port:       51413,
+		InfoHashes: [][20]byte{sha1.Sum([]byte("a")), sha1.Sum([]byte("b"))},
+		Cookie:     "abc",
+	}
+	got, err := ParseAnnounce(a.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, a, got)
+
+	// 头部名称不区分大小写，也接受\n换行
+	raw := "BT-SEARCH * HTTP/1.1\nhost: 239.192.152.143:6771\nPORT: 6881\n" +
+		"INFOHASH: 86f7e437faa5a7fce15d1ddcb9eaeaea377667b8\nx-unknown: 1\n\n\n"
+	got, err = ParseAnnounce([]byte(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, 6881, got.Port)
+	assert.Equal(t, [][20]byte{sha1.Sum([]byte("a"))}, got.InfoHashes)
+
+	for _, bad := range []string{
+		"NOTIFY * HTTP/1.1\r\nPort: 1\r\nInfohash: 86f7e437faa5a7fce15d1ddcb9eaeaea377667b8\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: 86f7e437faa5a7fce15d1ddcb9eaeaea377667b8\r\n\r\n",
+	} {
+		_, err = ParseAnnounce([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestWatchDiscoversPeers(t *testing.T) {
+	h := new(hub)
+	seeder := newTestService(t, h.join("192.168.1.2"))
+	leecher := newTestService(t, h.join("192.168.1.3"))
+	ih := sha1.Sum([]byte(t.Name()))
+
+	found := make(chan Peer, 4)
+	stop := leecher.Watch(ih, 0, func(p Peer) { found <- p })
+	defer stop()
+	// 其他info hash的announce不会上报
+	other := seeder.Watch(sha1.Sum([]byte("other")), 6882, func(Peer) {})
+	defer other()
+	ownFound := make(chan Peer, 4)
+	defer seeder.Watch(ih, 6881, func(p Peer) { ownFound <- p })()
+
+	select {
+	case p := <-found:
+		assert.Equal(t, "192.168.1.2", p.IP.String())
+		assert.Equal(t, uint16(6881), p.Port)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not discovered")
+	}
+	// 自己的announce通过cookie忽略，只watch不announce的一方不会发送
+	select {
+	case p := <-ownFound:
+		t.Fatal("unexpected peer", p)
+	case p := <-found:
+		t.Fatal("unexpected peer", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAnnounceRateLimit(t *testing.T) {
+	h := new(hub)
+	s := newTestService(t, h.join("192.168.1.2"))
+	listener := h.join("192.168.1.3")
+	ih := sha1.Sum([]byte(t.Name()))
+
+	defer s.Watch(ih, 6881, func(Peer) {})()
+	defer s.Watch(ih, 6881, func(Peer) {})()
+	buf := make([]byte, 1500)
+	n, _, err := listener.Receive(buf)
+	assert.NoError(t, err)
+	a, err := ParseAnnounce(buf[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, [][20]byte{ih}, a.InfoHashes)
+	assert.Len(t, listener.in, 0)
+}
+
+// 真实的组播在沙箱等环境中可能不可用，此时跳过
+func TestMulticastLoopback(t *testing.T) {
+	tr1, err := NewMulticastTransport("udp4", IPv4Group)
+	if err != nil {
+		t.Skip("multicast unavailable:", err)
+	}
+	tr2, err := NewMulticastTransport("udp4", IPv4Group)
+	if err != nil {
+		tr1.Close()
+		t.Skip("multicast unavailable:", err)
+	}
+	s1 := newTestService(t, tr1)
+	s2 := newTestService(t, tr2)
+	ih := sha1.Sum([]byte(t.Name()))
+	found := make(chan Peer, 4)
+	defer s2.Watch(ih, 0, func(p Peer) { found <- p })()
+	defer s1.Watch(ih, 6881, func(Peer) {})()
+	select {
+	case p := <-found:
+		assert.Equal(t, uint16(6881), p.Port)
+	case <-time.After(2 * time.Second):
+		t.Skip("multicast packets are not looped back")
+	}
+}
@@ -0,0 +1,71 @@
+package lsd
+
+import (
+	"net"
+)
+
+// 组播地址 (BEP 14)
+const (
+	IPv4Group = "239.192.152.143:6771"
+	IPv6Group = "[ff15::efc0:988f]:6771"
+)
+
+// Transport carries LSD packets to and from one multicast group. It can be
+// replaced, e.g. by an in-memory transport in tests.
+type Transport interface {
+	// Host is the multicast group and port, sent in the Host header
+	Host() string
+	// Send delivers a packet to every member of the group
+	Send(b []byte) error
+	// Receive blocks until a packet of the group arrives
+	Receive(b []byte) (int, net.Addr, error)
+	Close() error
+}
+
+// 通过UDP组播收发报文
+type multicastTransport struct {
+	host  string
+	group *net.UDPAddr
+	recv  *net.UDPConn
+	send  *net.UDPConn
+}
+
+// NewMulticastTransport joins the multicast group on the default interface,
+// network is "udp4" or "udp6"
+func NewMulticastTransport(network, group string) (Transport, error) {
+	addr, err := net.ResolveUDPAddr(network, group)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+	return &multicastTransport{host: group, group: addr, recv: recv, send: send}, nil
+}
+
+func (mt *multicastTransport) Host() string {
+	return mt.host
+}
+
+func (mt *multicastTransport) Send(b []byte) error {
+	_, err := mt.send.WriteToUDP(b, mt.group)
+	return err
+}
+
+func (mt *multicastTransport) Receive(b []byte) (int, net.Addr, error) {
+	return mt.recv.ReadFrom(b)
+}
+
+func (mt *multicastTransport) Close() error {
+	err := mt.recv.Close()
+	if serr := mt.send.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
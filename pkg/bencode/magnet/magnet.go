@@ -0,0 +1,236 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	HashLen   = 20
+	HashV2Len = 32
+	KeyLen    = 32
+	Scheme    = "magnet"
+	btihURN   = "urn:btih:"
+	btmhURN   = "urn:btmh:"
+	btpkURN   = "urn:btpk:"
+	// sha2-256 multihash prefix: function code 0x12, digest length 0x20
+	sha256Multihash = "1220"
+	// MaxSelect bounds the number of file indices a select-only (so) list
+	// may expand to
+	MaxSelect = 1 << 16
+)
+
+var (
+	ErrScheme   = errors.New("not a magnet uri")
+	ErrNoHash   = errors.New("magnet uri has no info hash")
+	ErrInfoHash = errors.New("invalid info hash")
+	ErrKey      = errors.New("invalid public key")
+	ErrSelect   = errors.New("invalid file selection")
+)
+
+// Magnet holds the parameters of a magnet link
+type Magnet struct {
+	// InfoHash is the v1 info hash (xt=urn:btih), valid when HasInfoHash is set
+	InfoHash    [HashLen]byte
+	HasInfoHash bool
+	// InfoHashV2 is the v2 info hash (xt=urn:btmh), valid when HasInfoHashV2 is set
+	InfoHashV2    [HashV2Len]byte
+	HasInfoHashV2 bool
+	// PublicKey is the ed25519 key of a mutable torrent (xs=urn:btpk, BEP 46),
+	// valid when HasPublicKey is set, and Salt the salt of its DHT item (s)
+	PublicKey    [KeyLen]byte
+	HasPublicKey bool
+	Salt         string
+	// Name is the display name (dn)
+	Name string
+	// Trackers are tracker urls (tr)
+	Trackers []string
+	// WebSeeds are web seed urls (ws)
+	WebSeeds []string
+	// Peers are host:port addresses of peers to contact directly (x.pe)
+	Peers []string
+	// Select are the indices of the files to download (so)
+	Select []int
+}
+
+// Parse parses a magnet uri
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != Scheme {
+		return nil, ErrScheme
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+		Peers:    q["x.pe"],
+	}
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, btihURN):
+			m.InfoHash, err = parseBtih(xt[len(btihURN):])
+			if err != nil {
+				return nil, err
+			}
+			m.HasInfoHash = true
+		case strings.HasPrefix(xt, btmhURN):
+			m.InfoHashV2, err = parseBtmh(xt[len(btmhURN):])
+			if err != nil {
+				return nil, err
+			}
+			m.HasInfoHashV2 = true
+		}
+	}
+	if xs := q.Get("xs"); strings.HasPrefix(xs, btpkURN) {
+		buf, err := hex.DecodeString(xs[len(btpkURN):])
+		if err != nil || len(buf) != KeyLen {
+			return nil, ErrKey
+		}
+		copy(m.PublicKey[:], buf)
+		m.HasPublicKey = true
+		salt, err := hex.DecodeString(q.Get("s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt: %w", err)
+		}
+		m.Salt = string(salt)
+	}
+	if !m.HasInfoHash && !m.HasInfoHashV2 && !m.HasPublicKey {
+		return nil, ErrNoHash
+	}
+	if so := q.Get("so"); len(so) != 0 {
+		m.Select, err = parseSelect(so)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// v1 info hash 可以是40位十六进制或32位base32编码
+func parseBtih(s string) ([HashLen]byte, error) {
+	var hash [HashLen]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case hex.EncodedLen(HashLen):
+		buf, err = hex.DecodeString(s)
+	case base32.StdEncoding.EncodedLen(HashLen):
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, ErrInfoHash
+	}
+	if err != nil {
+		return hash, fmt.Errorf("%w: %s", ErrInfoHash, err.Error())
+	}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+// v2 info hash 是十六进制编码的sha2-256 multihash
+func parseBtmh(s string) ([HashV2Len]byte, error) {
+	var hash [HashV2Len]byte
+	if len(s) != len(sha256Multihash)+hex.EncodedLen(HashV2Len) || !strings.HasPrefix(s, sha256Multihash) {
+		return hash, ErrInfoHash
+	}
+	buf, err := hex.DecodeString(s[len(sha256Multihash):])
+	if err != nil {
+		return hash, fmt.Errorf("%w: %s", ErrInfoHash, err.Error())
+	}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+// 解析形如 "0,2,4-6" 的文件序号列表，展开后最多MaxSelect个序号
+func parseSelect(s string) ([]int, error) {
+	var indices []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, ErrSelect
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil || last < first {
+				return nil, ErrSelect
+			}
+		}
+		// 用差值比较，避免last+1溢出
+		if last-first >= MaxSelect-len(indices) {
+			return nil, ErrSelect
+		}
+		for i := first; i <= last; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
+
+func formatSelect(indices []int) string {
+	sorted := append([]int(nil), indices...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, strconv.Itoa(sorted[i])+"-"+strconv.Itoa(sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// String encodes the magnet link
+func (m *Magnet) String() string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+	if m.HasInfoHash {
+		params = append(params, "xt="+btihURN+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.HasInfoHashV2 {
+		params = append(params, "xt="+btmhURN+sha256Multihash+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+	if m.HasPublicKey {
+		params = append(params, "xs="+btpkURN+hex.EncodeToString(m.PublicKey[:]))
+		if len(m.Salt) != 0 {
+			params = append(params, "s="+hex.EncodeToString([]byte(m.Salt)))
+		}
+	}
+	if len(m.Name) != 0 {
+		add("dn", m.Name)
+	}
+	for _, tr := range m.Trackers {
+		add("tr", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		add("ws", ws)
+	}
+	for _, pe := range m.Peers {
+		add("x.pe", pe)
+	}
+	if len(m.Select) != 0 {
+		params = append(params, "so="+formatSelect(m.Select))
+	}
+	return Scheme + ":?" + strings.Join(params, "&")
+}
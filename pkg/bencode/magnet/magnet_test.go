@@ -0,0 +1,107 @@
+package magnet
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+const testHex = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+func TestParseHex(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:" + testHex +
+		"&dn=ubuntu+24.04.iso&tr=http%3A%2F%2Ft1%2Fannounce&tr=udp%3A%2F%2Ft2%3A80" +
+		"&ws=http%3A%2F%2Fmirror%2Fubuntu.iso&x.pe=10.0.0.1%3A6881&x.pe=%5B%3A%3A1%5D%3A6881&so=0,2,4-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, m.HasInfoHash)
+	assert.False(t, m.HasInfoHashV2)
+	assert.Equal(t, testHex, hex.EncodeToString(m.InfoHash[:]))
+	assert.Equal(t, "ubuntu 24.04.iso", m.Name)
+	assert.Equal(t, []string{"http://t1/announce", "udp://t2:80"}, m.Trackers)
+	assert.Equal(t, []string{"http://mirror/ubuntu.iso"}, m.WebSeeds)
+	assert.Equal(t, []string{"10.0.0.1:6881", "[::1]:6881"}, m.Peers)
+	assert.Equal(t, []int{0, 2, 4, 5, 6}, m.Select)
+}
+
+func TestParseBase32(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testHex, hex.EncodeToString(m.InfoHash[:]))
+
+	lower, err := Parse("magnet:?xt=urn:btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek")
+	assert.NoError(t, err)
+	assert.Equal(t, m.InfoHash, lower.InfoHash)
+}
+
+func TestParseV2(t *testing.T) {
+	v2 := "1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	m, err := Parse("magnet:?xt=urn:btih:" + testHex + "&xt=urn:btmh:" + v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, m.HasInfoHash)
+	assert.True(t, m.HasInfoHashV2)
+	assert.Equal(t, v2[4:], hex.EncodeToString(m.InfoHashV2[:]))
+}
+
+func TestParseErrors(t *testing.T) {
+	for uri, want := range map[string]error{
+		"http://example.com/?xt=urn:btih:" + testHex: ErrScheme,
+		"magnet:?dn=nothing":                         ErrNoHash,
+		"magnet:?xt=urn:btih:abc":                    ErrInfoHash,
+		"magnet:?xt=urn:btmh:1220abc":                ErrInfoHash,
+		"magnet:?xt=urn:btih:" + testHex + "&so=3-1": ErrSelect,
+		// 恶意的范围不会展开成大量序号
+		"magnet:?xt=urn:btih:" + testHex + "&so=0-2147483647":          ErrSelect,
+		"magnet:?xt=urn:btih:" + testHex + "&so=0-9223372036854775807": ErrSelect,
+		"magnet:?xt=urn:btih:" + testHex + "&so=0-40000,50000-90000":   ErrSelect,
+		"magnet:?xs=urn:btpk:" + testHex:                               ErrKey,
+	} {
+		_, err := Parse(uri)
+		assert.ErrorIs(t, err, want, uri)
+	}
+}
+
+func TestParseSelectLimit(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:" + testHex + "&so=1," + strconv.Itoa(MaxSelect) + "-" + strconv.Itoa(2*MaxSelect-2))
+	assert.NoError(t, err)
+	assert.Len(t, m.Select, MaxSelect)
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	m := &Magnet{
+		HasInfoHash: true,
+		Name:        "build & test",
+		Trackers:    []string{"http://t1/announce?key=a&b"},
+		WebSeeds:    []string{"http://mirror/"},
+		Peers:       []string{"127.0.0.1:6666"},
+		Select:      []int{5, 1, 2, 3, 7},
+	}
+	copy(m.InfoHash[:], "abcdefghijklmnopqrst")
+	uri := m.String()
+	assert.Contains(t, uri, "so=1-3,5,7")
+	parsed, err := Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Select = []int{1, 2, 3, 5, 7}
+	assert.Equal(t, m, parsed)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key := "8543d3e6115f0f98c944077a4493dcd543e49c739fd998550a1f614ab36ed63e"
+	m, err := Parse("magnet:?xs=urn:btpk:" + key + "&s=6e696768746c79")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, m.HasPublicKey)
+	assert.False(t, m.HasInfoHash)
+	assert.Equal(t, key, hex.EncodeToString(m.PublicKey[:]))
+	assert.Equal(t, "nightly", m.Salt)
+	assert.Equal(t, "magnet:?xs=urn:btpk:"+key+"&s=6e696768746c79", m.String())
+}
@@ -0,0 +1,263 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MinPieceLength = 16 << 10
+	MaxPieceLength = 16 << 20
+	// TargetPieces is the number of pieces an automatically chosen piece length aims for
+	TargetPieces = 1500
+)
+
+// Builder creates a torrent from a file or a directory. The same input
+// content and options always produce byte-identical output.
+type Builder struct {
+	// Trackers are announce URL tiers, the first URL becomes announce
+	Trackers [][]string
+	WebSeeds []string
+	Comment  string
+	// CreatedBy defaults to "torcore"
+	CreatedBy string
+	// CreationDate is left out of the torrent when zero
+	CreationDate time.Time
+	Private      bool
+	Source       string
+	// Name defaults to the base name of the path being built
+	Name string
+	// PieceLength is chosen from the content length when zero
+	PieceLength int
+	// Workers is the number of goroutines hashing pieces, defaults to the number of CPUs
+	Workers int
+}
+
+// 待打包的单个文件
+type sourceFile struct {
+	path   string
+	length int
+	parts  []string
+}
+
+// AutoPieceLength picks a power of two piece length giving about TargetPieces pieces
+func AutoPieceLength(total int) int {
+	length := MinPieceLength
+	for length < MaxPieceLength && total/length > TargetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// Build walks root and hashes its content into a new torrent
+func (b *Builder) Build(root string) (*MetaInfo, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	var files []sourceFile
+	if st.IsDir() {
+		files, err = walkFiles(root)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		files = []sourceFile{{path: root, length: int(st.Size())}}
+	}
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, errors.New("no content to build a torrent from")
+	}
+
+	info := Info{
+		Name:        b.Name,
+		PieceLength: b.PieceLength,
+		Source:      b.Source,
+	}
+	if len(info.Name) == 0 {
+		info.Name = filepath.Base(filepath.Clean(root))
+	}
+	if info.PieceLength <= 0 {
+		info.PieceLength = AutoPieceLength(total)
+	}
+	if b.Private {
+		info.Private = 1
+	}
+	if st.IsDir() {
+		for _, f := range files {
+			info.Files = append(info.Files, FileInfo{Length: f.length, Path: f.parts})
+		}
+	} else {
+		info.Length = total
+	}
+	info.Pieces, err = b.hashPieces(files, total, info.PieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	mi := &MetaInfo{
+		Comment:   b.Comment,
+		CreatedBy: b.CreatedBy,
+		Info:      info,
+		UrlList:   b.WebSeeds,
+	}
+	if len(mi.CreatedBy) == 0 {
+		mi.CreatedBy = "torcore"
+	}
+	if !b.CreationDate.IsZero() {
+		mi.CreationDate = int(b.CreationDate.Unix())
+	}
+	for _, tier := range b.Trackers {
+		if len(tier) == 0 {
+			continue
+		}
+		if len(mi.Announce) == 0 {
+			mi.Announce = tier[0]
+		}
+		mi.AnnounceList = append(mi.AnnounceList, tier)
+	}
+	// announce-list只在有多个tracker时才有意义
+	if len(mi.AnnounceList) == 1 && len(mi.AnnounceList[0]) == 1 {
+		mi.AnnounceList = nil
+	}
+	mi.InfoHash()
+	return mi, nil
+}
+
+// 按路径的字典序遍历目录下的普通文件，保证输出稳定
+func walkFiles(root string) ([]sourceFile, error) {
+	var files []sourceFile
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{
+			path:   path,
+			length: int(st.Size()),
+			parts:  strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// 并行计算所有分片的SHA-1，分片可能跨越多个文件
+func (b *Builder) hashPieces(files []sourceFile, total, pieceLen int) (string, error) {
+	fds := make([]*os.File, len(files))
+	defer func() {
+		for _, fd := range fds {
+			if fd != nil {
+				fd.Close()
+			}
+		}
+	}()
+	for i, f := range files {
+		fd, err := os.Open(f.path)
+		if err != nil {
+			return "", err
+		}
+		fds[i] = fd
+	}
+	r := &filesReader{files: files, fds: fds}
+
+	numPieces := (total + pieceLen - 1) / pieceLen
+	hashes := make([]byte, numPieces*HashLen)
+	workers := b.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLen)
+			for index := range indexes {
+				begin := index * pieceLen
+				n := min(pieceLen, total-begin)
+				_, err := r.ReadAt(buf[:n], int64(begin))
+				if err != nil {
+					errs <- err
+					return
+				}
+				h := sha1.Sum(buf[:n])
+				copy(hashes[index*HashLen:], h[:])
+			}
+		}()
+	}
+	var err error
+Feed:
+	for index := 0; index < numPieces; index++ {
+		select {
+		case indexes <- index:
+		case err = <-errs:
+			break Feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	select {
+	case err = <-errs:
+		return "", err
+	default:
+	}
+	return string(hashes), nil
+}
+
+// 将多个文件按顺序拼接成一个连续的ReaderAt
+type filesReader struct {
+	files []sourceFile
+	fds   []*os.File
+}
+
+func (r *filesReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	start := int64(0)
+	for i, f := range r.files {
+		end := start + int64(f.length)
+		if off < end && n < len(p) {
+			want := min(len(p)-n, int(end-off))
+			m, err := r.fds[i].ReadAt(p[n:n+want], off-start)
+			n += m
+			off += int64(m)
+			if m < want {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+		}
+		start = end
+	}
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
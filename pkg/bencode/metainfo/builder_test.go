@@ -0,0 +1,103 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	writeTestFiles(t, root, map[string]string{
+		"b.txt":       "bbbbbbbbbbbbbbbbbbbbbbbbb",
+		"a/z.bin":     "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz",
+		"a/empty.txt": "",
+	})
+	b := &Builder{
+		Trackers:     [][]string{{"http://t1/announce", "http://t2/announce"}, {"http://t3/announce"}},
+		WebSeeds:     []string{"http://mirror/release/"},
+		Comment:      "nightly",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		Source:       "ci",
+		PieceLength:  16,
+		Workers:      3,
+	}
+	mi, err := b.Build(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "release", mi.Info.Name)
+	assert.Equal(t, "http://t1/announce", mi.Announce)
+	assert.Equal(t, []FileInfo{
+		{Length: 0, Path: []string{"a", "empty.txt"}},
+		{Length: 34, Path: []string{"a", "z.bin"}},
+		{Length: 25, Path: []string{"b.txt"}},
+	}, mi.Info.Files)
+
+	content := []byte("zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz" + "bbbbbbbbbbbbbbbbbbbbbbbbb")
+	hashes, err := mi.Info.PieceHashes()
+	assert.NoError(t, err)
+	assert.Len(t, hashes, 4)
+	for i, h := range hashes {
+		assert.Equal(t, sha1.Sum(content[i*16:min((i+1)*16, len(content))]), h)
+	}
+
+	var first, second bytes.Buffer
+	assert.NoError(t, mi.Write(&first))
+	again, err := b.Build(root)
+	assert.NoError(t, err)
+	assert.NoError(t, again.Write(&second))
+	assert.Equal(t, first.Bytes(), second.Bytes())
+
+	loaded, err := Load(bytes.NewReader(first.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, mi.InfoHash(), loaded.InfoHash())
+	assert.Equal(t, mi.AnnounceList, loaded.AnnounceList)
+	assert.Equal(t, mi.UrlList, loaded.UrlList)
+	assert.Equal(t, 1700000000, loaded.CreationDate)
+	assert.Equal(t, 1, loaded.Info.Private)
+	assert.Equal(t, "ci", loaded.Info.Source)
+	assert.Equal(t, mi.Info.Files, loaded.Info.Files)
+}
+
+func TestBuildSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"app.tar": "0123456789"})
+	mi, err := (&Builder{Trackers: [][]string{{"http://t1/announce"}}}).Build(filepath.Join(dir, "app.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 10, mi.Info.Length)
+	assert.Nil(t, mi.Info.Files)
+	assert.Nil(t, mi.AnnounceList)
+	assert.Equal(t, MinPieceLength, mi.Info.PieceLength)
+	assert.Equal(t, "torcore", mi.CreatedBy)
+
+	var buf bytes.Buffer
+	assert.NoError(t, mi.Write(&buf))
+	want := "d8:announce18:http://t1/announce10:created by7:torcore4:infod6:lengthi10e4:name7:app.tar12:piece lengthi16384e6:pieces20:"
+	assert.Equal(t, want, buf.String()[:len(want)])
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	assert.Equal(t, MinPieceLength, AutoPieceLength(1<<20))
+	assert.Equal(t, 1<<20, AutoPieceLength(1<<30))
+	assert.Equal(t, MaxPieceLength, AutoPieceLength(1<<40))
+}
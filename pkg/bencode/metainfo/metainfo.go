@@ -0,0 +1,161 @@
+package metainfo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"github.com/shoggothforever/torcore/pkg/bencode/model"
+	"io"
+	"os"
+)
+
+const HashLen = 20
+
+// MetaInfo is the content of a .torrent file. Fields are declared in the
+// sorted order of their keys so that marshaling yields canonical bencode.
+type MetaInfo struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int        `bencode:"creation date,omitempty"`
+	Info         Info       `bencode:"info"`
+	UrlList      []string   `bencode:"url-list,omitempty"`
+	// InfoBytes is the bencoded info dictionary the info hash is computed from
+	InfoBytes []byte `bencode:"-"`
+}
+
+// Info is the info dictionary of a torrent, either single-file (Length) or multi-file (Files)
+type Info struct {
+	Files       []FileInfo `bencode:"files,omitempty"`
+	Length      int        `bencode:"length,omitempty"`
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Private     int        `bencode:"private,omitempty"`
+	Source      string     `bencode:"source,omitempty"`
+}
+
+// FileInfo describes one file of a multi-file torrent
+type FileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// TotalLength is the sum of the lengths of all files in the torrent
+func (info *Info) TotalLength() int {
+	if len(info.Files) == 0 {
+		return info.Length
+	}
+	total := 0
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// PieceHashes splits the concatenated piece hashes
+func (info *Info) PieceHashes() ([][HashLen]byte, error) {
+	if len(info.Pieces)%HashLen != 0 {
+		return nil, errors.New("malformed pieces")
+	}
+	hashes := make([][HashLen]byte, len(info.Pieces)/HashLen)
+	for i := range hashes {
+		copy(hashes[i][:], info.Pieces[i*HashLen:(i+1)*HashLen])
+	}
+	return hashes, nil
+}
+
+// InfoHash is the SHA-1 of the bencoded info dictionary
+func (mi *MetaInfo) InfoHash() [HashLen]byte {
+	if mi.InfoBytes == nil {
+		var buf bytes.Buffer
+		model.MarshalBen(&buf, mi.Info)
+		mi.InfoBytes = buf.Bytes()
+	}
+	return sha1.Sum(mi.InfoBytes)
+}
+
+// Write encodes the torrent as bencode
+func (mi *MetaInfo) Write(w io.Writer) error {
+	if n := model.MarshalBen(w, mi); n <= 0 {
+		return model.ErrEncode
+	}
+	return nil
+}
+
+// WriteFile encodes the torrent as bencode into the named file
+func (mi *MetaInfo) WriteFile(name string) error {
+	fd, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = mi.Write(fd)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// Load parses a .torrent file, keeping the encoded info dictionary for hashing
+func Load(r io.Reader) (*MetaInfo, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	mi := new(MetaInfo)
+	err = model.UnmarshalBen(bytes.NewReader(raw), mi)
+	if err != nil {
+		return nil, err
+	}
+	node, err := model.BenDecode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := node.Data().(*model.BDict)
+	if !ok {
+		return nil, model.ErrParse
+	}
+	info, ok := (*dict)["info"]
+	if !ok {
+		return nil, model.ErrParse
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	_, err = info.Encode(bw)
+	if err != nil {
+		return nil, err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	mi.InfoBytes = buf.Bytes()
+	return mi, nil
+}
+
+// FromInfo builds a torrent from a bencoded info dictionary, as obtained from peers for a magnet link
+func FromInfo(raw []byte) (*MetaInfo, error) {
+	mi := new(MetaInfo)
+	err := model.UnmarshalBen(bytes.NewReader(raw), &mi.Info)
+	if err != nil {
+		return nil, err
+	}
+	if len(mi.Info.Name) == 0 || mi.Info.PieceLength <= 0 {
+		return nil, model.ErrParse
+	}
+	mi.InfoBytes = raw
+	return mi, nil
+}
+
+// LoadFile parses the named .torrent file
+func LoadFile(name string) (*MetaInfo, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return Load(fd)
+}
@@ -2,12 +2,21 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"reflect"
+	"slices"
 	"strings"
 )
 
+// RawMessage is an encoded bencode value. It is written as is when
+// marshaling and receives the canonical encoding of the value when
+// unmarshaling, e.g. to verify signatures over values of any type.
+type RawMessage []byte
+
+var rawType = reflect.TypeOf(RawMessage(nil))
+
 // r: bencode字符串或者文件的读取流
 // receiver: 接收者,可以是int|string|map[string]*Bobject|[]*Bobject
 func UnmarshalBen(r io.Reader, receiver interface{}) error {
@@ -59,23 +68,28 @@ func unmarshalList(rcValue reflect.Value, list BList) error {
 	elemSlice := reflect.MakeSlice(elem.Type(), len(list), len(list))
 	elem.Set(elemSlice)
 
-	fmt.Println(elem)
 	for k, v := range list {
-		fmt.Println("Index:", k, "Type:", reflect.TypeOf(v))
 		switch o := v.(type) {
 		case *BInt:
-			if elem.Index(k).CanSet() {
-				elem.Index(k).Set(reflect.ValueOf(int(*o)))
-			} else {
-				fmt.Println(elem.Index(k).Type())
-				fmt.Println("Cannot set BStr")
+			// 元素类型不匹配时返回错误而不是panic，数据可能来自不可信的网络
+			ev := elem.Index(k)
+			switch {
+			case ev.Kind() == reflect.Interface:
+				ev.Set(reflect.ValueOf(int(*o)))
+			case ev.Kind() >= reflect.Int && ev.Kind() <= reflect.Int64:
+				ev.SetInt(int64(*o))
+			default:
+				return ErrMarshal
 			}
 		case *BStr:
-			if elem.Index(k).CanSet() {
-				elem.Index(k).Set(reflect.ValueOf(string(*o)))
-			} else {
-				fmt.Println(elem.Index(k).Type())
-				fmt.Println("Cannot set BStr")
+			ev := elem.Index(k)
+			switch ev.Kind() {
+			case reflect.Interface:
+				ev.Set(reflect.ValueOf(string(*o)))
+			case reflect.String:
+				ev.SetString(string(*o))
+			default:
+				return ErrMarshal
 			}
 		case *BList:
 			if reflect.TypeOf(v).Elem().Kind() != reflect.Slice {
@@ -122,11 +136,18 @@ func unmarshalDict(rcValue reflect.Value, dict BDict) error {
 			continue
 		}
 		ft := tp.Field(i)
-		tag := ft.Tag.Get(BTag)
-		if len(tag) == 0 {
-			tag = strings.ToLower(ft.Name)
+		tag, _ := parseTag(ft)
+		if tag == "-" {
+			continue
 		}
 		if v, ok := dict[tag]; ok && v != nil {
+			if ft.Type == rawType || ft.Type.Kind() == reflect.Ptr {
+				_, err := unmarshalValue(fv.Addr(), v)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			switch v.Type() {
 			case BINT:
 				if ft.Type.Kind() < reflect.Int || ft.Type.Kind() > reflect.Int64 {
@@ -153,6 +174,15 @@ func unmarshalDict(rcValue reflect.Value, dict BDict) error {
 				}
 				fv.Set(ln.Elem())
 			case BDICT:
+				if ft.Type.Kind() == reflect.Map {
+					mp := reflect.New(ft.Type)
+					err := unmarshalMap(mp, *v.(*BDict))
+					if err != nil {
+						break
+					}
+					fv.Set(mp.Elem())
+					break
+				}
 				if ft.Type.Kind() != reflect.Struct {
 					break
 				}
@@ -175,6 +205,88 @@ func unmarshalDict(rcValue reflect.Value, dict BDict) error {
 
 }
 
+// rcValue: 指向map[string]T的指针，字典中与T类型不匹配的值会被忽略
+func unmarshalMap(rcValue reflect.Value, dict BDict) error {
+	if rcValue.Kind() != reflect.Ptr || rcValue.Elem().Kind() != reflect.Map ||
+		rcValue.Elem().Type().Key().Kind() != reflect.String {
+		return ErrMarshal
+	}
+	mpType := rcValue.Elem().Type()
+	mp := reflect.MakeMapWithSize(mpType, len(dict))
+	for k, v := range dict {
+		if v == nil {
+			continue
+		}
+		ev := reflect.New(mpType.Elem())
+		ok, err := unmarshalValue(ev, v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mp.SetMapIndex(reflect.ValueOf(k).Convert(mpType.Key()), ev.Elem())
+		}
+	}
+	rcValue.Elem().Set(mp)
+	return nil
+}
+
+// 将单个bencode对象赋值给ev指向的值，类型不匹配时返回false
+func unmarshalValue(ev reflect.Value, v BObject) (bool, error) {
+	kind := ev.Elem().Kind()
+	if ev.Elem().Type() == rawType {
+		raw, err := encodeObject(v)
+		ev.Elem().SetBytes(raw)
+		return true, err
+	}
+	// 指针字段在值存在时才分配
+	if kind == reflect.Ptr {
+		p := reflect.New(ev.Elem().Type().Elem())
+		ok, err := unmarshalValue(p, v)
+		if ok && err == nil {
+			ev.Elem().Set(p)
+		}
+		return ok, err
+	}
+	switch o := v.(type) {
+	case *BInt:
+		if kind < reflect.Int || kind > reflect.Int64 {
+			return false, nil
+		}
+		ev.Elem().SetInt(int64(*o))
+	case *BStr:
+		if kind != reflect.String {
+			return false, nil
+		}
+		ev.Elem().SetString(string(*o))
+	case *BList:
+		if kind != reflect.Slice {
+			return false, nil
+		}
+		return true, unmarshalList(ev, *o)
+	case *BDict:
+		switch kind {
+		case reflect.Struct:
+			return true, unmarshalDict(ev, *o)
+		case reflect.Map:
+			return true, unmarshalMap(ev, *o)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// 将解码得到的bencode对象重新编码
+func encodeObject(v BObject) ([]byte, error) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	_, err := v.Encode(bw)
+	if err != nil {
+		return nil, err
+	}
+	err = bw.Flush()
+	return buf.Bytes(), err
+}
+
 func MarshalBen(w io.Writer, v interface{}) int {
 	p := reflect.ValueOf(v)
 	if p.Kind() == reflect.Ptr {
@@ -194,10 +306,19 @@ func marshalValue(w io.Writer, v reflect.Value) int {
 	case reflect.Struct:
 		l += marshalDict(bw, v)
 	case reflect.Slice:
-		fmt.Println("marshal list before")
+		if v.Type() == rawType {
+			n, _ = bw.Write(v.Bytes())
+			l += n
+			break
+		}
 		l += marshalList(bw, v)
-		fmt.Println("marshal list after , write ", l)
-	case reflect.Int:
+	case reflect.Map:
+		l += marshalMap(bw, v)
+	case reflect.Interface, reflect.Ptr:
+		if !v.IsNil() {
+			l += marshalValue(bw, v.Elem())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		bInt := BInt(v.Int())
 		n, _ = bInt.Encode(bw)
 		l += n
@@ -219,9 +340,6 @@ func marshalList(w io.Writer, v reflect.Value) int {
 	if err != nil {
 		return -1
 	}
-	if v.Len() == 0 {
-		fmt.Println("get empty slice")
-	}
 	for i := 0; i < v.Len(); i++ {
 		l += marshalValue(w, v.Index(i))
 	}
@@ -242,9 +360,9 @@ func marshalDict(w io.Writer, v reflect.Value) int {
 	for i := 0; i < v.NumField(); i++ {
 		ft := v.Type().Field(i)
 		fv := v.Field(i)
-		ben := ft.Tag.Get(BTag)
-		if len(ben) == 0 {
-			ben = strings.ToLower(ft.Name)
+		ben, omitEmpty := parseTag(ft)
+		if ben == "-" || (omitEmpty && isEmptyValue(fv)) {
+			continue
 		}
 		str := BStr(ben)
 		n, err := str.Encode(w)
@@ -261,3 +379,51 @@ func marshalDict(w io.Writer, v reflect.Value) int {
 	return l
 
 }
+
+// 解析结构体字段的bencode标签，格式为 "key[,omitempty]"，"-" 表示忽略该字段
+// 未设置标签时使用字段名的小写形式作为key
+func parseTag(ft reflect.StructField) (name string, omitEmpty bool) {
+	tag := ft.Tag.Get(BTag)
+	name, opts, _ := strings.Cut(tag, ",")
+	if len(name) == 0 {
+		name = strings.ToLower(ft.Name)
+	}
+	return name, opts == "omitempty"
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func marshalMap(w io.Writer, v reflect.Value) int {
+	if v.Type().Key().Kind() != reflect.String {
+		return -1
+	}
+	l := 2
+	_, err := w.Write([]byte{'d'})
+	if err != nil {
+		return -1
+	}
+	keys := v.MapKeys()
+	slices.SortFunc(keys, func(a, b reflect.Value) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	for _, k := range keys {
+		str := BStr(k.String())
+		n, err := str.Encode(w)
+		if err != nil {
+			return -1
+		}
+		l += n
+		l += marshalValue(w, v.MapIndex(k))
+	}
+	_, err = w.Write([]byte{'e'})
+	if err != nil {
+		return -1
+	}
+	return l
+}
@@ -153,3 +153,98 @@ func TestUnmarshalTeam(t *testing.T) {
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
+
+type Release struct {
+	Comment string   `bencode:"comment,omitempty"`
+	Files   []string `bencode:"files,omitempty"`
+	Name    string   `bencode:"name"`
+	Size    int      `bencode:"size,omitempty"`
+	Local   string   `bencode:"-"`
+}
+
+func TestMarshalOmitEmpty(t *testing.T) {
+	buf := new(bytes.Buffer)
+	r := &Release{Name: "nightly", Local: "/tmp/nightly"}
+	length := MarshalBen(buf, r)
+	assert.Equal(t, "d4:name7:nightlye", buf.String())
+	assert.Equal(t, buf.Len(), length)
+
+	buf.Reset()
+	r.Comment = "ok"
+	r.Files = []string{"a"}
+	r.Size = 3
+	MarshalBen(buf, r)
+	str := "d7:comment2:ok5:filesl1:ae4:name7:nightly4:sizei3ee"
+	assert.Equal(t, str, buf.String())
+
+	got := &Release{}
+	assert.NoError(t, UnmarshalBen(bytes.NewBufferString(str), got))
+	assert.Equal(t, Release{Comment: "ok", Files: []string{"a"}, Name: "nightly", Size: 3}, *got)
+}
+
+type Handshake struct {
+	M    map[string]int `bencode:"m"`
+	Port int            `bencode:"p,omitempty"`
+}
+
+func TestMarshalMap(t *testing.T) {
+	str := "d1:md11:ut_metadatai3e6:ut_pexi1ee1:pi6881ee"
+	h := &Handshake{}
+	assert.NoError(t, UnmarshalBen(bytes.NewBufferString(str), h))
+	assert.Equal(t, map[string]int{"ut_metadata": 3, "ut_pex": 1}, h.M)
+	assert.Equal(t, 6881, h.Port)
+
+	buf := new(bytes.Buffer)
+	length := MarshalBen(buf, h)
+	assert.Equal(t, str, buf.String())
+	assert.Equal(t, len(str), length)
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	for _, str := range []string{"d1:ml", "d1:m99999999999:x", "d1:mli1e", "d1:m-5:abc"} {
+		h := &Handshake{}
+		assert.NotPanics(t, func() { UnmarshalBen(bytes.NewBufferString(str), h) }, str)
+	}
+}
+
+type KrpcError struct {
+	E []interface{} `bencode:"e"`
+	Y string        `bencode:"y"`
+}
+
+func TestMarshalMixedList(t *testing.T) {
+	str := "d1:eli201e13:Generic Errore1:y1:ee"
+	k := &KrpcError{}
+	assert.NoError(t, UnmarshalBen(bytes.NewBufferString(str), k))
+	assert.Equal(t, []interface{}{201, "Generic Error"}, k.E)
+
+	buf := new(bytes.Buffer)
+	MarshalBen(buf, k)
+	assert.Equal(t, str, buf.String())
+
+	r := &Release{}
+	assert.NotPanics(t, func() {
+		assert.Error(t, UnmarshalBen(bytes.NewBufferString("d5:filesli1eee"), r))
+	})
+}
+
+type Item struct {
+	Cas *int       `bencode:"cas,omitempty"`
+	Seq *int       `bencode:"seq,omitempty"`
+	V   RawMessage `bencode:"v,omitempty"`
+}
+
+func TestMarshalRawAndPointer(t *testing.T) {
+	str := "d3:seqi0e1:vd2:ih3:abc1:nli1ei2eeee"
+	it := &Item{}
+	assert.NoError(t, UnmarshalBen(bytes.NewBufferString(str), it))
+	assert.Nil(t, it.Cas)
+	if assert.NotNil(t, it.Seq) {
+		assert.Equal(t, 0, *it.Seq)
+	}
+	assert.Equal(t, "d2:ih3:abc1:nli1ei2eee", string(it.V))
+
+	buf := new(bytes.Buffer)
+	MarshalBen(buf, it)
+	assert.Equal(t, str, buf.String())
+}
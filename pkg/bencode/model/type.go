@@ -2,6 +2,7 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -93,11 +94,7 @@ func (o *BStr) Encode(writer io.Writer) (int, error) {
 
 func (o *BStr) Decode(br *bufio.Reader, node *BNode) {
 	node.type_ = BSTR
-	str, _ := br.ReadString(':')
-	str = strings.Trim(str, ":")
-	length, _ := strconv.Atoi(str)
-	buf := make([]byte, length)
-	_, err := io.ReadAtLeast(br, buf, length)
+	buf, err := readString(br)
 	if err != nil {
 		return
 	}
@@ -106,6 +103,26 @@ func (o *BStr) Decode(br *bufio.Reader, node *BNode) {
 	node.data = o
 }
 
+// 读取 "<length>:<data>" 形式的字符串，数据随读取增长而不是按声明的长度预先分配，
+// 避免来自网络的恶意长度造成巨大的内存分配
+func readString(br *bufio.Reader) ([]byte, error) {
+	str, err := br.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	str = strings.Trim(str, ":")
+	length, err := strconv.Atoi(str)
+	if err != nil || length < 0 {
+		return nil, ErrNum
+	}
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, br, int64(length))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (o *BStr) Type() Btype {
 	return BSTR
 }
@@ -145,11 +162,7 @@ func (o *BDict) Decode(br *bufio.Reader, node *BNode) {
 	node.type_ = BDICT
 	br.ReadByte()
 	for t, err := br.Peek(1); err != io.EOF && t[0] != 'e'; t, err = br.Peek(1) {
-		str, _ := br.ReadString(':')
-		str = strings.Trim(str, ":")
-		length, _ := strconv.Atoi(str)
-		buf := make([]byte, length)
-		_, err := io.ReadAtLeast(br, buf, length)
+		buf, err := readString(br)
 		if err != nil {
 			return
 		}
@@ -195,7 +208,7 @@ func (o *BList) Encode(writer io.Writer) (int, error) {
 func (o *BList) Decode(br *bufio.Reader, node *BNode) {
 	node.type_ = BLIST
 	br.ReadByte()
-	for t, _ := br.Peek(1); t[0] != 'e'; t, _ = br.Peek(1) {
+	for t, err := br.Peek(1); err == nil && t[0] != 'e'; t, err = br.Peek(1) {
 		elem, err := BenDecode(br)
 		if err != nil {
 			return
@@ -215,6 +228,11 @@ type BNode struct {
 	data  BObject
 }
 
+// Data returns the decoded bencode object held by the node
+func (o *BNode) Data() BObject {
+	return o.data
+}
+
 func Encode(o *BNode, writer io.Writer) (int, error) {
 	bw, ok := writer.(*bufio.Writer)
 	if !ok {
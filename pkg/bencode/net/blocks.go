@@ -0,0 +1,201 @@
+package net
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// 正在下载的分片中一个块的状态
+type blockState struct {
+	received bool
+	// 已向其请求该块、尚未收到回应的peer
+	requested []*PeerConn
+}
+
+// 正在下载的分片，按块记录请求和接收情况。不同的块可以从不同的peer下载，
+// endgame时同一个块可以同时向多个peer请求。peer断开后已收到的块仍然保留
+type activePiece struct {
+	pw       *pieceWork
+	buf      []byte
+	blocks   []blockState
+	received int
+	// 分片收齐后关闭
+	done chan struct{}
+}
+
+// 第i个块在分片中的偏移和长度
+func (ap *activePiece) blockBounds(i int) (begin, length int) {
+	begin = i * MaxBlockSize
+	return begin, min(MaxBlockSize, ap.pw.length-begin)
+}
+
+func (ap *activePiece) finished() bool {
+	select {
+	case <-ap.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 所有正在下载的分片
+type activePieces struct {
+	mu     sync.Mutex
+	pieces map[int]*activePiece
+}
+
+func newActivePieces() *activePieces {
+	return &activePieces{pieces: make(map[int]*activePiece)}
+}
+
+// 开始下载由picker选出的分片
+func (a *activePieces) start(pw *pieceWork) *activePiece {
+	ap := &activePiece{
+		pw:     pw,
+		buf:    make([]byte, pw.length),
+		blocks: make([]blockState, (pw.length+MaxBlockSize-1)/MaxBlockSize),
+		done:   make(chan struct{}),
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pieces[pw.index] = ap
+	return ap
+}
+
+// 为c选择一个field中的、仍有块可以向它请求的分片，优先选择有块还未请求过的分片。
+// 不在endgame时只选择有块还未向任何peer请求过的分片
+func (a *activePieces) join(c *PeerConn, field Bitfield, endgame bool) *activePiece {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var best *activePiece
+	for index, ap := range a.pieces {
+		if !field.HasPiece(index) {
+			continue
+		}
+		i, unrequested := ap.next(c, endgame)
+		if i < 0 || (!endgame && !unrequested) {
+			continue
+		}
+		if best == nil || unrequested {
+			best = ap
+		}
+		if unrequested {
+			break
+		}
+	}
+	return best
+}
+
+// 可以向c请求的下一个块。优先选择还没有向任何peer请求过的块，
+// endgame时也可以选择已经向其他peer请求过的块
+func (ap *activePiece) next(c *PeerConn, endgame bool) (block int, unrequested bool) {
+	dup := -1
+	for i, b := range ap.blocks {
+		if b.received {
+			continue
+		}
+		if len(b.requested) == 0 {
+			return i, true
+		}
+		if endgame && dup < 0 && !slices.Contains(b.requested, c) {
+			dup = i
+		}
+	}
+	return dup, false
+}
+
+// 选择并记录向c请求的下一个块
+func (a *activePieces) request(ap *activePiece, c *PeerConn, endgame bool) (begin, length int, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ap.finished() {
+		return 0, 0, false
+	}
+	i, _ := ap.next(c, endgame)
+	if i < 0 {
+		return 0, 0, false
+	}
+	ap.blocks[i].requested = append(ap.blocks[i].requested, c)
+	begin, length = ap.blockBounds(i)
+	return begin, length, true
+}
+
+// 已向c请求但尚未收到的块数
+func (a *activePieces) outstanding(ap *activePiece, c *PeerConn) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for _, b := range ap.blocks {
+		if slices.Contains(b.requested, c) {
+			n++
+		}
+	}
+	return n
+}
+
+// 是否已经收到了该偏移处的块
+func (a *activePieces) received(ap *activePiece, begin int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := begin / MaxBlockSize
+	return i >= 0 && i < len(ap.blocks) && ap.blocks[i].received
+}
+
+// 记录从c收到的块。返回同样请求了该块、需要发送cancel的其他peer，
+// 以及分片是否因此收齐，重复收到的块直接忽略
+func (a *activePieces) receive(ap *activePiece, c *PeerConn, begin int, data []byte) (cancel []*PeerConn, complete bool, err error) {
+	i := begin / MaxBlockSize
+	if begin%MaxBlockSize != 0 || i >= len(ap.blocks) {
+		return nil, false, fmt.Errorf("unexpected block at offset %d of piece #%d", begin, ap.pw.index)
+	}
+	if _, length := ap.blockBounds(i); length != len(data) {
+		return nil, false, fmt.Errorf("block at offset %d of piece #%d has length %d, want %d", begin, ap.pw.index, len(data), length)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := &ap.blocks[i]
+	if b.received || ap.finished() {
+		return nil, false, nil
+	}
+	copy(ap.buf[begin:], data)
+	b.received = true
+	for _, other := range b.requested {
+		if other != c {
+			cancel = append(cancel, other)
+		}
+	}
+	b.requested = nil
+	ap.received++
+	return cancel, ap.received == len(ap.blocks), nil
+}
+
+// c不会再回应对这些块的请求，例如被拒绝或者被choke。begin小于0表示所有块
+func (a *activePieces) release(ap *activePiece, c *PeerConn, begin int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range ap.blocks {
+		if b, _ := ap.blockBounds(i); begin >= 0 && b != begin {
+			continue
+		}
+		ap.blocks[i].requested = slices.DeleteFunc(ap.blocks[i].requested, func(p *PeerConn) bool { return p == c })
+	}
+}
+
+// c不再下载该分片，未收到的块可以再向其他peer请求。
+// 没有peer时分片仍然保留，之后连接的peer从已收到的块继续下载
+func (a *activePieces) leave(ap *activePiece, c *PeerConn) {
+	a.release(ap, c, -1)
+}
+
+// 分片收齐后移除，并通知其他仍在下载该分片的peer。
+// 校验失败时同样移除，已收到的块全部丢弃
+func (a *activePieces) finish(ap *activePiece) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ap.finished() {
+		return
+	}
+	delete(a.pieces, ap.pw.index)
+	close(ap.done)
+}
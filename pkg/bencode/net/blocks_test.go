@@ -0,0 +1,184 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestActivePiecesEndgame(t *testing.T) {
+	pieces := newActivePieces()
+	pw := &pieceWork{index: 3, length: 2*MaxBlockSize + 10}
+	ap := pieces.start(pw)
+	assert.Len(t, ap.blocks, 3)
+	slow, fast := &PeerConn{BitField: fullBitfield(4)}, &PeerConn{BitField: fullBitfield(4)}
+
+	for i := 0; i < 3; i++ {
+		_, _, ok := pieces.request(ap, slow, false)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 3, pieces.outstanding(ap, slow))
+	// 所有块都已请求，只有endgame时才重复请求
+	_, _, ok := pieces.request(ap, fast, false)
+	assert.False(t, ok)
+	assert.Nil(t, pieces.join(fast, fast.BitField, false))
+	assert.Same(t, ap, pieces.join(fast, fast.BitField, true))
+	begin, length, ok := pieces.request(ap, fast, true)
+	assert.True(t, ok)
+	assert.Equal(t, 0, begin)
+	assert.Equal(t, MaxBlockSize, length)
+
+	cancel, complete, err := pieces.receive(ap, fast, 0, make([]byte, MaxBlockSize))
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, []*PeerConn{slow}, cancel)
+	assert.Equal(t, 2, pieces.outstanding(ap, slow))
+	// 重复收到的块被忽略
+	cancel, complete, err = pieces.receive(ap, slow, 0, make([]byte, MaxBlockSize))
+	assert.NoError(t, err)
+	assert.Nil(t, cancel)
+	assert.False(t, complete)
+	_, _, err = pieces.receive(ap, slow, 2*MaxBlockSize, make([]byte, MaxBlockSize))
+	assert.Error(t, err)
+
+	_, _, err = pieces.receive(ap, slow, MaxBlockSize, make([]byte, MaxBlockSize))
+	assert.NoError(t, err)
+	_, complete, err = pieces.receive(ap, slow, 2*MaxBlockSize, make([]byte, 10))
+	assert.NoError(t, err)
+	assert.True(t, complete)
+
+	pieces.finish(ap)
+	pieces.leave(ap, fast)
+	pieces.leave(ap, slow)
+	assert.Nil(t, pieces.join(fast, fast.BitField, true))
+}
+
+// 同一个分片的块可以从不同的peer下载，peer离开后已收到的块保留
+func TestActivePiecesShared(t *testing.T) {
+	pieces := newActivePieces()
+	ap := pieces.start(&pieceWork{index: 1, length: 4 * MaxBlockSize})
+	a, b := &PeerConn{BitField: fullBitfield(2)}, &PeerConn{BitField: fullBitfield(2)}
+	for i := 0; i < 2; i++ {
+		_, _, ok := pieces.request(ap, a, false)
+		assert.True(t, ok)
+	}
+	// 只拥有其他分片的peer不会加入
+	assert.Nil(t, pieces.join(b, bitfieldOf(2, 0), false))
+	assert.Same(t, ap, pieces.join(b, b.BitField, false))
+	begin, _, ok := pieces.request(ap, b, false)
+	assert.True(t, ok)
+	assert.Equal(t, 2*MaxBlockSize, begin)
+
+	_, _, err := pieces.receive(ap, a, 0, make([]byte, MaxBlockSize))
+	assert.NoError(t, err)
+	pieces.leave(ap, a)
+	assert.Equal(t, 0, pieces.outstanding(ap, a))
+	// a未返回的块可以再向b请求，已收到的块不会再请求
+	begin, _, ok = pieces.request(ap, b, false)
+	assert.True(t, ok)
+	assert.Equal(t, MaxBlockSize, begin)
+	begin, _, ok = pieces.request(ap, b, false)
+	assert.True(t, ok)
+	assert.Equal(t, 3*MaxBlockSize, begin)
+	_, _, ok = pieces.request(ap, b, false)
+	assert.False(t, ok)
+	for _, begin := range []int{MaxBlockSize, 2 * MaxBlockSize} {
+		_, complete, err := pieces.receive(ap, b, begin, make([]byte, MaxBlockSize))
+		assert.NoError(t, err)
+		assert.False(t, complete)
+	}
+	_, complete, err := pieces.receive(ap, b, 3*MaxBlockSize, make([]byte, MaxBlockSize))
+	assert.NoError(t, err)
+	assert.True(t, complete)
+}
+
+// 完成握手、发送位图并unchoke后从不返回数据的peer，收到的request和cancel消息依次写入msgs
+func startStalledPeer(t *testing.T, ctx context.Context, tf *TorrentFile) (*PeerInfo, <-chan *Message) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	context.AfterFunc(ctx, func() { l.Close() })
+	msgs := make(chan *Message, 64)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = acceptHandShake(conn, tf.InfoSHA, util.GeneratePeerID("stalled"))
+		if err != nil {
+			return
+		}
+		c := &PeerConn{Conn: conn}
+		c.WriteMessage(NewBitfieldMessage(fullBitfield(len(tf.PieceSHA))))
+		c.SendUnChoke()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg != nil && (msg.ID == MsgRequest || msg.ID == MsgCancel) {
+				msgs <- msg
+			}
+		}
+	}()
+	return peerFromAddr(t, l.Addr().String()), msgs
+}
+
+// 最后一个分片卡在不返回数据的peer上时，由其他peer完成并向其发送cancel
+func TestEndgameCancelsStalledRequests(t *testing.T) {
+	tf, data := newTestTorrentFile(t, 4*MaxBlockSize, 8*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	stalled, msgs := startStalledPeer(t, ctx, tf)
+	seeder := peerFromAddr(t, startTestSeeder(t, ctx, tf, data))
+
+	tf.peers = []*PeerInfo{stalled}
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	go func() {
+		// 卡住的peer领取一个分片后再加入做种方
+		<-msgs
+		leecher.discoverPeer(seeder)
+	}()
+	start := time.Now()
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+	assert.Less(t, time.Since(start), RequestTimeout)
+
+	select {
+	case msg := <-msgs:
+		for msg.ID == MsgRequest {
+			msg = <-msgs
+		}
+		_, begin, length, err := ParseCancel(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, begin%MaxBlockSize)
+		assert.Equal(t, MaxBlockSize, length)
+	case <-ctx.Done():
+		t.Fatal("no cancel received")
+	}
+}
+
+// 分片较大时，多个peer同时下载同一个分片的不同块
+func TestDownloadLargePieceFromPeers(t *testing.T) {
+	tf, data := newTestTorrentFile(t, 16*MaxBlockSize, 16*MaxBlockSize+100)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{
+		peerFromAddr(t, startTestSeeder(t, ctx, tf, data)),
+		peerFromAddr(t, startTestSeeder(t, ctx, tf, data)),
+	}
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+}
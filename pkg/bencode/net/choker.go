@@ -0,0 +1,226 @@
+package net
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUploadSlots is the number of peers unchoked at the same time,
+// including the optimistic unchoke
+const DefaultUploadSlots = 4
+
+// ChokeInterval is how often the peers to unchoke are chosen again
+const ChokeInterval = 10 * time.Second
+
+// OptimisticInterval is how often the optimistic unchoke moves to another peer
+const OptimisticInterval = 30 * time.Second
+
+// NewPeerTime is how long a peer counts as newly connected, new peers are
+// three times as likely to get the optimistic unchoke
+const NewPeerTime = time.Minute
+
+// 参与choke轮换的peer，以及上一轮统计时的传输量
+type chokePeer struct {
+	joined   time.Time
+	lastDown int64
+	lastUp   int64
+	rate     int64
+}
+
+// 决定unchoke哪些peer：按下载速率（做种时按上传速率）unchoke前slots-1个
+// 感兴趣的peer，另外轮换一个乐观unchoke的peer
+type choker struct {
+	slots   int
+	seeding func() bool
+	running atomic.Bool
+
+	mu             sync.Mutex
+	peers          map[*PeerConn]*chokePeer
+	optimistic     *PeerConn
+	lastOptimistic time.Time
+	rand           *rand.Rand
+}
+
+func newChoker(slots int, seeding func() bool) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{
+		slots:   slots,
+		seeding: seeding,
+		peers:   make(map[*PeerConn]*chokePeer),
+		rand:    rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// 开始定期轮换，直到ctx结束，已经在运行时直接返回
+func (ch *choker) start(ctx context.Context) {
+	if !ch.running.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer ch.running.Store(false)
+		tk := time.NewTicker(ChokeInterval)
+		defer tk.Stop()
+		for {
+			select {
+			case now := <-tk.C:
+				ch.rechoke(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (ch *choker) add(c *PeerConn) {
+	c.choker = ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.peers[c] = &chokePeer{
+		joined:   time.Now(),
+		lastDown: c.downloaded.Load(),
+		lastUp:   c.uploaded.Load(),
+	}
+}
+
+func (ch *choker) remove(c *PeerConn) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	delete(ch.peers, c)
+	if ch.optimistic == c {
+		ch.optimistic = nil
+	}
+}
+
+// 对方开始感兴趣时，如果还有空闲的名额就立即unchoke，不必等到下一轮
+func (ch *choker) interested(c *PeerConn) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if _, ok := ch.peers[c]; !ok {
+		return
+	}
+	unchoked := 0
+	for p := range ch.peers {
+		if !p.choking() {
+			unchoked++
+		}
+	}
+	if unchoked < ch.slots {
+		c.setChoking(false)
+	}
+}
+
+// 重新选择unchoke的peer
+func (ch *choker) rechoke(now time.Time) {
+	ch.mu.Lock()
+	seeding := ch.seeding != nil && ch.seeding()
+	var candidates []*PeerConn
+	for c, p := range ch.peers {
+		down, up := c.downloaded.Load(), c.uploaded.Load()
+		p.rate = down - p.lastDown
+		if seeding {
+			p.rate = up - p.lastUp
+		}
+		p.lastDown, p.lastUp = down, up
+		if c.interested() {
+			candidates = append(candidates, c)
+		}
+	}
+	// 速率相同时随机排序，避免总是unchoke同样的peer
+	ch.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return ch.peers[candidates[i]].rate > ch.peers[candidates[j]].rate
+	})
+	regular := candidates[:min(len(candidates), ch.slots-1)]
+	unchoke := make(map[*PeerConn]bool)
+	for _, c := range regular {
+		unchoke[c] = true
+	}
+	rest := candidates[len(regular):]
+	if ch.optimistic == nil || unchoke[ch.optimistic] || !ch.optimistic.interested() ||
+		now.Sub(ch.lastOptimistic) >= OptimisticInterval {
+		ch.optimistic = ch.pickOptimistic(rest, now)
+		ch.lastOptimistic = now
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	peers := make([]*PeerConn, 0, len(ch.peers))
+	for c := range ch.peers {
+		peers = append(peers, c)
+	}
+	ch.mu.Unlock()
+	for _, c := range peers {
+		c.setChoking(!unchoke[c])
+	}
+}
+
+// 随机选择乐观unchoke的peer，新连接的peer的权重是其他peer的三倍
+func (ch *choker) pickOptimistic(candidates []*PeerConn, now time.Time) *PeerConn {
+	total := 0
+	weight := func(c *PeerConn) int {
+		if now.Sub(ch.peers[c].joined) < NewPeerTime {
+			return 3
+		}
+		return 1
+	}
+	for _, c := range candidates {
+		total += weight(c)
+	}
+	if total == 0 {
+		return nil
+	}
+	n := ch.rand.Intn(total)
+	for _, c := range candidates {
+		n -= weight(c)
+		if n < 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// 我们是否正在choke对方
+func (c *PeerConn) choking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amChoking
+}
+
+// 改变对对方的choke状态，状态变化时通知对方
+func (c *PeerConn) setChoking(choke bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.amChoking == choke {
+		return nil
+	}
+	c.amChoking = choke
+	if choke {
+		return c.SendBasicMessage(MsgChoke)
+	}
+	return c.SendBasicMessage(MsgUnchoke)
+}
+
+// 对方是否对我们的分片感兴趣
+func (c *PeerConn) interested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerInterested
+}
+
+// 处理对方的interested和not interested消息
+func (c *PeerConn) setInterested(interested bool) {
+	c.mu.Lock()
+	c.peerInterested = interested
+	c.mu.Unlock()
+	if interested && c.choker != nil {
+		c.choker.interested(c)
+	}
+}
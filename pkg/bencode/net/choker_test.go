@@ -0,0 +1,147 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 连接到一个丢弃所有消息的对端，初始状态为choke
+func newChokeTestPeer(t *testing.T, ch *choker, interested bool) *PeerConn {
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() { local.Close() })
+	c := &PeerConn{Conn: local, amChoking: true}
+	ch.add(c)
+	c.mu.Lock()
+	c.peerInterested = interested
+	c.mu.Unlock()
+	return c
+}
+
+func unchokedPeers(peers []*PeerConn) []int {
+	var unchoked []int
+	for i, c := range peers {
+		if !c.choking() {
+			unchoked = append(unchoked, i)
+		}
+	}
+	return unchoked
+}
+
+func TestChokerUnchokesFastestPeers(t *testing.T) {
+	seeding := false
+	ch := newChoker(3, func() bool { return seeding })
+	var peers []*PeerConn
+	for i := 0; i < 6; i++ {
+		peers = append(peers, newChokeTestPeer(t, ch, i != 5))
+	}
+	// 下载时按从对方下载的速率排序，不感兴趣的peer不会unchoke
+	for i, c := range peers {
+		c.downloaded.Add(int64(100 * i))
+		c.uploaded.Add(int64(100 * (5 - i)))
+	}
+	now := time.Now()
+	ch.rechoke(now)
+	unchoked := unchokedPeers(peers)
+	assert.Len(t, unchoked, 3)
+	assert.Contains(t, unchoked, 3)
+	assert.Contains(t, unchoked, 4)
+	assert.NotContains(t, unchoked, 5)
+	optimistic := ch.optimistic
+	assert.Contains(t, peers[:3], optimistic)
+
+	// 做种时按上传速率排序，乐观unchoke在OptimisticInterval内保持不变
+	seeding = true
+	for i, c := range peers {
+		c.uploaded.Add(int64(100 * (5 - i)))
+	}
+	ch.rechoke(now.Add(ChokeInterval))
+	unchoked = unchokedPeers(peers)
+	assert.Contains(t, unchoked, 0)
+	assert.Contains(t, unchoked, 1)
+	if optimistic != peers[0] && optimistic != peers[1] {
+		assert.Same(t, optimistic, ch.optimistic)
+		assert.Len(t, unchoked, 3)
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	ch := newChoker(1, nil)
+	var peers []*PeerConn
+	for i := 0; i < 4; i++ {
+		peers = append(peers, newChokeTestPeer(t, ch, true))
+	}
+	now := time.Now()
+	ch.rechoke(now)
+	first := ch.optimistic
+	assert.Len(t, unchokedPeers(peers), 1)
+	ch.rechoke(now.Add(ChokeInterval))
+	assert.Same(t, first, ch.optimistic)
+
+	changed := false
+	for i := 1; i <= 20 && !changed; i++ {
+		ch.rechoke(now.Add(time.Duration(i) * OptimisticInterval))
+		changed = ch.optimistic != first
+		assert.Len(t, unchokedPeers(peers), 1)
+	}
+	assert.True(t, changed)
+}
+
+// 新连接的peer更容易获得乐观unchoke
+func TestChokerPrefersNewPeers(t *testing.T) {
+	ch := newChoker(1, nil)
+	var peers []*PeerConn
+	for i := 0; i < 4; i++ {
+		peers = append(peers, newChokeTestPeer(t, ch, true))
+	}
+	now := time.Now()
+	for _, c := range peers[1:] {
+		ch.peers[c].joined = now.Add(-2 * NewPeerTime)
+	}
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		if ch.pickOptimistic(peers, now) == peers[0] {
+			picked++
+		}
+	}
+	// 新peer的概率为3/6
+	assert.InDelta(t, 500, picked, 100)
+}
+
+// 名额用完后感兴趣的peer要等到下一轮才会被unchoke
+func TestChokerLimitsUploadSlots(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 4*MaxBlockSize)
+	tf.UploadSlots = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peer := peerFromAddr(t, startTestSeeder(t, ctx, tf, data))
+
+	// 读取消息直到超时，返回是否收到了unchoke
+	unchoked := func(c *PeerConn, wait time.Duration) bool {
+		c.SetReadDeadline(time.Now().Add(wait))
+		defer c.SetReadDeadline(time.Time{})
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return false
+			}
+			if msg != nil && msg.ID == MsgUnchoke {
+				return true
+			}
+		}
+	}
+	for i, want := range []bool{true, false} {
+		c, err := NewConn(peer, tf.InfoSHA, util.GeneratePeerID("leecher"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		assert.NoError(t, c.SendInterested())
+		assert.Equal(t, want, unchoked(c, time.Second), i)
+	}
+}
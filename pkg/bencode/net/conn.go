@@ -0,0 +1,264 @@
+package net
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// KeepAliveInterval is how long a connection may go without us sending
+// anything before a keep-alive is sent
+const KeepAliveInterval = 2 * time.Minute
+
+// DefaultPeerTimeout is how long a peer may stay silent before its connection
+// is closed, long enough for the keep-alives of other clients to arrive
+const DefaultPeerTimeout = 3 * time.Minute
+
+// EventBacklog is the number of messages buffered between the reader of a
+// connection and its download loop
+const EventBacklog = 2 * MaxBacklog
+
+// 连接的读取协程：依次读取并处理对方的所有消息，直到连接出错或者ctx结束时连接被关闭。
+// 连接上只有这一个协程读取，其他协程通过连接的状态和events获取对方的消息。
+// 对方沉默超过peerTimeout时断开连接，读取期间在空闲时向对方发送keep-alive
+func (t *Torrent) readLoop(c *PeerConn) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.sendKeepAlives(t.keepAlive, stop)
+	for {
+		err := c.SetReadDeadline(time.Now().Add(t.peerTimeout))
+		if err != nil {
+			return err
+		}
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.checkBan(c, err)
+			return err
+		}
+		// keep-alive只用于维持连接
+		if msg == nil {
+			continue
+		}
+		err = t.handleMessage(c, msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 距上次发送消息超过interval时发送keep-alive，直到stop关闭或者发送失败
+func (c *PeerConn) sendKeepAlives(interval time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+		idle := time.Since(time.Unix(0, c.lastWrite.Load()))
+		if idle >= interval {
+			_, err := c.WriteMessage(nil)
+			if err != nil {
+				return
+			}
+			idle = 0
+		}
+		timer.Reset(interval - idle)
+	}
+}
+
+// 为下载连接启动读取协程，返回的函数在下载循环结束时调用
+func (t *Torrent) startReader(c *PeerConn) (stop func()) {
+	c.events = make(chan *Message, EventBacklog)
+	c.quit = make(chan struct{})
+	go func() {
+		c.readErr = t.readLoop(c)
+		close(c.events)
+	}()
+	return func() {
+		close(c.quit)
+		c.Close()
+	}
+}
+
+// 按消息类型更新连接的状态，之后将下载需要的消息转发给下载循环。
+// 未知的消息直接忽略
+func (t *Torrent) handleMessage(c *PeerConn, msg *Message) error {
+	var err error
+	switch msg.ID {
+	case MsgChoke:
+		c.setPeerChoking(true)
+	case MsgUnchoke:
+		c.setPeerChoking(false)
+	case MsgInterested:
+		c.setInterested(true)
+	case MsgNotInterested:
+		c.setInterested(false)
+	case MsgHave:
+		var index int
+		index, err = GetHaveIndex(msg)
+		if err != nil {
+			return err
+		}
+		c.setHave(index)
+		err = c.updateInterest()
+	case MsgBitfield:
+		err = c.checkBitfield(msg.Payload)
+		if err != nil {
+			return err
+		}
+		c.setBitfield(msg.Payload, false)
+		err = c.updateInterest()
+	case MsgHaveAll:
+		c.setBitfield(fullBitfield(len(t.PieceSHA)), true)
+		err = c.updateInterest()
+	case MsgHaveNone:
+		c.setBitfield(NewBitfield(len(t.PieceSHA)), false)
+		err = c.updateInterest()
+	case MsgRequest:
+		err = t.sendBlock(c, msg)
+	case MsgCancel:
+		// 请求在收到时立即处理，没有排队等待发送的块可以取消
+	case MsgExtended:
+		err = c.handleExtended(msg.Payload)
+	case MsgAllowedFast:
+		err = c.handleFastMessage(msg)
+	case MsgSuggest:
+		// 按期限、优先级和稀有度选择分片，不使用对方的建议
+	}
+	if err != nil {
+		return err
+	}
+	c.forward(msg)
+	return nil
+}
+
+// 将请求的结果，以及可能使更多分片可以请求的状态变化转发给下载循环
+func (c *PeerConn) forward(msg *Message) {
+	if c.events == nil {
+		return
+	}
+	switch msg.ID {
+	case MsgChoke, MsgUnchoke, MsgHave, MsgBitfield, MsgHaveAll, MsgHaveNone,
+		MsgAllowedFast, MsgPiece, MsgReject:
+		select {
+		case c.events <- msg:
+		case <-c.quit:
+		}
+	}
+}
+
+// 对方是否choke我们
+func (c *PeerConn) peerChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Choked
+}
+
+func (c *PeerConn) setPeerChoking(choked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Choked = choked
+}
+
+// 我们是否对对方的分片感兴趣
+func (c *PeerConn) interesting() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amInterested
+}
+
+// 根据对方拥有的分片重新计算我们是否对其感兴趣，变化时通知对方。
+// 没有在下载的连接不会感兴趣
+func (c *PeerConn) updateInterest() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	interested := c.picker != nil && c.picker.Interesting(c.BitField)
+	if interested == c.amInterested {
+		return nil
+	}
+	c.amInterested = interested
+	if interested {
+		return c.SendBasicMessage(MsgInterested)
+	}
+	return c.SendBasicMessage(MsgNotInterested)
+}
+
+// 对方是否拥有全部分片
+func (c *PeerConn) complete() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.haveAll || (c.numPieces > 0 && c.BitField.Equal(fullBitfield(c.numPieces)))
+}
+
+// 下载时统计对方拥有的分片，在启动读取协程之前调用
+func (c *PeerConn) attachPicker(p *PiecePicker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.picker = p
+	p.AddPeer(c.BitField)
+}
+
+// 连接断开时不再统计对方拥有的分片
+func (c *PeerConn) detachPicker() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.picker != nil {
+		c.picker.RemovePeer(c.BitField)
+		c.picker = nil
+	}
+}
+
+// 本地拥有的分片变化后，重新计算对所有下载连接的兴趣
+func (t *Torrent) updateInterests() {
+	t.m.Lock()
+	conns := make([]*PeerConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.m.Unlock()
+	for _, c := range conns {
+		c.updateInterest()
+	}
+}
+
+// 对方发送了超过长度上限的消息时，不再与其IP通信
+func (t *Torrent) checkBan(c *PeerConn, err error) {
+	if !errors.Is(err, ErrMessageTooLong) {
+		return
+	}
+	host, _, splitErr := net.SplitHostPort(c.RemoteAddr().String())
+	if splitErr != nil {
+		return
+	}
+	log.Println("banning", host+":", err)
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.bans[net.ParseIP(host).String()] = struct{}{}
+}
+
+// addr所在的IP是否已被禁止
+func (t *Torrent) banned(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	_, ok := t.bans[net.ParseIP(host).String()]
+	return ok
+}
+
+func (t *Torrent) addConn(c *PeerConn) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.conns[c] = struct{}{}
+}
+
+func (t *Torrent) removeConn(c *PeerConn) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.conns, c)
+}
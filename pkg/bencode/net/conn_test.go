@@ -0,0 +1,234 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// 通过内存管道连接的对端，对方发来的消息依次写入返回的channel
+func newPipeConn(t *testing.T, tr *Torrent) (*PeerConn, net.Conn, <-chan *Message) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	c := &PeerConn{
+		Conn:      local,
+		Choked:    true,
+		BitField:  NewBitfield(len(tr.PieceSHA)),
+		numPieces: len(tr.PieceSHA),
+		amChoking: true,
+	}
+	msgs := make(chan *Message, 64)
+	go func() {
+		peer := &PeerConn{Conn: remote}
+		for {
+			msg, err := peer.ReadMessage()
+			if err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return c, remote, msgs
+}
+
+func nextMessage(t *testing.T, msgs <-chan *Message) *Message {
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+// 对方拥有我们缺少的分片时发送interested，本地下载完这些分片后发送not interested
+func TestInterestFollowsBitfields(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 4*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("leecher"))
+	tr.picker = NewPiecePicker(len(tf.PieceSHA))
+	c, _, msgs := newPipeConn(t, tr)
+	c.attachPicker(tr.picker)
+	tr.addConn(c)
+
+	assert.NoError(t, c.updateInterest())
+	assert.False(t, c.interesting())
+	assert.NoError(t, tr.handleMessage(c, NewHaveMessage(2)))
+	assert.True(t, c.interesting())
+	assert.Equal(t, MsgInterested, nextMessage(t, msgs).ID)
+	assert.Equal(t, 1, tr.picker.Availability(2))
+
+	index, ok := tr.picker.Pick(c.requestable())
+	assert.False(t, ok)
+	assert.NoError(t, tr.handleMessage(c, NewUnchokeMessage()))
+	index, ok = tr.picker.Pick(c.requestable())
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+	tr.picker.Done(index)
+	tr.updateInterests()
+	assert.False(t, c.interesting())
+	assert.Equal(t, MsgNotInterested, nextMessage(t, msgs).ID)
+
+	// 位图替换之前的分片，picker中的统计随之更新
+	assert.NoError(t, tr.handleMessage(c, NewBitfieldMessage(bitfieldOf(len(tf.PieceSHA), 0, 3))))
+	assert.Equal(t, MsgInterested, nextMessage(t, msgs).ID)
+	assert.Equal(t, 0, tr.picker.Availability(2))
+	assert.Equal(t, 1, tr.picker.Availability(3))
+	c.detachPicker()
+	assert.Equal(t, 0, tr.picker.Availability(3))
+}
+
+// 长度不对或者多余的位被置1的位图被拒绝，读取协程因此关闭连接
+func TestInvalidBitfield(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 10*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("leecher"))
+	tr.picker = NewPiecePicker(len(tf.PieceSHA))
+	c, _, _ := newPipeConn(t, tr)
+	c.attachPicker(tr.picker)
+
+	for _, field := range []Bitfield{{0xff}, {0xff, 0xc0, 0x00}, {0xff, 0xe0}, {0xff, 0xc1}} {
+		assert.Error(t, tr.handleMessage(c, NewBitfieldMessage(field)), field)
+		assert.Equal(t, 0, tr.picker.Availability(0))
+	}
+	assert.NoError(t, tr.handleMessage(c, NewBitfieldMessage(Bitfield{0xff, 0xc0})))
+	assert.Equal(t, 1, tr.picker.Availability(9))
+}
+
+// 下载连接同样为对方的request返回数据
+func TestServeRequestsOnAnyConnection(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("seeder"))
+	tr.storage = memoryStorage(t, tf, data)
+	assert.NoError(t, tr.verifyPieces())
+	c, _, msgs := newPipeConn(t, tr)
+	tr.picker = NewPiecePicker(len(tf.PieceSHA))
+	c.attachPicker(tr.picker)
+	defer tr.startReader(c)()
+
+	assert.NoError(t, c.setChoking(false))
+	assert.Equal(t, MsgUnchoke, nextMessage(t, msgs).ID)
+	req := NewRequestMessage(1, 0, MaxBlockSize)
+	assert.NoError(t, tr.handleMessage(c, &req))
+	msg := nextMessage(t, msgs)
+	assert.Equal(t, MsgPiece, msg.ID)
+	assert.Equal(t, data[MaxBlockSize:], msg.Payload[8:])
+}
+
+// keep-alive和未知类型的消息被忽略，之后的消息照常处理
+func TestReaderSkipsUnknownMessages(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("leecher"))
+	c, remote, _ := newPipeConn(t, tr)
+	defer tr.startReader(c)()
+
+	go func() {
+		remote.Write([]byte{0, 0, 0, 0})
+		remote.Write((&Message{ID: 99, Payload: []byte("unknown")}).Serialize())
+		remote.Write(NewUnchokeMessage().Serialize())
+	}()
+	select {
+	case msg, ok := <-c.events:
+		assert.True(t, ok, c.readErr)
+		assert.Equal(t, MsgUnchoke, msg.ID)
+	case <-time.After(time.Second):
+		t.Fatal("unchoke not forwarded")
+	}
+	assert.False(t, c.peerChoking())
+}
+
+// 空闲时发送keep-alive，对方的keep-alive维持连接，对方沉默超时后断开
+func TestKeepAliveAndPeerTimeout(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	tf.PeerTimeout = 300 * time.Millisecond
+	tr := newTorrent(tf, util.GeneratePeerID("leecher"))
+	tr.keepAlive = 50 * time.Millisecond
+	c, remote, msgs := newPipeConn(t, tr)
+	defer tr.startReader(c)()
+
+	assert.Nil(t, nextMessage(t, msgs))
+	for i := 0; i < 8; i++ {
+		_, err := remote.Write((*Message)(nil).Serialize())
+		assert.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-c.events:
+		t.Fatal("connection closed while the peer sent keep-alives", c.readErr)
+	default:
+	}
+
+	select {
+	case _, ok := <-c.events:
+		assert.False(t, ok)
+		var ne net.Error
+		if assert.ErrorAs(t, c.readErr, &ne) {
+			assert.True(t, ne.Timeout())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent peer not dropped")
+	}
+}
+
+// 超过上限的消息在读取payload之前被拒绝，位图的上限按分片数计算
+func TestReadMessageLength(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("leecher"))
+	c, remote, _ := newPipeConn(t, tr)
+	c.numPieces = 8 * (MaxMessageLen + 100)
+	send := func(msg *Message) {
+		go remote.Write(msg.Serialize())
+	}
+
+	send(NewBitfieldMessage(NewBitfield(c.numPieces)))
+	msg, err := c.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, MsgBitfield, msg.ID)
+	send(NewPieceMessage(0, 0, make([]byte, MaxBlockSize)))
+	msg, err = c.ReadMessage()
+	assert.NoError(t, err)
+	assert.Len(t, msg.Payload, 8+MaxBlockSize)
+	releaseMessage(msg)
+	assert.Nil(t, msg.Payload)
+
+	go remote.Write([]byte{0x40, 0, 0, 0, byte(MsgPiece)})
+	_, err = c.ReadMessage()
+	assert.ErrorIs(t, err, ErrMessageTooLong)
+	c.maxMessage = 100
+	send(&Message{ID: MsgExtended, Payload: make([]byte, 100)})
+	_, err = c.ReadMessage()
+	assert.ErrorIs(t, err, ErrMessageTooLong)
+}
+
+// 发送过长消息的peer被断开，之后不再接受其连接
+func TestOversizedMessageBansPeer(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	assert.NoError(t, seeder.verifyPieces())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := peerFromAddr(t, l.Addr().String())
+
+	c, err := dialConn(peer, tf.InfoSHA, util.GeneratePeerID("attacker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Write([]byte{0xff, 0xff, 0xff, 0xff, byte(MsgExtended)})
+	assert.NoError(t, err)
+	for err == nil {
+		_, err = c.ReadMessage()
+	}
+	assert.True(t, seeder.banned(c.LocalAddr()))
+	_, err = dialConn(peer, tf.InfoSHA, util.GeneratePeerID("attacker"))
+	assert.Error(t, err)
+}
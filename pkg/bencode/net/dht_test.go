@@ -0,0 +1,45 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/dht"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestDHT(t *testing.T, bootstrap ...string) *dht.Server {
+	s, err := dht.NewServer(dht.Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: append([]string{}, bootstrap...),
+		QueryTimeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// 没有tracker和已知peer时通过DHT找到做种方
+func TestDownloadFromDHTPeers(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 8*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	addr := startTestSeeder(t, ctx, tf, data)
+
+	router := newTestDHT(t)
+	seederDHT := newTestDHT(t, router.Addr().String())
+	_, err := seederDHT.Announce(ctx, tf.InfoSHA, int(peerFromAddr(t, addr).Port))
+	assert.NoError(t, err)
+
+	tf.DHT = newTestDHT(t, router.Addr().String())
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+	assert.Len(t, leecher.Peers, 1)
+}
@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/dht"
+	"github.com/shoggothforever/torcore/pkg/bencode/lsd"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
 	"log"
 	"net"
 	"runtime"
@@ -22,6 +27,9 @@ const MaxBacklog = 5
 
 const ReceiveGNums = 16
 
+// DHTInterval is how often peers are looked up, and announced, on the DHT
+const DHTInterval = 5 * time.Minute
+
 type pieceWork struct {
 	index  int
 	hash   [20]byte
@@ -32,13 +40,18 @@ type pieceResult struct {
 	index int
 	buf   []byte
 }
+
+// 在一个连接上下载分片的进度，块的状态记录在可能与其他连接共享的activePiece中
 type pieceProgress struct {
-	index      int
-	client     *PeerConn
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+	index    int
+	client   *PeerConn
+	pieces   *activePieces
+	piece    *activePiece
+	complete bool
+}
+
+func newPieceProgress(c *PeerConn, pieces *activePieces, ap *activePiece) *pieceProgress {
+	return &pieceProgress{index: ap.pw.index, client: c, pieces: pieces, piece: ap}
 }
 
 // Torrent holds data required to download a torrent from a list of peers
@@ -53,35 +66,196 @@ type Torrent struct {
 	m           sync.Mutex
 	mp          map[string]struct{}
 	wg          sync.WaitGroup
+	// 本地已拥有的分片以及分片数据的存储，用于向其他peer上传
+	bitfield   Bitfield
+	storage    storage.Torrent
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	infoBytes  []byte
+	extensions *ExtensionRegistry
+	// 接收其他peer连接的端口，在扩展握手中告知对方
+	port int
+	// 当前已连接的peer，通过PEX告知其他peer
+	live map[string]pexPeer
+	// 下载过程中连接新发现的peer，未在下载时为nil
+	addPeerFn func(peer *PeerInfo)
+	// 下载时选择各个peer下载的分片，以及正在下载的分片中各个块的状态
+	picker *PiecePicker
+	active *activePieces
+	// 决定向哪些peer上传
+	choker *choker
+	// 正在下载的连接，本地拥有的分片变化时重新计算对它们的兴趣
+	conns map[*PeerConn]struct{}
+	// 关闭沉默的peer的时限，以及空闲时发送keep-alive的间隔
+	peerTimeout time.Duration
+	keepAlive   time.Duration
+	// peer消息的长度上限，以及因为违反上限而不再连接的IP
+	maxMessage int
+	bans       map[string]struct{}
+	// 创建该下载的种子
+	tf *TorrentFile
+	// SetPriorityRange设置的优先范围，以及各个Reader的优先范围，由t.m保护
+	priority   priorityRange
+	readRanges map[*Reader]priorityRange
+	// 是否顺序下载，以及顺序下载当前的窗口，由t.m保护
+	sequential bool
+	window     sequentialWindow
+	// 供Reader读取的存储
+	reading readable
+	// 各个文件的优先级，由t.m保护
+	filePriority []Priority
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.ReadMessage() // this call blocks
-	if err != nil {
-		return err
+func newTorrent(tf *TorrentFile, peerID [IDLEN]byte) *Torrent {
+	t := &Torrent{
+		PeerID:      peerID,
+		InfoSHA:     tf.InfoSHA,
+		PieceSHA:    tf.PieceSHA,
+		PieceLength: tf.PieceLen,
+		Length:      tf.FileLen,
+		Name:        tf.FileName,
+		mp:          make(map[string]struct{}),
+		bitfield:    NewBitfield(len(tf.PieceSHA)),
+		infoBytes:   tf.infoBytes,
+		live:        make(map[string]pexPeer),
+		conns:       make(map[*PeerConn]struct{}),
+		peerTimeout: tf.PeerTimeout,
+		keepAlive:   KeepAliveInterval,
+		maxMessage:  tf.MaxMessageLen,
+		bans:        make(map[string]struct{}),
+		tf:          tf,
+		reading:     readable{changed: make(chan struct{})},
 	}
+	t.filePriority = make([]Priority, len(t.fileList()))
+	// 只下载magnet链接的so参数列出的文件
+	if tf.Select != nil {
+		for i := range t.filePriority {
+			t.filePriority[i] = PrioritySkip
+		}
+		for _, i := range tf.Select {
+			if i >= 0 && i < len(t.filePriority) {
+				t.filePriority[i] = PriorityNormal
+			}
+		}
+	}
+	if t.peerTimeout <= 0 {
+		t.peerTimeout = DefaultPeerTimeout
+	}
+	t.choker = newChoker(tf.UploadSlots, t.seeding)
+	t.extensions = NewExtensionRegistry()
+	t.extensions.Register(&metadataExtension{t: t})
+	if !tf.Private {
+		t.extensions.Register(&pexExtension{t: t})
+	}
+	return t
+}
+
+// 处理读取协程转发的消息，连接的状态已经由读取协程更新
+func (state *pieceProgress) handleMessage(msg *Message) error {
 	switch msg.ID {
-	case MsgUnchoke:
-		state.client.Choked = false
 	case MsgChoke:
-		state.client.Choked = true
-	case MsgHave:
-		index, err := GetHaveIndex(&msg)
+		// 不支持快速扩展的peer在choke时丢弃所有未完成的请求
+		if !state.client.supportsFast() && state.piece != nil {
+			state.pieces.release(state.piece, state.client, -1)
+		}
+	case MsgReject:
+		index, begin, _, err := ParseReject(msg)
 		if err != nil {
 			return err
 		}
-		state.client.BitField.SetPiece(index)
+		// 已经从其他peer收到、发送过cancel的块被拒绝是正常的
+		if state.piece == nil || index != state.index || state.pieces.received(state.piece, begin) {
+			return nil
+		}
+		state.pieces.release(state.piece, state.client, begin)
+		return errRequestRejected
 	case MsgPiece:
-		n, err := copyPieceData(state.index, state.buf, &msg)
+		// 块复制到分片中后缓冲区即可重用
+		defer releaseMessage(msg)
+		if len(msg.Payload) < 8 {
+			return errors.New("Piece's payload length illegal")
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		// 之前被放弃的分片仍可能陆续到达，直接忽略
+		if state.piece == nil || index != state.index {
+			return nil
+		}
+		data := msg.Payload[8:]
+		cancel, complete, err := state.pieces.receive(state.piece, state.client, begin, data)
+		if err != nil {
+			return err
+		}
+		state.client.downloaded.Add(int64(len(data)))
+		// endgame时通知其他peer不再需要该块
+		for _, other := range cancel {
+			other.SendCancel(index, begin, len(data))
+		}
+		state.complete = complete
+	}
+	return nil
+}
+
+// 未被choke或者分片允许快速下载时才能发送请求
+func (state *pieceProgress) canRequest() bool {
+	return !state.client.peerChoking() || state.client.isAllowedFast(state.index)
+}
+
+// 可以请求时补足未完成的请求
+func (state *pieceProgress) sendRequests(endgame bool) error {
+	c := state.client
+	if !state.canRequest() {
+		return nil
+	}
+	for n := state.pieces.outstanding(state.piece, c); n < MaxBacklog; n++ {
+		begin, length, ok := state.pieces.request(state.piece, c, endgame)
+		if !ok {
+			break
+		}
+		err := c.SendRequest(state.index, begin, length)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 下载分片的块，直到收齐、分片被其他peer完成，或者没有块可以再向该peer请求。
+// endgame为nil或返回false时不会重复请求已经向其他peer请求过的块
+func (state *pieceProgress) run(endgame func() bool) error {
+	c := state.client
+	tk := time.NewTicker(PickWait)
+	defer tk.Stop()
+	last := time.Now()
+	for !state.complete && !state.piece.finished() {
+		err := state.sendRequests(endgame != nil && endgame())
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		//fmt.Println("get peers pieces ", n)
-		state.backlog--
+		// 剩余的块都在向其他peer请求
+		if state.canRequest() && state.pieces.outstanding(state.piece, c) == 0 {
+			return nil
+		}
+		select {
+		case msg, ok := <-c.events:
+			if !ok {
+				return c.readErr
+			}
+			last = time.Now()
+			err = state.handleMessage(msg)
+			if err != nil {
+				return err
+			}
+		case <-state.piece.done:
+		case <-tk.C:
+			if time.Since(last) > RequestTimeout {
+				return errRequestTimeout
+			}
+		}
 	}
 	return nil
 }
+
 func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
@@ -90,138 +264,314 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-// 与对等实体建立连接，从workQueue中获取需要的工作，然后开始真正的下载工作，最后将结果写入结果队列
-func (t *Torrent) startDownload(ctx context.Context, peer *PeerInfo, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := NewConn(peer, t.InfoSHA, t.PeerID)
+// 与对等实体建立连接，从picker中选取对方拥有的最稀有的分片下载，最后将结果写入结果队列
+func (t *Torrent) startDownload(ctx context.Context, peer *PeerInfo, results chan *pieceResult) {
+	c, err := t.connect(peer)
 	if err != nil {
 		return
 	}
 	fmt.Println("connect successfully")
 	defer c.Conn.Close()
-	c.SendBasicMessage(MsgInterested)
-	c.SendBasicMessage(MsgUnchoke)
+	c.attachPicker(t.picker)
+	defer c.detachPicker()
+	err = t.startExtensions(c)
+	if err != nil {
+		return
+	}
+	defer t.startPex(c, true)()
+	t.choker.add(c)
+	defer t.choker.remove(c)
+	defer t.startReader(c)()
+	t.addConn(c)
+	defer t.removeConn(c)
+	err = c.updateInterest()
+	if err != nil {
+		return
+	}
 
-	for pw := range workQueue {
-		if !c.BitField.HasPiece(pw.index) {
-			workQueue <- pw
+	for ctx.Err() == nil && !t.picker.Complete() {
+		ap := t.nextPiece(c)
+		if ap == nil {
+			// 对方没有还需要的分片，等待其have消息，或者其他peer放弃的分片
+			err = waitForPieces(ctx, c)
+			if err != nil {
+				log.Println("Exiting", err)
+				return
+			}
+			continue
+		}
+		err = t.downloadPiece(ctx, c, ap, results)
+		if errors.Is(err, errRequestRejected) {
 			continue
 		}
-		buf, err := attemptDownloadPiece(c, pw)
 		if err != nil {
 			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
 			return
 		}
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
-			continue
+	}
+}
+
+// 为c选择要下载的分片：优先继续下载还有块未请求的分片，其次按期限和稀有度选择新的分片，
+// 然后是错过期限的分片，剩余的分片都在下载中时进入endgame，向c重复请求其他peer还未返回的块
+func (t *Torrent) nextPiece(c *PeerConn) *activePiece {
+	field := c.requestable()
+	if ap := t.active.join(c, field, false); ap != nil {
+		return ap
+	}
+	if index, ok := t.picker.Pick(field); ok {
+		return t.active.start(&pieceWork{index, t.PieceSHA[index], t.calculatePieceSize(index)})
+	}
+	// 错过期限的分片同时向c请求，不再只等待原来的peer
+	if late := t.picker.Overdue(field, time.Now()); late != nil {
+		if ap := t.active.join(c, late, true); ap != nil {
+			return ap
 		}
-		//fmt.Println("check right")
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
 	}
+	if t.picker.Endgame() {
+		return t.active.join(c, field, true)
+	}
+	return nil
 }
-func attemptDownloadPiece(c *PeerConn, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+
+// 在c上下载分片中的块，由收齐最后一个块的peer校验并提交结果
+func (t *Torrent) downloadPiece(ctx context.Context, c *PeerConn, ap *activePiece, results chan *pieceResult) error {
+	state := newPieceProgress(c, t.active, ap)
+	// endgame时以及分片错过期限后，可以请求已经向其他peer请求过的块
+	err := state.run(func() bool {
+		return t.picker.Endgame() || t.picker.late(ap.pw.index, time.Now())
+	})
+	t.active.leave(ap, c)
+	if !state.complete {
+		return err
 	}
-	err := c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	t.active.finish(ap)
+	err = checkIntegrity(ap.pw, ap.buf)
 	if err != nil {
-		return nil, err
+		log.Printf("Piece #%d failed integrity check\n", ap.pw.index)
+		t.picker.Abort(ap.pw.index) // Put piece back to be picked again
+		return nil
+	}
+	//fmt.Println("check right")
+	// 分片写入存储后再发送have，之后对方的请求可以得到数据
+	t.picker.Done(ap.pw.index)
+	t.advanceWindow()
+	t.updateInterests()
+	select {
+	case results <- &pieceResult{ap.pw.index, ap.buf}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+}
 
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-				err = c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
-		}
+// PickWait is how long to wait for a message before picking pieces, or
+// requesting blocks, again
+const PickWait = time.Second
 
-		err = state.readMessage()
-		if err != nil {
-			return nil, err
+// RequestTimeout is how long a peer may stay silent while a piece is
+// downloaded from it
+const RequestTimeout = 30 * time.Second
+
+var errRequestTimeout = errors.New("peer did not respond to requests in time")
+
+// 空闲时等待对方的状态变化，最多等待PickWait。此时到达的块属于已经放弃的分片，直接丢弃
+func waitForPieces(ctx context.Context, c *PeerConn) error {
+	select {
+	case msg, ok := <-c.events:
+		if !ok {
+			return c.readErr
 		}
+		releaseMessage(msg)
+	case <-time.After(PickWait):
+	case <-ctx.Done():
 	}
-	return state.buf, nil
+	return nil
 }
 
-func (t *Torrent) download(ctx context.Context, tf *TorrentFile) ([]byte, error) {
-	workerQueue := make(chan *pieceWork, len(t.PieceSHA))
-	ResQueue := make(chan *pieceResult, len(t.PieceSHA))
-	for index, hash := range t.PieceSHA {
-		length := t.calculatePieceSize(index)
-		workerQueue <- &pieceWork{index, hash, length}
+// 在已经启动读取协程的连接上单独下载一个分片
+func attemptDownloadPiece(c *PeerConn, pw *pieceWork) ([]byte, error) {
+	pieces := newActivePieces()
+	state := newPieceProgress(c, pieces, pieces.start(pw))
+	err := state.run(nil)
+	if err != nil {
+		return nil, err
 	}
+	return state.piece.buf, nil
+}
 
-	go t.updatePeersConn(ctx, tf, workerQueue, ResQueue)
-
-	buf := make([]byte, t.Length)
+// 下载种子，校验通过的分片立即写入st并标记完成，内存中只保留正在下载和等待写入的分片
+func (t *Torrent) download(ctx context.Context, tf *TorrentFile, st storage.Torrent) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	// 写入跟不上下载时阻塞下载连接，避免分片在内存中堆积
+	ResQueue := make(chan *pieceResult, ReceiveGNums)
+	t.m.Lock()
+	t.picker = NewPiecePicker(len(t.PieceSHA))
+	t.applyPriority()
+	t.applyFilePriorities()
+	// 下载的同时向unchoke的peer上传已经写入存储的分片，返回后存储可能被关闭
+	t.storage = st
+	t.m.Unlock()
+	defer func() {
+		t.m.Lock()
+		t.storage = nil
+		t.m.Unlock()
+	}()
+	t.active = newActivePieces()
+	// 存储中已经完成的分片（例如从恢复文件中读取的）不再下载
 	donePieces := atomic.Int64{}
-	donePieces.Store(0)
+	for index := range t.PieceSHA {
+		if st.Piece(index).Completed() {
+			t.picker.Done(index)
+			t.addPiece(index)
+			donePieces.Add(1)
+		}
+	}
+	t.advanceWindow()
+	if int(donePieces.Load()) >= t.picker.Wanted() {
+		return nil
+	}
+	// 下载时同样接收其他peer的连接，向tracker、DHT和LSD汇报实际监听的端口
+	l, err := t.listen(ctx, net.JoinHostPort("", strconv.Itoa(tf.Port)))
+	if err != nil {
+		return err
+	}
+	log.Println("accepting peers on ", l.Addr())
+
+	t.m.Lock()
+	t.addPeerFn = func(peer *PeerInfo) {
+		t.addPeer(ctx, peer, ResQueue)
+	}
+	t.m.Unlock()
+	for _, peer := range tf.peers {
+		t.addPeer(ctx, peer, ResQueue)
+	}
+	go t.updatePeersConn(ctx, tf, ResQueue)
+	if tf.DHT != nil && !tf.Private {
+		go t.dhtPeers(ctx, tf.DHT)
+	}
+	if tf.LSD != nil && !tf.Private {
+		defer tf.LSD.Watch(t.InfoSHA, t.port, t.lsdPeer)()
+	}
+
 	for i := 0; i < ReceiveGNums; i++ {
 		t.wg.Add(1)
 		go func() {
 			tk := time.NewTicker(time.Second)
 			defer t.wg.Done()
-			for int(donePieces.Load()) < len(t.PieceSHA) {
+			// 跳过的文件中的分片不需要下载
+			for int(donePieces.Load()) < t.picker.Wanted() {
 				select {
 				case res := <-ResQueue:
-					begin, end := t.calculateBoundsForPiece(res.index)
-					copy(buf[begin:end], res.buf)
+					piece := st.Piece(res.index)
+					_, err := piece.WriteAt(res.buf, 0)
+					if err == nil {
+						err = piece.MarkComplete()
+					}
+					if err != nil {
+						cancel(fmt.Errorf("write piece #%d: %w", res.index, err))
+						return
+					}
+					t.addPiece(res.index)
 					donePieces.Add(1)
-					percent := float64(donePieces.Load()) / float64(len(t.PieceSHA)) * 100
+					t.downloaded.Add(int64(len(res.buf)))
+					t.notifyReaders()
+					percent := float64(donePieces.Load()) / float64(t.picker.Wanted()) * 100
 					numWorkers := runtime.NumGoroutine() - 1 - ReceiveGNums // subtract 1 for main thread
 					log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
 				case <-tk.C:
 					continue
 				case <-ctx.Done():
-					break
+					return
 				}
 			}
 		}()
 	}
 	t.wg.Wait()
-	close(ResQueue)
-	close(workerQueue)
-	return buf, nil
+	t.m.Lock()
+	t.addPeerFn = nil
+	t.m.Unlock()
+	if int(donePieces.Load()) < t.picker.Wanted() {
+		return context.Cause(ctx)
+	}
+	return nil
 }
-func (t *Torrent) updatePeersConn(ctx context.Context, tf *TorrentFile, workerQueue chan *pieceWork, ResQueue chan *pieceResult) {
+
+// 与尚未连接过的peer建立下载连接
+func (t *Torrent) addPeer(ctx context.Context, peer *PeerInfo, ResQueue chan *pieceResult) {
+	pi := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
+	t.m.Lock()
+	defer t.m.Unlock()
+	if _, ok := t.bans[peer.Ip.String()]; ok {
+		return
+	}
+	if _, ok := t.mp[pi]; ok {
+		return
+	}
+	t.mp[pi] = struct{}{}
+	t.Peers = append(t.Peers, peer)
+	go t.startDownload(ctx, peer, ResQueue)
+}
+
+func (t *Torrent) updatePeersConn(ctx context.Context, tf *TorrentFile, ResQueue chan *pieceResult) {
+	if len(tf.trackers()) == 0 && len(tf.TracerUrl) == 0 {
+		return
+	}
 	tk := time.NewTicker(15 * time.Second)
+	defer tk.Stop()
 	for {
+		peers, err := tf.getPeers(t.PeerID, t.port)
+		if err != nil {
+			return
+		}
+		for _, peer := range peers {
+			t.addPeer(ctx, peer, ResQueue)
+		}
 		select {
 		case <-tk.C:
-			peers, err := tf.getPeers(t.PeerID)
-			if err != nil {
-				return
-			}
-			for _, peer := range peers {
-				pi := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
-				if _, ok := t.mp[pi]; !ok {
-					t.mp[pi] = struct{}{}
-					t.Peers = append(t.Peers, peer)
-					go t.startDownload(ctx, peer, workerQueue, ResQueue)
-				}
-			}
+		case <-ctx.Done():
+			return
 		}
 	}
 
 }
+
+// 定期在DHT上查找peer，有监听端口时同时announce
+func (t *Torrent) dhtPeers(ctx context.Context, node *dht.Server) {
+	tk := time.NewTicker(DHTInterval)
+	defer tk.Stop()
+	for {
+		var peers []dht.Peer
+		var err error
+		if t.port > 0 {
+			peers, err = node.Announce(ctx, t.InfoSHA, t.port)
+		} else {
+			peers, err = node.GetPeers(ctx, t.InfoSHA)
+		}
+		if err != nil {
+			log.Println("dht:", err)
+		}
+		for _, p := range peers {
+			t.discoverPeer(&PeerInfo{Ip: p.IP, Port: p.Port})
+		}
+		select {
+		case <-tk.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 本地网络上announce了该种子的peer
+func (t *Torrent) lsdPeer(p lsd.Peer) {
+	t.discoverPeer(&PeerInfo{Ip: p.IP, Port: p.Port})
+}
+
+// 不在下载或者已经下载完成时处于做种状态，此时按上传速率选择unchoke的peer
+func (t *Torrent) seeding() bool {
+	return t.picker == nil || t.picker.Complete()
+}
+
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
@@ -0,0 +1,226 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/model"
+	"io"
+	"net"
+)
+
+// ExtHandshakeID is the extended message ID of the extension handshake (BEP 10)
+const ExtHandshakeID = 0
+
+// MaxRequestQueue is the number of outstanding requests we accept from a peer, announced as reqq
+const MaxRequestQueue = 250
+
+// ClientVersion is announced as v in the extension handshake
+const ClientVersion = "torcore"
+
+// ExtHandshake is the payload of the extension handshake. m maps extension
+// names to the message IDs the sender wants to receive them under.
+type ExtHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+}
+
+// Extension is a BEP 10 extension. Handlers run on the goroutine reading
+// the connection, so they should not block on it.
+type Extension interface {
+	// Name is the key of the extension in the m dictionary, e.g. "ut_metadata"
+	Name() string
+	// OnHandshake is called when the peer's extension handshake arrives,
+	// whether or not the peer supports this extension
+	OnHandshake(c *PeerConn, hs *ExtHandshake) error
+	// OnMessage handles a message of this extension sent by the peer
+	OnMessage(c *PeerConn, payload []byte) error
+}
+
+// ExtensionRegistry assigns local message IDs to extensions and dispatches
+// incoming extended messages to them
+type ExtensionRegistry struct {
+	exts   []Extension
+	byName map[string]byte
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{byName: make(map[string]byte)}
+}
+
+// Register adds an extension and returns the message ID we receive it under
+func (r *ExtensionRegistry) Register(ext Extension) (byte, error) {
+	if _, ok := r.byName[ext.Name()]; ok {
+		return 0, fmt.Errorf("extension %s already registered", ext.Name())
+	}
+	if len(r.exts) >= 255 {
+		return 0, errors.New("too many extensions")
+	}
+	r.exts = append(r.exts, ext)
+	id := byte(len(r.exts))
+	r.byName[ext.Name()] = id
+	return id, nil
+}
+
+// ID is the local message ID of the named extension, 0 when not registered
+func (r *ExtensionRegistry) ID(name string) byte {
+	if r == nil {
+		return 0
+	}
+	return r.byName[name]
+}
+
+// m字典，声明本地支持的扩展
+func (r *ExtensionRegistry) m() map[string]int {
+	m := make(map[string]int, len(r.exts))
+	for i, ext := range r.exts {
+		m[ext.Name()] = i + 1
+	}
+	return m
+}
+
+// MsgExtended
+func NewExtendedMessage(extID byte, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// 将v编码为bencode后附加在扩展消息ID之后
+func newBencodedExtendedMessage(extID byte, v interface{}, tail []byte) *Message {
+	var buf bytes.Buffer
+	buf.WriteByte(extID)
+	model.MarshalBen(&buf, v)
+	buf.Write(tail)
+	return &Message{ID: MsgExtended, Payload: buf.Bytes()}
+}
+
+// 解析扩展消息中的bencode字典，返回字典之后剩余的数据
+func parseBencodedPayload(payload []byte, v interface{}) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(payload))
+	err := model.UnmarshalBen(br, v)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(br)
+}
+
+// 以紧凑格式编码的对方IP，IPv4为4字节，IPv6为16字节
+func compactIP(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if ip4 := tcp.IP.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(tcp.IP.To16())
+}
+
+// 对方是否支持扩展协议
+func (c *PeerConn) supportsExtensions() bool {
+	return c.reserved[extensionByte]&extensionBit != 0
+}
+
+// PeerExtensions is the extension handshake the peer sent, nil before it arrives
+func (c *PeerConn) PeerExtensions() *ExtHandshake {
+	return c.peerExt
+}
+
+// 发送扩展握手，m字典由连接上的扩展注册表给出
+func (c *PeerConn) sendExtHandshake(hs ExtHandshake) error {
+	if c.registry != nil {
+		hs.M = c.registry.m()
+	}
+	if hs.M == nil {
+		hs.M = make(map[string]int)
+	}
+	hs.V = ClientVersion
+	hs.Reqq = MaxRequestQueue
+	hs.YourIP = compactIP(c.RemoteAddr())
+	_, err := c.WriteMessage(newBencodedExtendedMessage(ExtHandshakeID, hs, nil))
+	return err
+}
+
+// SendExtended sends a message of the named extension under the ID the peer assigned to it
+func (c *PeerConn) SendExtended(name string, payload []byte) error {
+	id := c.extensionID(name)
+	if id == 0 {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	_, err := c.WriteMessage(NewExtendedMessage(id, payload))
+	return err
+}
+
+// 对方为name扩展分配的消息ID，0表示不支持
+func (c *PeerConn) extensionID(name string) byte {
+	if c.peerExt == nil {
+		return 0
+	}
+	id, ok := c.peerExt.M[name]
+	if !ok || id <= 0 || id > 255 {
+		return 0
+	}
+	return byte(id)
+}
+
+// 处理收到的扩展消息，扩展握手通知所有扩展，其余消息按本地ID分发
+func (c *PeerConn) handleExtended(payload []byte) error {
+	if len(payload) < 1 {
+		return errors.New("extended message too short")
+	}
+	if payload[0] == ExtHandshakeID {
+		hs := new(ExtHandshake)
+		_, err := parseBencodedPayload(payload[1:], hs)
+		if err != nil {
+			return err
+		}
+		if hs.M == nil {
+			hs.M = make(map[string]int)
+		}
+		c.peerExt = hs
+		if c.registry == nil {
+			return nil
+		}
+		for _, ext := range c.registry.exts {
+			err = ext.OnHandshake(c, hs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if c.registry == nil || int(payload[0]) > len(c.registry.exts) {
+		return nil
+	}
+	return c.registry.exts[payload[0]-1].OnMessage(c, payload[1:])
+}
+
+// 注册种子文件中由使用者提供的扩展，内置扩展在newTorrent中注册
+func (t *Torrent) registerExtensions(exts []Extension) error {
+	for _, ext := range exts {
+		_, err := t.extensions.Register(ext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 建立连接后交换扩展握手
+func (t *Torrent) startExtensions(c *PeerConn) error {
+	c.registry = t.extensions
+	if !c.supportsExtensions() {
+		return nil
+	}
+	return c.sendExtHandshake(ExtHandshake{
+		MetadataSize: len(t.infoBytes),
+		P:            t.port,
+	})
+}
@@ -0,0 +1,108 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// 收到消息后原样加上前缀回复，并记录收到的握手和消息
+type echoExtension struct {
+	handshakes chan *ExtHandshake
+	received   chan string
+}
+
+func (e *echoExtension) Name() string {
+	return "x_echo"
+}
+
+func (e *echoExtension) OnHandshake(c *PeerConn, hs *ExtHandshake) error {
+	if e.handshakes != nil {
+		e.handshakes <- hs
+	}
+	return nil
+}
+
+func (e *echoExtension) OnMessage(c *PeerConn, payload []byte) error {
+	if e.received != nil {
+		e.received <- string(payload)
+		return nil
+	}
+	return c.SendExtended(e.Name(), append([]byte("echo:"), payload...))
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	r := NewExtensionRegistry()
+	id, err := r.Register(&metadataExtension{})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), id)
+	id, err = r.Register(&echoExtension{})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), id)
+	_, err = r.Register(&echoExtension{})
+	assert.Error(t, err)
+	assert.Equal(t, map[string]int{UtMetadata: 1, "x_echo": 2}, r.m())
+	assert.Equal(t, byte(2), r.ID("x_echo"))
+	assert.Equal(t, byte(0), r.ID("ut_pex"))
+}
+
+func TestExtensionHandshakeAndMessages(t *testing.T) {
+	tf, data := newTestMetaInfo(t, MaxBlockSize, 4*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	assert.NoError(t, seeder.verifyPieces())
+	assert.NoError(t, seeder.registerExtensions([]Extension{&echoExtension{}}))
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	ext := &echoExtension{handshakes: make(chan *ExtHandshake, 1), received: make(chan string, 1)}
+	assert.NoError(t, leecher.registerExtensions([]Extension{ext}))
+	c, err := NewConn(peerFromAddr(t, l.Addr().String()), tf.InfoSHA, leecher.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.True(t, c.supportsExtensions())
+	assert.NoError(t, leecher.startExtensions(c))
+
+	go func() {
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.ID == MsgExtended {
+				c.handleExtended(msg.Payload)
+			}
+		}
+	}()
+	var hs *ExtHandshake
+	select {
+	case hs = <-ext.handshakes:
+	case <-ctx.Done():
+		t.Fatal("no extension handshake received")
+	}
+	assert.Equal(t, ClientVersion, hs.V)
+	assert.Equal(t, MaxRequestQueue, hs.Reqq)
+	assert.Equal(t, l.Addr().(*net.TCPAddr).Port, hs.P)
+	assert.Equal(t, len(tf.infoBytes), hs.MetadataSize)
+	assert.Equal(t, string(net.IPv4(127, 0, 0, 1).To4()), hs.YourIP)
+	assert.Equal(t, int(seeder.extensions.ID("x_echo")), hs.M["x_echo"])
+
+	assert.NoError(t, c.SendExtended("x_echo", []byte("hello")))
+	select {
+	case got := <-ext.received:
+		assert.Equal(t, "echo:hello", got)
+	case <-ctx.Done():
+		t.Fatal("no echo received")
+	}
+	assert.Error(t, c.SendExtended("lt_donthave", nil))
+}
@@ -0,0 +1,127 @@
+package net
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+)
+
+// AllowedFastCount is the number of pieces a choked peer may still request from us
+const AllowedFastCount = 10
+
+// MaxAllowedFast bounds the number of allowed fast pieces remembered per peer
+const MaxAllowedFast = 32
+
+// 对方拒绝了当前分片的请求，应换一个分片继续
+var errRequestRejected = errors.New("request rejected by peer")
+
+// AllowedFastSet generates the canonical allowed fast set of k pieces for a
+// peer with the given IPv4 address (BEP 6). It is nil for IPv6 peers.
+func AllowedFastSet(ip net.IP, infoHash [SHALEN]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+	x := make([]byte, 0, IpLen+SHALEN)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	set := make([]int, 0, k)
+	seen := make(map[int]struct{}, k)
+	for len(set) < k {
+		y := sha1.Sum(x)
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(y[i*4:]) % uint32(numPieces))
+			if _, ok := seen[index]; !ok {
+				seen[index] = struct{}{}
+				set = append(set, index)
+			}
+		}
+		x = y[:]
+	}
+	return set
+}
+
+// 创建前pieces位全部置1的位图
+func fullBitfield(pieces int) Bitfield {
+	field := NewBitfield(pieces)
+	for i := 0; i < pieces; i++ {
+		field.SetPiece(i)
+	}
+	return field
+}
+
+// 对方是否支持快速扩展
+func (c *PeerConn) supportsFast() bool {
+	return c.reserved[fastByte]&fastBit != 0
+}
+
+// HasPiece reports whether the peer has the piece, including after a HaveAll
+func (c *PeerConn) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.haveAll || c.BitField.HasPiece(index)
+}
+
+// 被对方choke时是否仍然可以请求该分片
+func (c *PeerConn) isAllowedFast(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.allowedFast[index]
+	return ok
+}
+
+// 当前可以向对方请求的分片：未被choke时为对方拥有的所有分片，否则只有允许快速下载的分片
+func (c *PeerConn) requestable() Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.Choked {
+		return slices.Clone(c.BitField)
+	}
+	field := NewBitfield(len(c.BitField) * 8)
+	for index := range c.allowedFast {
+		if c.haveAll || c.BitField.HasPiece(index) {
+			field.SetPiece(index)
+		}
+	}
+	return field
+}
+
+// 记录对方允许快速下载的分片，忽略超出种子的分片以及超过MaxAllowedFast个的分片
+func (c *PeerConn) handleFastMessage(msg *Message) error {
+	index, err := GetAllowedFastIndex(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (c.numPieces > 0 && index >= c.numPieces) || len(c.allowedFast) >= MaxAllowedFast {
+		return nil
+	}
+	if c.allowedFast == nil {
+		c.allowedFast = make(map[int]struct{})
+	}
+	c.allowedFast[index] = struct{}{}
+	return nil
+}
+
+// 向支持快速扩展的peer发送允许其在被choke时请求的分片
+func (t *Torrent) grantAllowedFast(c *PeerConn) error {
+	if !c.supportsFast() || c.peer == nil {
+		return nil
+	}
+	c.grantedFast = make(map[int]struct{})
+	for _, index := range AllowedFastSet(c.peer.Ip, t.InfoSHA, len(t.PieceSHA), AllowedFastCount) {
+		if !t.hasPiece(index) {
+			continue
+		}
+		c.grantedFast[index] = struct{}{}
+		_, err := c.WriteMessage(NewAllowedFastMessage(index))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// BEP 6 中给出的示例
+	var infoHash [SHALEN]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	ip := net.ParseIP("80.4.4.200")
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, AllowedFastSet(ip, infoHash, 1313, 7))
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, AllowedFastSet(ip, infoHash, 1313, 9))
+	assert.Len(t, AllowedFastSet(ip, infoHash, 3, 10), 3)
+	assert.Nil(t, AllowedFastSet(net.ParseIP("::1"), infoHash, 1313, 7))
+}
+
+func TestFastMessages(t *testing.T) {
+	index, err := GetAllowedFastIndex(NewAllowedFastMessage(42))
+	assert.NoError(t, err)
+	assert.Equal(t, 42, index)
+	index, err = GetSuggestIndex(NewSuggestMessage(7))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, index)
+	_, err = GetSuggestIndex(NewAllowedFastMessage(7))
+	assert.Error(t, err)
+
+	index, begin, length, err := ParseReject(NewRejectMessage(3, MaxBlockSize, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, MaxBlockSize, 100}, []int{index, begin, length})
+	assert.Equal(t, "HaveAll [0]", NewHaveAllMessage().String())
+	assert.Equal(t, "HaveNone [0]", NewHaveNoneMessage().String())
+}
+
+// 被choke的peer只能下载allowed fast分片，其余请求会立即被拒绝
+func TestAllowedFastWhileChoked(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 64*MaxBlockSize)
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	assert.NoError(t, seeder.verifyPieces())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	c, err := leecher.connect(peerFromAddr(t, l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.True(t, c.supportsFast())
+	assert.True(t, c.haveAll)
+	assert.True(t, c.BitField.Equal(fullBitfield(len(tf.PieceSHA))))
+	defer leecher.startReader(c)()
+
+	allowed := AllowedFastSet(net.ParseIP("127.0.0.1"), tf.InfoSHA, len(tf.PieceSHA), AllowedFastCount)
+	for _, index := range allowed {
+		pw := &pieceWork{index, tf.PieceSHA[index], MaxBlockSize}
+		buf, err := attemptDownloadPiece(c, pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, checkIntegrity(pw, buf))
+	}
+	assert.True(t, c.peerChoking())
+	c.mu.Lock()
+	assert.Len(t, c.allowedFast, AllowedFastCount)
+	c.mu.Unlock()
+
+	rejected := 0
+	for rejected == 0 || c.isAllowedFast(rejected) {
+		rejected++
+	}
+	assert.NoError(t, c.SendRequest(rejected, 0, MaxBlockSize))
+	pieces := newActivePieces()
+	state := newPieceProgress(c, pieces, pieces.start(&pieceWork{rejected, tf.PieceSHA[rejected], MaxBlockSize}))
+	start := time.Now()
+	assert.ErrorIs(t, state.run(nil), errRequestRejected)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// 超出种子的分片和超过MaxAllowedFast个的allowed fast消息被忽略
+func TestAllowedFastBounded(t *testing.T) {
+	c := &PeerConn{numPieces: 100}
+	assert.NoError(t, c.handleFastMessage(NewAllowedFastMessage(100)))
+	assert.NoError(t, c.handleFastMessage(NewAllowedFastMessage(1<<31)))
+	assert.False(t, c.isAllowedFast(100))
+	for index := 0; index < 100; index++ {
+		assert.NoError(t, c.handleFastMessage(NewAllowedFastMessage(index)))
+	}
+	assert.Len(t, c.allowedFast, MaxAllowedFast)
+	assert.True(t, c.isAllowedFast(MaxAllowedFast-1))
+	assert.False(t, c.isAllowedFast(MaxAllowedFast))
+}
@@ -0,0 +1,87 @@
+package net
+
+import (
+	"fmt"
+	"strings"
+)
+
+// File is one file of a torrent
+type File struct {
+	// Path is relative to the torrent, parts separated by '/'
+	Path string
+	// Offset is where the file starts in the content of the torrent
+	Offset   int64
+	Length   int64
+	Priority Priority
+}
+
+// 种子中的文件，单文件种子只有一个以种子名命名的文件
+func (t *Torrent) fileList() []File {
+	info := t.tf.info()
+	if len(info.Files) == 0 {
+		return []File{{Path: info.Name, Length: int64(info.Length)}}
+	}
+	files := make([]File, len(info.Files))
+	var offset int64
+	for i, f := range info.Files {
+		files[i] = File{Path: strings.Join(f.Path, "/"), Offset: offset, Length: int64(f.Length)}
+		offset += int64(f.Length)
+	}
+	return files
+}
+
+// Files returns the files of the torrent in order with their priorities. A
+// single-file torrent has one file named after the torrent.
+func (t *Torrent) Files() []File {
+	files := t.fileList()
+	t.m.Lock()
+	defer t.m.Unlock()
+	for i := range files {
+		files[i].Priority = t.filePriority[i]
+	}
+	return files
+}
+
+// SetFilePriority sets the priority of the file at index, it may be called
+// before or while downloading. Pieces wholly inside skipped files are not
+// downloaded, a piece takes the highest priority of the files it covers.
+func (t *Torrent) SetFilePriority(index int, priority Priority) error {
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+	t.m.Lock()
+	if index < 0 || index >= len(t.filePriority) {
+		t.m.Unlock()
+		return fmt.Errorf("no file #%d in torrent", index)
+	}
+	t.filePriority[index] = priority
+	t.applyFilePriorities()
+	t.m.Unlock()
+	// 跳过或恢复文件后，对各个peer的兴趣可能变化
+	t.updateInterests()
+	return nil
+}
+
+// 按文件的优先级设置picker中分片的优先级，调用时持有t.m
+func (t *Torrent) applyFilePriorities() {
+	if t.picker == nil || t.PieceLength <= 0 {
+		return
+	}
+	pieces := make([]Priority, len(t.PieceSHA))
+	for i := range pieces {
+		pieces[i] = PrioritySkip
+	}
+	for i, f := range t.fileList() {
+		if f.Length == 0 {
+			continue
+		}
+		first := int(f.Offset / int64(t.PieceLength))
+		last := int((f.Offset + f.Length - 1) / int64(t.PieceLength))
+		for index := first; index <= last && index < len(pieces); index++ {
+			pieces[index] = max(pieces[index], t.filePriority[i])
+		}
+	}
+	for index, priority := range pieces {
+		t.picker.SetPriority(index, priority)
+	}
+}
@@ -0,0 +1,107 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 跳过的分片不会选出也不影响完成，优先级高的分片先于稀有的分片选出
+func TestPiecePickerPriorities(t *testing.T) {
+	p := NewPiecePicker(4)
+	all := fullBitfield(4)
+	p.AddPeer(all)
+	p.AddPeer(bitfieldOf(4, 0, 1, 2))
+	p.SetPriority(3, PrioritySkip)
+	p.SetPriority(0, PriorityHigh)
+	p.SetPriority(2, PriorityLow)
+	assert.Equal(t, 3, p.Wanted())
+	assert.False(t, p.Interesting(bitfieldOf(4, 3)))
+
+	var order []int
+	for {
+		index, ok := p.Pick(all)
+		if !ok {
+			break
+		}
+		order = append(order, index)
+	}
+	assert.Equal(t, []int{0, 1, 2}, order)
+	assert.True(t, p.Endgame())
+	for _, index := range order {
+		p.Done(index)
+	}
+	assert.True(t, p.Complete())
+	assert.False(t, p.Endgame())
+
+	// 有期限时跳过的分片也会下载
+	p.SetDeadline(3, time.Now())
+	assert.True(t, p.Interesting(all))
+	index, ok := p.Pick(all)
+	assert.True(t, ok)
+	assert.Equal(t, 3, index)
+	assert.False(t, p.Complete())
+	p.Done(3)
+	assert.True(t, p.Complete())
+	assert.Equal(t, 4, p.Wanted())
+}
+
+// 跳过的文件所在的分片不下载，也不创建该文件
+func TestDownloadSkipsFiles(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 5*MaxBlockSize+5)
+	tf.files = []metainfo.FileInfo{
+		{Length: 2 * MaxBlockSize, Path: []string{"a"}},
+		{Length: 2 * MaxBlockSize, Path: []string{"skip", "b.nfo"}},
+		{Length: MaxBlockSize + 5, Path: []string{"c"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	tr, err := tf.NewTorrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, tr.SetFilePriority(3, PrioritySkip))
+	assert.NoError(t, tr.SetFilePriority(1, PrioritySkip))
+	assert.NoError(t, tr.SetFilePriority(2, PriorityHigh))
+	assert.Equal(t, []File{
+		{Path: "a", Length: 2 * MaxBlockSize, Priority: PriorityNormal},
+		{Path: "skip/b.nfo", Offset: 2 * MaxBlockSize, Length: 2 * MaxBlockSize, Priority: PrioritySkip},
+		{Path: "c", Offset: 4 * MaxBlockSize, Length: MaxBlockSize + 5, Priority: PriorityHigh},
+	}, tr.Files())
+
+	dir := t.TempDir()
+	assert.NoError(t, tr.Download(ctx, dir))
+	a, err := os.ReadFile(filepath.Join(dir, tf.FileName, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, data[:2*MaxBlockSize], a)
+	c, err := os.ReadFile(filepath.Join(dir, tf.FileName, "c"))
+	assert.NoError(t, err)
+	assert.Equal(t, data[4*MaxBlockSize:], c)
+	_, err = os.Stat(filepath.Join(dir, tf.FileName, "skip", "b.nfo"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// magnet链接的so参数列出的文件之外的文件被跳过
+func TestSelectSkipsFiles(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 5*MaxBlockSize)
+	tf.files = []metainfo.FileInfo{
+		{Length: 2 * MaxBlockSize, Path: []string{"a"}},
+		{Length: 2 * MaxBlockSize, Path: []string{"b"}},
+		{Length: MaxBlockSize, Path: []string{"c"}},
+	}
+	tf.Select = []int{0, 2, 7}
+	tr, err := tf.NewTorrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var priorities []Priority
+	for _, f := range tr.Files() {
+		priorities = append(priorities, f.Priority)
+	}
+	assert.Equal(t, []Priority{PriorityNormal, PrioritySkip, PriorityNormal}, priorities)
+}
@@ -0,0 +1,101 @@
+package net
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler serves the files of a torrent over HTTP while it downloads. Each
+// file is at its path in the torrent, "/" lists them. Range requests read
+// only the pieces they cover, which are downloaded before the others.
+type Handler struct {
+	t     *Torrent
+	files []File
+	paths map[string]int
+
+	closeOnce sync.Once
+}
+
+// NewHandler serves the files of t. It keeps the downloaded data readable
+// after Download returns, until the Handler is closed.
+func NewHandler(t *Torrent) (*Handler, error) {
+	err := t.retain()
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{t: t, files: t.fileList(), paths: make(map[string]int)}
+	for i, f := range h.files {
+		h.paths["/"+f.Path] = i
+	}
+	return h, nil
+}
+
+// Close stops keeping the data readable, requests in progress may fail
+func (h *Handler) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		err = h.t.release()
+	})
+	return err
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.URL.Path == "/" {
+		h.serveIndex(w)
+		return
+	}
+	index, ok := h.paths[req.URL.Path]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	r, err := h.t.NewReader(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer r.Close()
+	// 客户端断开时结束等待数据的读取
+	stop := context.AfterFunc(req.Context(), func() { r.Close() })
+	defer stop()
+
+	// 种子的内容由info hash确定，不会变化
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(h.t.InfoSHA[:]), index))
+	contentType := mime.TypeByExtension(path.Ext(r.Name()))
+	if contentType == "" {
+		// 不让ServeContent读取开头的数据来猜测类型
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, req, r.Name(), time.Time{}, r)
+}
+
+// 列出所有文件的链接
+func (h *Handler) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<title>%s</title>\n<ul>\n", html.EscapeString(h.t.Name))
+	for _, f := range h.files {
+		parts := strings.Split(f.Path, "/")
+		for i, part := range parts {
+			parts[i] = url.PathEscape(part)
+		}
+		fmt.Fprintf(&b, "<li><a href=\"/%s\">%s</a> %d bytes</li>\n", strings.Join(parts, "/"), html.EscapeString(f.Path), f.Length)
+	}
+	b.WriteString("</ul>\n")
+	fmt.Fprint(w, b.String())
+}
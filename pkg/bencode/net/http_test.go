@@ -0,0 +1,105 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp, body
+}
+
+// 边下载边通过HTTP读取文件，支持Range和ETag
+func TestHandlerServesFiles(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 5*MaxBlockSize)
+	tf.files = []metainfo.FileInfo{
+		{Length: MaxBlockSize + 10, Path: []string{"poster.png"}},
+		{Length: 4*MaxBlockSize - 10, Path: []string{"extras", "notes v1.bin"}},
+	}
+	tf.Storage = storage.NewMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	tr, err := tf.NewTorrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	done := make(chan error, 1)
+	go func() { done <- tr.Download(ctx, t.TempDir()) }()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/extras/notes%20v1.bin", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	resp, body := get(t, req)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 100-199/"+strconv.Itoa(4*MaxBlockSize-10), resp.Header.Get("Content-Range"))
+	assert.Equal(t, "100", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, data[MaxBlockSize+10+100:MaxBlockSize+10+200], body)
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/poster.png", nil)
+	resp, body = get(t, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, data[:MaxBlockSize+10], body)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/poster.png", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, _ = get(t, req)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodHead, srv.URL+"/poster.png", nil)
+	resp, body = get(t, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(MaxBlockSize+10), resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	// 下载结束后仍然可以读取
+	assert.NoError(t, <-done)
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/extras/notes%20v1.bin", nil)
+	req.Header.Set("Range", "bytes=-5")
+	resp, body = get(t, req)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, data[len(data)-5:], body)
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	resp, body = get(t, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body), `href="/extras/notes%20v1.bin"`))
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/missing", nil)
+	resp, _ = get(t, req)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/poster.png", nil)
+	resp, _ = get(t, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	assert.NoError(t, h.Close())
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/poster.png", nil)
+	resp, _ = get(t, req)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
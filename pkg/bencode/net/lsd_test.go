@@ -0,0 +1,208 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/lsd"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 只接收注入报文的本地发现传输层
+type injectTransport struct {
+	in   chan []byte
+	from net.Addr
+	done chan struct{}
+}
+
+func (it *injectTransport) Host() string      { return lsd.IPv4Group }
+func (it *injectTransport) Send([]byte) error { return nil }
+func (it *injectTransport) Close() error      { close(it.done); return nil }
+
+func (it *injectTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-it.in:
+		return copy(b, p), it.from, nil
+	case <-it.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// 没有tracker和已知peer时通过本地网络上的announce找到做种方
+func TestDownloadFromLSDPeers(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 8*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	seeder := peerFromAddr(t, startTestSeeder(t, ctx, tf, data))
+
+	tr := &injectTransport{
+		in:   make(chan []byte, 1),
+		from: &net.UDPAddr{IP: seeder.Ip, Port: 6771},
+		done: make(chan struct{}),
+	}
+	svc, err := lsd.New(lsd.Config{Transports: []lsd.Transport{tr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	a := &lsd.Announce{Host: lsd.IPv4Group, Port: int(seeder.Port), InfoHashes: [][20]byte{tf.InfoSHA}}
+	// 做种方定期announce，下载开始前收到的报文会被忽略
+	go func() {
+		for ctx.Err() == nil {
+			select {
+			case tr.in <- a.Marshal():
+			default:
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	tf.LSD = svc
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+	assert.Len(t, leecher.Peers, 1)
+}
+
+// 把每个成员发送的报文交给其他成员，相当于同一个本地网络上的多播组
+type lsdBus struct {
+	mu      sync.Mutex
+	members []*busTransport
+}
+
+type busTransport struct {
+	*injectTransport
+	bus *lsdBus
+}
+
+func (b *lsdBus) join() *busTransport {
+	bt := &busTransport{
+		injectTransport: &injectTransport{
+			in:   make(chan []byte, 16),
+			from: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6771},
+			done: make(chan struct{}),
+		},
+		bus: b,
+	}
+	b.mu.Lock()
+	b.members = append(b.members, bt)
+	b.mu.Unlock()
+	return bt
+}
+
+func (bt *busTransport) Send(p []byte) error {
+	bt.bus.mu.Lock()
+	defer bt.bus.mu.Unlock()
+	for _, m := range bt.bus.members {
+		if m == bt {
+			continue
+		}
+		select {
+		case m.in <- p:
+		default:
+		}
+	}
+	return nil
+}
+
+// 分片标记完成后调用written的存储
+type notifyStorage struct {
+	storage.Torrent
+	written func()
+}
+
+type notifyPiece struct {
+	storage.Piece
+	written func()
+}
+
+func (s *notifyStorage) Piece(index int) storage.Piece {
+	return &notifyPiece{Piece: s.Torrent.Piece(index), written: s.written}
+}
+
+func (p *notifyPiece) MarkComplete() error {
+	err := p.Piece.MarkComplete()
+	if err == nil {
+		p.written()
+	}
+	return err
+}
+
+// 两个各有一半分片的下载方只通过本地网络上的announce找到对方，互相下载缺少的分片
+func TestLeechersFindEachOtherOverLSD(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 8*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	half := len(tf.PieceSHA) / 2
+	var total atomic.Int32
+	allWritten := make(chan struct{})
+	bus := new(lsdBus)
+
+	leechers := make([]*Torrent, 2)
+	stores := make([]storage.Torrent, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range leechers {
+		svc, err := lsd.New(lsd.Config{Transports: []lsd.Transport{bus.join()}, Interval: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer svc.Close()
+		ltf := *tf
+		ltf.LSD = svc
+		st, err := storage.NewMemory().OpenTorrent(ltf.info(), ltf.InfoSHA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 第一个下载方有前一半分片，第二个有后一半
+		for index := i * half; index < (i+1)*half; index++ {
+			piece := st.Piece(index)
+			_, err = piece.WriteAt(data[index*tf.PieceLen:(index+1)*tf.PieceLen], 0)
+			assert.NoError(t, err)
+			assert.NoError(t, piece.MarkComplete())
+		}
+		var mine atomic.Int32
+		written := func() {
+			if total.Add(1) == int32(len(tf.PieceSHA)) {
+				close(allWritten)
+			}
+			// 写完缺少的分片后下载结束并停止上传，先等对方也写完
+			if mine.Add(1) == int32(half) {
+				select {
+				case <-allWritten:
+				case <-ctx.Done():
+				}
+			}
+		}
+		stores[i] = st
+		leechers[i] = newTorrent(&ltf, util.GeneratePeerID("leecher"))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = leechers[i].download(ctx, &ltf, &notifyStorage{Torrent: st, written: written})
+		}()
+	}
+	wg.Wait()
+
+	for i, st := range stores {
+		if !assert.NoError(t, errs[i]) {
+			continue
+		}
+		buf := make([]byte, len(data))
+		for index := range tf.PieceSHA {
+			assert.True(t, st.Piece(index).Completed())
+			_, err := st.Piece(index).ReadAt(buf[index*tf.PieceLen:(index+1)*tf.PieceLen], 0)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, data, buf)
+		assert.Len(t, leechers[i].Peers, 1)
+	}
+}
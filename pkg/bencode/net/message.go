@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -31,6 +32,18 @@ const (
 	MsgPiece MsgID = 7
 	// MsgCancel cancels a request
 	MsgCancel MsgID = 8
+	// MsgSuggest suggests a piece to download (BEP 6)
+	MsgSuggest MsgID = 13
+	// MsgHaveAll replaces a bitfield with every bit set (BEP 6)
+	MsgHaveAll MsgID = 14
+	// MsgHaveNone replaces a bitfield with no bit set (BEP 6)
+	MsgHaveNone MsgID = 15
+	// MsgReject tells the receiver a request will not be served (BEP 6)
+	MsgReject MsgID = 16
+	// MsgAllowedFast lets the receiver request a piece while choked (BEP 6)
+	MsgAllowedFast MsgID = 17
+	// MsgExtended carries an extension protocol message (BEP 10)
+	MsgExtended MsgID = 20
 )
 
 func (m *Message) name() string {
@@ -56,13 +69,26 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
 }
 func (m *Message) Serialize() []byte {
+	// keep-alive只有长度为0的前缀
 	if m == nil {
-		return make([]byte, 0)
+		return make([]byte, 4)
 	}
 	length := len(m.Payload) + 1
 	buf := make([]byte, length+4)
@@ -94,8 +120,22 @@ type Message struct {
 
 // 对于have类型的peer消息，类型为PHave，而且payload固定为四字节
 func GetHaveIndex(msg *Message) (int, error) {
-	if msg.ID != MsgHave || len(msg.Payload) != 4 {
-		return -1, errors.New("wrong form of HAVE peer message ")
+	return getIndex(msg, MsgHave)
+}
+
+// suggest消息的payload与have相同，为四字节的分片序号
+func GetSuggestIndex(msg *Message) (int, error) {
+	return getIndex(msg, MsgSuggest)
+}
+
+// allowed fast消息的payload与have相同，为四字节的分片序号
+func GetAllowedFastIndex(msg *Message) (int, error) {
+	return getIndex(msg, MsgAllowedFast)
+}
+
+func getIndex(msg *Message, id MsgID) (int, error) {
+	if msg.ID != id || len(msg.Payload) != 4 {
+		return -1, fmt.Errorf("wrong form of %s peer message ", strings.ToUpper(NewMessage(id).name()))
 	}
 	index := binary.BigEndian.Uint32(msg.Payload)
 	return int(index), nil
@@ -133,49 +173,166 @@ func NewRequestMessage(index, offset, length int) Message {
 	return Message{MsgRequest, buf}
 }
 
-// 对等实体之间握手建立连接
-func handShake(conn net.Conn, infoSha [SHALEN]byte, peerID [IDLEN]byte) error {
+// MsgCancel
+func NewCancelMessage(index, begin, length int) *Message {
+	return newBlockMessage(MsgCancel, index, begin, length)
+}
+
+// MsgPiece
+func NewPieceMessage(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// MsgBitfield
+func NewBitfieldMessage(field Bitfield) *Message {
+	return &Message{ID: MsgBitfield, Payload: field}
+}
+
+// 对于request类型的peer消息，payload固定为十二字节：index, begin, length
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(msg, MsgRequest)
+}
+
+// cancel消息的payload与request相同
+func ParseCancel(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(msg, MsgCancel)
+}
+
+// reject消息的payload与request相同
+func ParseReject(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(msg, MsgReject)
+}
+
+func parseBlock(msg *Message, id MsgID) (index, begin, length int, err error) {
+	if msg.ID != id || len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("wrong form of %s peer message ", strings.ToUpper(NewMessage(id).name()))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+func newIndexMessage(id MsgID, index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: id, Payload: payload}
+}
+
+func newBlockMessage(id MsgID, index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: id, Payload: payload}
+}
+
+// MsgSuggest
+func NewSuggestMessage(index int) *Message {
+	return newIndexMessage(MsgSuggest, index)
+}
+
+// MsgHaveAll
+func NewHaveAllMessage() *Message {
+	return &Message{ID: MsgHaveAll}
+}
+
+// MsgHaveNone
+func NewHaveNoneMessage() *Message {
+	return &Message{ID: MsgHaveNone}
+}
+
+// MsgReject
+func NewRejectMessage(index, begin, length int) *Message {
+	return newBlockMessage(MsgReject, index, begin, length)
+}
+
+// MsgAllowedFast
+func NewAllowedFastMessage(index int) *Message {
+	return newIndexMessage(MsgAllowedFast, index)
+}
+
+// 对等实体之间握手建立连接，返回对方的握手报文
+func handShake(conn net.Conn, infoSha [SHALEN]byte, peerID [IDLEN]byte) (handShakeMsg, error) {
 	err := conn.SetDeadline(time.Now().Add(3 * time.Second))
 	if err != nil {
-		return err
+		return handShakeMsg{}, err
 	}
 	defer conn.SetDeadline(time.Time{})
 	req := newHandShakeMsg(infoSha, peerID)
 	_, err = writeHandShake(conn, req)
 	if err != nil {
-		return err
+		return handShakeMsg{}, err
 	}
 	res, err := readHandShake(conn)
 	if err != nil {
-		return err
+		return handShakeMsg{}, err
 	}
 	if !bytes.Equal(req.infoSha[:], res.infoSha[:]) {
-		return errors.New("invalid info_sha")
+		return handShakeMsg{}, errors.New("invalid info_sha")
 	}
-	return nil
+	return res, nil
+}
+
+// 被动握手：先读取对方的握手报文，校验info_sha后再回复
+func acceptHandShake(conn net.Conn, infoSha [SHALEN]byte, peerID [IDLEN]byte) (handShakeMsg, error) {
+	err := conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err != nil {
+		return handShakeMsg{}, err
+	}
+	defer conn.SetDeadline(time.Time{})
+	res, err := readHandShake(conn)
+	if err != nil {
+		return handShakeMsg{}, err
+	}
+	if !bytes.Equal(infoSha[:], res.infoSha[:]) {
+		return handShakeMsg{}, errors.New("invalid info_sha")
+	}
+	_, err = writeHandShake(conn, newHandShakeMsg(infoSha, peerID))
+	if err != nil {
+		return handShakeMsg{}, err
+	}
+	return res, nil
 }
 
 // 握手报文
 type handShakeMsg struct {
-	PreMsg  string
-	infoSha [SHALEN]byte
-	peerID  [IDLEN]byte
+	PreMsg   string
+	reserved [ReservedLen]byte
+	infoSha  [SHALEN]byte
+	peerID   [IDLEN]byte
 }
 
-// 新建握手报文信息
+// 保留字节中表示支持扩展协议(BEP 10)和快速扩展(BEP 6)的位
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+	fastByte      = 7
+	fastBit       = 0x04
+)
+
+// 新建握手报文信息，默认声明支持扩展协议和快速扩展
 func newHandShakeMsg(infoSha [SHALEN]byte, peerID [IDLEN]byte) handShakeMsg {
-	return handShakeMsg{
+	msg := handShakeMsg{
 		PreMsg:  "BitTorrent protocol",
 		infoSha: infoSha,
 		peerID:  peerID,
 	}
+	msg.reserved[extensionByte] |= extensionBit
+	msg.reserved[fastByte] |= fastBit
+	return msg
 }
+
 func writeHandShake(w io.Writer, req handShakeMsg) (int, error) {
 	buf := make([]byte, PreMsgSizeBitLen+len(req.PreMsg)+ReservedLen+SHALEN+IDLEN)
 	buf[0] = 0x13
 	n := 1
 	n += copy(buf[n:n+len(req.PreMsg)], req.PreMsg)
-	n += copy(buf[n:n+ReservedLen], make([]byte, ReservedLen))
+	n += copy(buf[n:n+ReservedLen], req.reserved[:])
 	n += copy(buf[n:n+SHALEN], req.infoSha[:])
 	n += copy(buf[n:n+IDLEN], req.peerID[:])
 	return w.Write(buf)
@@ -197,32 +354,11 @@ func readHandShake(w io.Reader) (handShakeMsg, error) {
 	st := 0
 	msg := handShakeMsg{}
 	msg.PreMsg = string(buf[st : st+PreMsgSizeLen])
-	st += PreMsgSizeLen + ReservedLen
+	st += PreMsgSizeLen
+	msg.reserved = [ReservedLen]byte(buf[st : st+ReservedLen])
+	st += ReservedLen
 	msg.infoSha = [SHALEN]byte(buf[st : st+SHALEN])
 	st += SHALEN
 	msg.peerID = [IDLEN]byte(buf[st : st+IDLEN])
 	return msg, nil
 }
-func copyPieceData(index int, buf []byte, msg *Message) (int, error) {
-	if msg.ID != MsgPiece {
-		return -1, errors.New("Piece message type illegal")
-	}
-	if len(msg.Payload) < 8 {
-		return -1, errors.New("Piece's payload length illegal")
-	}
-	id := binary.BigEndian.Uint32(msg.Payload[:4])
-	if int(id) != index {
-		return -1, fmt.Errorf("%d!=%d %s", int(id), index, errors.New("Piece's id illegal").Error())
-	}
-	offset := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	if offset >= len(buf) {
-		return 0, fmt.Errorf("offset too high. %d >= %d", offset, len(buf))
-	}
-	data := msg.Payload[8:]
-	if offset+len(data) > len(buf) {
-
-		return 0, fmt.Errorf("data too large [%d] for offset %d with length %d", len(data), offset, len(buf))
-	}
-	copy(buf[offset:], data)
-	return len(data), nil
-}
@@ -0,0 +1,292 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/dht"
+	"github.com/shoggothforever/torcore/pkg/bencode/magnet"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// UtMetadata is the extension name of metadata exchange (BEP 9)
+const UtMetadata = "ut_metadata"
+
+// MetadataPieceLen is the size of every ut_metadata piece but the last (BEP 9)
+const MetadataPieceLen = 16384
+
+// MaxMetadataSize bounds the info dictionary size a peer may announce
+const MaxMetadataSize = 16 << 20
+
+// MetadataTimeout bounds fetching the whole info dictionary from one peer
+const MetadataTimeout = 30 * time.Second
+
+// 同时尝试获取info字典的peer数量
+const metadataWorkers = 8
+
+// ut_metadata 消息类型
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// ut_metadata扩展，t为nil时本地没有info字典，拒绝所有请求
+type metadataExtension struct {
+	t *Torrent
+}
+
+func (e *metadataExtension) Name() string {
+	return UtMetadata
+}
+
+func (e *metadataExtension) OnHandshake(c *PeerConn, hs *ExtHandshake) error {
+	return nil
+}
+
+// 回应对方的ut_metadata请求，本地没有info字典或请求越界时拒绝
+func (e *metadataExtension) OnMessage(c *PeerConn, payload []byte) error {
+	msg := new(metadataMsg)
+	_, err := parseBencodedPayload(payload, msg)
+	if err != nil {
+		return err
+	}
+	id := c.extensionID(UtMetadata)
+	if msg.MsgType != metadataRequest || id == 0 {
+		return nil
+	}
+	var infoBytes []byte
+	if e.t != nil {
+		infoBytes = e.t.infoBytes
+	}
+	// 先检查分片序号再计算偏移，过大的序号相乘后会溢出
+	numPieces := (len(infoBytes) + MetadataPieceLen - 1) / MetadataPieceLen
+	if msg.Piece < 0 || msg.Piece >= numPieces {
+		reject := metadataMsg{MsgType: metadataReject, Piece: msg.Piece}
+		_, err = c.WriteMessage(newBencodedExtendedMessage(id, reject, nil))
+		return err
+	}
+	begin := msg.Piece * MetadataPieceLen
+	data := metadataMsg{MsgType: metadataData, Piece: msg.Piece, TotalSize: len(infoBytes)}
+	piece := infoBytes[begin:min(begin+MetadataPieceLen, len(infoBytes))]
+	_, err = c.WriteMessage(newBencodedExtendedMessage(id, data, piece))
+	return err
+}
+
+// 从单个peer获取info字典并校验其SHA-1
+func fetchMetadataFrom(ctx context.Context, peer *PeerInfo, infoSha [SHALEN]byte, peerID [IDLEN]byte) ([]byte, error) {
+	c, err := dialConn(peer, infoSha, peerID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	if !c.supportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+	err = c.SetDeadline(time.Now().Add(MetadataTimeout))
+	if err != nil {
+		return nil, err
+	}
+	c.registry = NewExtensionRegistry()
+	localID, err := c.registry.Register(&metadataExtension{})
+	if err != nil {
+		return nil, err
+	}
+	err = c.sendExtHandshake(ExtHandshake{})
+	if err != nil {
+		return nil, err
+	}
+	for c.peerExt == nil {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil && msg.ID == MsgExtended && len(msg.Payload) > 0 && msg.Payload[0] == ExtHandshakeID {
+			err = c.handleExtended(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	id := c.extensionID(UtMetadata)
+	if id == 0 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+	size := c.peerExt.MetadataSize
+	if size <= 0 || size > MaxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	numPieces := (size + MetadataPieceLen - 1) / MetadataPieceLen
+	for i := 0; i < numPieces; i++ {
+		req := metadataMsg{MsgType: metadataRequest, Piece: i}
+		_, err = c.WriteMessage(newBencodedExtendedMessage(id, req, nil))
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, size)
+	got := make([]bool, numPieces)
+	for received := 0; received < numPieces; {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended || len(msg.Payload) < 1 || msg.Payload[0] != localID {
+			continue
+		}
+		res := new(metadataMsg)
+		data, err := parseBencodedPayload(msg.Payload[1:], res)
+		if err != nil {
+			return nil, err
+		}
+		switch res.MsgType {
+		case metadataRequest:
+			err = c.handleExtended(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", res.Piece)
+		case metadataData:
+			begin := res.Piece * MetadataPieceLen
+			if res.Piece < 0 || res.Piece >= numPieces || len(data) != min(MetadataPieceLen, size-begin) {
+				return nil, fmt.Errorf("invalid metadata piece %d", res.Piece)
+			}
+			if !got[res.Piece] {
+				got[res.Piece] = true
+				copy(buf[begin:], data)
+				received++
+			}
+		}
+	}
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], infoSha[:]) {
+		return nil, errors.New("metadata failed integrity check")
+	}
+	return buf, nil
+}
+
+// 解析magnet链接中x.pe给出的peer地址
+func magnetPeers(m *magnet.Magnet) []*PeerInfo {
+	var peers []*PeerInfo
+	for _, addr := range m.Peers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ips, err := net.LookupIP(host)
+			if err != nil || len(ips) == 0 {
+				continue
+			}
+			ip = ips[0]
+		}
+		peers = append(peers, &PeerInfo{Ip: ip, Port: uint16(p)})
+	}
+	return peers
+}
+
+// FetchMetadata obtains the info dictionary of a magnet link from the peers
+// it lists, its trackers and the DHT when node is not nil, returning a
+// torrent ready to be downloaded
+func FetchMetadata(ctx context.Context, m *magnet.Magnet, peerID [IDLEN]byte, node *dht.Server) (*TorrentFile, error) {
+	if !m.HasInfoHash {
+		return nil, errors.New("magnet link has no v1 info hash")
+	}
+	stub := &TorrentFile{InfoSHA: m.InfoHash, FileName: m.Name}
+	for _, tr := range m.Trackers {
+		stub.AnnounceList = append(stub.AnnounceList, []string{tr})
+	}
+	peers := magnetPeers(m)
+	if len(stub.trackers()) != 0 {
+		// 获取种子信息时还没有监听端口，向tracker汇报默认端口
+		port, _ := strconv.Atoi(PeerPort)
+		trackerPeers, err := stub.getPeers(peerID, port)
+		if err == nil {
+			peers = append(peers, trackerPeers...)
+		}
+	}
+	if node != nil {
+		dhtPeers, err := node.GetPeers(ctx, m.InfoHash)
+		if err != nil {
+			log.Println("dht:", err)
+		}
+		for _, p := range dhtPeers {
+			peers = append(peers, &PeerInfo{Ip: p.IP, Port: p.Port})
+		}
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch metadata from")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queue := make(chan *PeerInfo, len(peers))
+	for _, peer := range peers {
+		queue <- peer
+	}
+	close(queue)
+	// 每个worker恰好发送一次结果，失败时发送nil
+	workers := min(metadataWorkers, len(peers))
+	results := make(chan []byte, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for peer := range queue {
+				raw, err := fetchMetadataFrom(ctx, peer, m.InfoHash, peerID)
+				if err != nil {
+					log.Println("fetch metadata from", peer.Ip, "failed:", err)
+					continue
+				}
+				results <- raw
+				return
+			}
+			results <- nil
+		}()
+	}
+	var raw []byte
+	for running := workers; raw == nil && running > 0; running-- {
+		select {
+		case raw = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if raw == nil {
+		return nil, errors.New("no peer provided the metadata")
+	}
+
+	mi, err := metainfo.FromInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+	mi.AnnounceList = stub.AnnounceList
+	tf, err := toTorrentFile(mi)
+	if err != nil {
+		return nil, err
+	}
+	tf.WebSeeds = m.WebSeeds
+	tf.Select = m.Select
+	tf.DHT = node
+	tf.peers = peers
+	return tf, nil
+}
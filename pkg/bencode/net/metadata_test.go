@@ -0,0 +1,117 @@
+package net
+
+import (
+	"context"
+	"crypto/sha1"
+	"github.com/shoggothforever/torcore/pkg/bencode/magnet"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动一个持有完整数据和info字典的做种实例，返回其监听地址
+func startTestSeeder(t *testing.T, ctx context.Context, tf *TorrentFile, data []byte) string {
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	if err := seeder.verifyPieces(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String()
+}
+
+// 构造一个info字典足够大、需要多个ut_metadata分片的种子
+func newTestMetaInfo(t *testing.T, pieceLen, length int) (*TorrentFile, []byte) {
+	tf, data := newTestTorrentFile(t, pieceLen, length)
+	var pieces strings.Builder
+	for _, h := range tf.PieceSHA {
+		pieces.Write(h[:])
+	}
+	mi := &metainfo.MetaInfo{Info: metainfo.Info{
+		Length:      length,
+		Name:        tf.FileName,
+		PieceLength: pieceLen,
+		Pieces:      pieces.String(),
+	}}
+	tf, err := toTorrentFile(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf, data
+}
+
+func TestFetchMetadataAndDownload(t *testing.T) {
+	tf, data := newTestMetaInfo(t, MaxBlockSize, 1000*MaxBlockSize+17)
+	assert.Greater(t, len(tf.infoBytes), MetadataPieceLen)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	addr := startTestSeeder(t, ctx, tf, data)
+
+	m := tf.Magnet()
+	m.Peers = []string{addr}
+	m.Select = []int{0}
+	parsed, err := magnet.Parse(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := FetchMetadata(ctx, parsed, util.GeneratePeerID("leecher"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tf.InfoSHA, got.InfoSHA)
+	assert.Equal(t, tf.PieceSHA, got.PieceSHA)
+	assert.Equal(t, tf.FileLen, got.FileLen)
+	assert.Equal(t, sha1.Sum(got.infoBytes), got.InfoSHA)
+	assert.Equal(t, []int{0}, got.Select)
+
+	leecher := newTorrent(got, util.GeneratePeerID("leecher"))
+	buf, err := downloadToMemory(ctx, leecher, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+}
+
+func TestFetchMetadataWrongHash(t *testing.T) {
+	tf, data := newTestMetaInfo(t, MaxBlockSize, 4*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addr := startTestSeeder(t, ctx, tf, data)
+
+	// 做种方只接受正确info hash的握手
+	m := &magnet.Magnet{HasInfoHash: true, Peers: []string{addr}}
+	m.InfoHash = sha1.Sum([]byte("other"))
+	_, err := FetchMetadata(ctx, m, util.GeneratePeerID("leecher"), nil)
+	assert.Error(t, err)
+}
+
+// 越界或者相乘会溢出的分片序号被拒绝，不会导致panic
+func TestMetadataRejectsOutOfRangePiece(t *testing.T) {
+	tf, _ := newTestMetaInfo(t, MaxBlockSize, 4*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("seeder"))
+	c, _, msgs := newPipeConn(t, tr)
+	c.peerExt = &ExtHandshake{M: map[string]int{UtMetadata: 3}}
+	ext := &metadataExtension{t: tr}
+	for _, piece := range []int{1 << 49, 1, -1, 0} {
+		req := newBencodedExtendedMessage(1, metadataMsg{MsgType: metadataRequest, Piece: piece}, nil)
+		assert.NoError(t, ext.OnMessage(c, req.Payload[1:]))
+		msg := nextMessage(t, msgs)
+		assert.Equal(t, byte(3), msg.Payload[0])
+		res := new(metadataMsg)
+		data, err := parseBencodedPayload(msg.Payload[1:], res)
+		assert.NoError(t, err)
+		assert.Equal(t, piece, res.Piece)
+		if piece == 0 {
+			assert.Equal(t, metadataData, res.MsgType)
+			assert.Equal(t, tf.infoBytes, data)
+		} else {
+			assert.Equal(t, metadataReject, res.MsgType)
+		}
+	}
+}
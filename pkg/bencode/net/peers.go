@@ -1,12 +1,16 @@
 package net
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +32,11 @@ func buildPeerInfo(peers []byte) []*PeerInfo {
 
 type Bitfield []byte
 
+// 创建能容纳pieces个分片的空位图
+func NewBitfield(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
 func (field Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
@@ -46,6 +55,10 @@ func (field Bitfield) SetPiece(index int) {
 	field[byteIndex] |= 1 << uint(7-offset)
 }
 
+func (field Bitfield) Equal(other Bitfield) bool {
+	return bytes.Equal(field, other)
+}
+
 func (field Bitfield) String() string {
 	str := "piece# "
 	for i := 0; i < len(field)*8; i++ {
@@ -65,65 +78,180 @@ type PeerInfo struct {
 // p2p对等实体连接信息
 type PeerConn struct {
 	net.Conn
+	// 对方是否choke我们，以及对方拥有的分片，建立连接后由mu保护
 	Choked   bool
 	BitField Bitfield
 	peer     *PeerInfo
 	peerId   [IDLEN]byte
 	infoSHA  [SHALEN]byte
+	// 对方握手报文中的保留字节和扩展握手，以及本地处理扩展消息的注册表
+	reserved [ReservedLen]byte
+	peerExt  *ExtHandshake
+	registry *ExtensionRegistry
+	// 种子的分片数量，为0表示未知，此时HaveAll只记录在haveAll中
+	numPieces int
+	haveAll   bool
+	// 对方可以发送的消息的最大长度，为0时使用MaxMessageLen
+	maxMessage int
+	// 快速扩展：对方允许我们在被choke时请求的分片，以及我们允许对方快速请求的分片
+	allowedFast map[int]struct{}
+	grantedFast map[int]struct{}
+	// 我们是否正在choke对方、是否对对方的分片感兴趣，对方是否对我们的分片感兴趣，由mu保护。
+	// 连接的读取协程更新对方的状态，下载、choke等其他协程读取
+	mu             sync.Mutex
+	amChoking      bool
+	amInterested   bool
+	peerInterested bool
+	// 读取协程转发给下载循环的消息，读取协程退出时关闭，退出的原因记录在readErr中。
+	// quit在下载循环结束时关闭，只上传的连接没有下载循环，两者均为nil
+	events  chan *Message
+	quit    chan struct{}
+	readErr error
+	// 最后一次向对方发送消息的时间，单位为纳秒
+	lastWrite atomic.Int64
+	// 从对方下载和向对方上传的数据量，以及决定是否unchoke对方的choker
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	choker     *choker
+	// 与对方交换peer列表的状态，未开始PEX时为nil
+	pex *pexConn
+	// 下载时统计对方拥有的分片，未下载时为nil
+	picker *PiecePicker
 }
 
 // 创建一个对等实体的连接
 // infoSha 用于校验，peerID在一次下载中唯一
 func NewConn(peer *PeerInfo, infoSha [SHALEN]byte, peerID [IDLEN]byte) (*PeerConn, error) {
-	addr := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
-	conn, err := net.DialTimeout("tcp", addr, DialTime)
+	c, err := dialConn(peer, infoSha, peerID)
 	if err != nil {
 		return nil, err
 	}
-	err = handShake(conn, infoSha, peerID)
+	err = c.ReadBitFieldMessage()
 	if err != nil {
-		fmt.Println("handshake failed")
-		conn.Close()
+		c.Close()
 		return nil, err
 	}
-	c := &PeerConn{
-		Conn:    conn,
-		Choked:  true,
-		peer:    peer,
-		peerId:  peerID,
-		infoSHA: infoSha,
+	return c, nil
+}
+
+// 与peer建立下载连接，读取其位图
+func (t *Torrent) connect(peer *PeerInfo) (*PeerConn, error) {
+	c, err := dialConn(peer, t.InfoSHA, t.PeerID)
+	if err != nil {
+		return nil, err
 	}
+	c.numPieces = len(t.PieceSHA)
+	c.maxMessage = t.maxMessage
 	err = c.ReadBitFieldMessage()
 	if err != nil {
+		t.checkBan(c, err)
+		c.Close()
 		return nil, err
 	}
 	return c, nil
 }
 
-// 从网络连接中获取p2p信息
-func (c *PeerConn) ReadMessage() (Message, error) {
-	buf := make([]byte, 4)
-	_, err := io.ReadFull(c, buf)
+// 拨号并完成握手，不读取任何后续消息
+func dialConn(peer *PeerInfo, infoSha [SHALEN]byte, peerID [IDLEN]byte) (*PeerConn, error) {
+	addr := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
+	conn, err := net.DialTimeout("tcp", addr, DialTime)
 	if err != nil {
-		return Message{}, err
+		return nil, err
 	}
-	length := binary.BigEndian.Uint32(buf)
-	buf = make([]byte, length)
-	_, err = io.ReadFull(c, buf)
+	res, err := handShake(conn, infoSha, peerID)
 	if err != nil {
-		return Message{}, err
-	}
-	if len(buf) < 1 {
-		return Message{}, errors.New("message too short")
+		fmt.Println("handshake failed")
+		conn.Close()
+		return nil, err
 	}
-	return Message{
-		ID:      MsgID(buf[0]),
-		Payload: buf[1:],
+	return &PeerConn{
+		Conn:      conn,
+		Choked:    true,
+		peer:      peer,
+		peerId:    res.peerID,
+		infoSHA:   infoSha,
+		reserved:  res.reserved,
+		amChoking: true,
 	}, nil
 }
 
+// MaxMessageLen is the default bound on the length of a message other than
+// a bitfield: a block with its piece header, or a metadata piece with its
+// extension header, fits with room to spare
+const MaxMessageLen = MaxBlockSize + 1024
+
+// ErrMessageTooLong is returned when a peer sends a message longer than
+// allowed, such a peer is disconnected and banned
+var ErrMessageTooLong = errors.New("peer message too long")
+
+// 块消息payload的缓冲区，块复制到分片中后通过releaseMessage放回
+const blockBufferLen = 8 + MaxBlockSize
+
+var blockPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, blockBufferLen)
+		return &buf
+	},
+}
+
+// 从网络连接中获取p2p信息，keep-alive消息返回nil。
+// 在读取payload之前检查长度，超过上限时返回ErrMessageTooLong
+func (c *PeerConn) ReadMessage() (*Message, error) {
+	var header [5]byte
+	_, err := io.ReadFull(c.Conn, header[:4])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 {
+		return nil, nil
+	}
+	_, err = io.ReadFull(c.Conn, header[4:])
+	if err != nil {
+		return nil, err
+	}
+	id := MsgID(header[4])
+	if length > uint32(c.maxMessageLen(id)) {
+		return nil, fmt.Errorf("%w: %s of %d bytes", ErrMessageTooLong, (&Message{ID: id}).name(), length)
+	}
+	var payload []byte
+	if id == MsgPiece && length-1 <= blockBufferLen {
+		payload = (*blockPool.Get().(*[]byte))[:length-1]
+	} else {
+		payload = make([]byte, length-1)
+	}
+	_, err = io.ReadFull(c.Conn, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{ID: id, Payload: payload}, nil
+}
+
+// 对方可以发送的消息的最大长度，位图的上限按种子的分片数计算
+func (c *PeerConn) maxMessageLen(id MsgID) int {
+	limit := c.maxMessage
+	if limit <= 0 {
+		limit = MaxMessageLen
+	}
+	if id == MsgBitfield {
+		limit = max(limit, 1+len(NewBitfield(c.numPieces)))
+	}
+	return limit
+}
+
+// 将块消息的缓冲区放回缓冲池，之后不能再使用msg的payload
+func releaseMessage(msg *Message) {
+	if msg == nil || msg.ID != MsgPiece || cap(msg.Payload) != blockBufferLen {
+		return
+	}
+	buf := msg.Payload[:blockBufferLen]
+	msg.Payload = nil
+	blockPool.Put(&buf)
+}
+
 // 向网络连接写入p2p信息
 func (c *PeerConn) WriteMessage(m *Message) (int, error) {
+	c.lastWrite.Store(time.Now().UnixNano())
 	return c.Write(m.Serialize())
 }
 func (c *PeerConn) ReadBitFieldMessage() error {
@@ -134,13 +262,73 @@ func (c *PeerConn) ReadBitFieldMessage() error {
 	if err != nil {
 		return err
 	}
-	if msg.ID != MsgBitfield {
+	switch {
+	case msg == nil:
+		return errors.New("expected bitfield, get keep-alive")
+	case msg.ID == MsgBitfield:
+		err = c.checkBitfield(msg.Payload)
+		if err != nil {
+			return err
+		}
+		c.setBitfield(msg.Payload, false)
+	case msg.ID == MsgHaveAll && c.supportsFast():
+		c.setBitfield(fullBitfield(c.numPieces), true)
+	case msg.ID == MsgHaveNone && c.supportsFast():
+		c.setBitfield(NewBitfield(c.numPieces), false)
+	default:
 		return fmt.Errorf("expected bitfield, get " + strconv.Itoa(int(msg.ID)))
 	}
 	fmt.Println("fill bitfield : " + c.peer.Ip.String())
-	c.BitField = msg.Payload
 	return nil
 }
+
+// 记录对方新拥有的分片
+func (c *PeerConn) setHave(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.BitField.HasPiece(index) {
+		return
+	}
+	c.BitField.SetPiece(index)
+	if c.picker != nil && c.BitField.HasPiece(index) {
+		c.picker.Have(index)
+	}
+}
+
+// 对方的位图必须与种子的分片数等长，末尾多余的位为0（BEP 3），分片数未知时不检查
+func (c *PeerConn) checkBitfield(field Bitfield) error {
+	if c.numPieces <= 0 {
+		return nil
+	}
+	if len(field) != len(NewBitfield(c.numPieces)) {
+		return fmt.Errorf("bitfield of %d bytes for %d pieces", len(field), c.numPieces)
+	}
+	for index := c.numPieces; index < len(field)*8; index++ {
+		if field.HasPiece(index) {
+			return fmt.Errorf("bitfield has spare bit %d set", index)
+		}
+	}
+	return nil
+}
+
+// 用对方的位图或者HaveAll、HaveNone替换对方拥有的分片
+func (c *PeerConn) setBitfield(field Bitfield, haveAll bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.picker != nil {
+		c.picker.RemovePeer(c.BitField)
+		c.picker.AddPeer(field)
+	}
+	c.BitField, c.haveAll = field, haveAll
+}
+
+// 对方拥有的分片的副本
+func (c *PeerConn) bitfield() Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.BitField)
+}
+
 func (c *PeerConn) SendRequest(index, offset, length int) error {
 	req := NewRequestMessage(index, offset, length)
 	_, err := c.WriteMessage(&req)
@@ -150,6 +338,10 @@ func (c *PeerConn) SendRequest(index, offset, length int) error {
 	//fmt.Println("send msg ", req)
 	return nil
 }
+func (c *PeerConn) SendCancel(index, offset, length int) error {
+	_, err := c.WriteMessage(NewCancelMessage(index, offset, length))
+	return err
+}
 func (c *PeerConn) SendHave(index int) error {
 	req := NewHaveMessage(index)
 	_, err := c.WriteMessage(req)
@@ -0,0 +1,310 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UtPex is the extension name of peer exchange (BEP 11)
+const UtPex = "ut_pex"
+
+// PexInterval is how often the connected peer list is sent to a peer
+const PexInterval = time.Minute
+
+// PexMinInterval is the shortest gap we accept between two PEX messages of a
+// peer, a little below PexInterval to allow for timer skew
+const PexMinInterval = 45 * time.Second
+
+// PexMaxPeers bounds the added and the dropped peers of one PEX message
+const PexMaxPeers = 50
+
+// PEX中每个peer的标志位
+const (
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUTP        = 0x04
+	PexHolepunch  = 0x08
+	PexOutgoing   = 0x10
+)
+
+const peer6Len = net.IPv6len + PortLen
+
+// ut_pex消息，peer均为紧凑格式，.f为每个peer对应一个字节的标志位
+type pexMsg struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+type pexPeer struct {
+	ip    net.IP
+	port  uint16
+	flags byte
+}
+
+func (p pexPeer) key() string {
+	return net.JoinHostPort(p.ip.String(), strconv.Itoa(int(p.port)))
+}
+
+// 紧凑格式：IPv4为6字节，IPv6为18字节
+func (p pexPeer) compact() string {
+	ip := p.ip.To4()
+	if ip == nil {
+		ip = p.ip.To16()
+	}
+	buf := make([]byte, len(ip)+PortLen)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.port)
+	return string(buf)
+}
+
+func (m *pexMsg) add(p pexPeer) {
+	if p.ip.To4() != nil {
+		m.Added += p.compact()
+		m.AddedF += string([]byte{p.flags})
+	} else {
+		m.Added6 += p.compact()
+		m.Added6F += string([]byte{p.flags})
+	}
+}
+
+func (m *pexMsg) drop(p pexPeer) {
+	if p.ip.To4() != nil {
+		m.Dropped += p.compact()
+	} else {
+		m.Dropped6 += p.compact()
+	}
+}
+
+// 解析紧凑格式的peer列表，flags缺失时标志位为0
+func parsePexPeers(peers, flags string, size int) ([]pexPeer, error) {
+	if len(peers)%size != 0 {
+		return nil, errors.New("malformed pex peer list")
+	}
+	res := make([]pexPeer, len(peers)/size)
+	for i := range res {
+		entry := peers[i*size : (i+1)*size]
+		res[i].ip = net.IP(entry[:size-PortLen])
+		res[i].port = binary.BigEndian.Uint16([]byte(entry[size-PortLen:]))
+		if i < len(flags) {
+			res[i].flags = flags[i]
+		}
+	}
+	return res, nil
+}
+
+// 对方加入的peer，IPv4在前
+func (m *pexMsg) added() ([]pexPeer, error) {
+	peers, err := parsePexPeers(m.Added, m.AddedF, PeerLen)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := parsePexPeers(m.Added6, m.Added6F, peer6Len)
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, peers6...), nil
+}
+
+// 一个连接上的PEX状态，由读取连接的goroutine和定期发送的goroutine共享
+type pexConn struct {
+	mu sync.Mutex
+	// 对方的ut_pex消息ID，收到扩展握手前为0
+	id byte
+	// 对方的监听地址，被动连接在扩展握手给出端口前为空
+	addr string
+	// 已经告知对方的peer
+	sent     map[string]pexPeer
+	lastRecv time.Time
+	ready    chan struct{}
+}
+
+// ut_pex扩展，交换各自已连接的peer
+type pexExtension struct {
+	t *Torrent
+}
+
+func (e *pexExtension) Name() string {
+	return UtPex
+}
+
+// 被动连接在对方告知监听端口后才加入已连接的peer列表
+func (e *pexExtension) OnHandshake(c *PeerConn, hs *ExtHandshake) error {
+	p := c.pex
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.addr == "" && hs.P > 0 && hs.P <= 0xffff {
+		if tcp, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			peer := pexPeer{ip: tcp.IP, port: uint16(hs.P)}
+			if c.complete() {
+				peer.flags |= PexSeed
+			}
+			p.addr = peer.key()
+			e.t.peerConnected(peer)
+		}
+	}
+	if p.id == 0 {
+		p.id = c.extensionID(UtPex)
+		if p.id != 0 {
+			close(p.ready)
+		}
+	}
+	return nil
+}
+
+// 将对方告知的peer加入下载，过于频繁的消息和超出数量的peer被忽略
+func (e *pexExtension) OnMessage(c *PeerConn, payload []byte) error {
+	p := c.pex
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	tooSoon := !p.lastRecv.IsZero() && now.Sub(p.lastRecv) < PexMinInterval
+	if !tooSoon {
+		p.lastRecv = now
+	}
+	p.mu.Unlock()
+	if tooSoon {
+		return nil
+	}
+	msg := new(pexMsg)
+	_, err := parseBencodedPayload(payload, msg)
+	if err != nil {
+		return err
+	}
+	added, err := msg.added()
+	if err != nil {
+		return err
+	}
+	for i, peer := range added {
+		if i >= PexMaxPeers {
+			break
+		}
+		e.t.discoverPeer(&PeerInfo{Ip: peer.ip, Port: peer.port})
+	}
+	return nil
+}
+
+// 记录一个已建立连接的peer
+func (t *Torrent) peerConnected(peer pexPeer) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.live[peer.key()] = peer
+}
+
+func (t *Torrent) peerDisconnected(addr string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.live, addr)
+}
+
+// 连接通过PEX等途径发现的peer，未在下载时忽略
+func (t *Torrent) discoverPeer(peer *PeerInfo) {
+	t.m.Lock()
+	add := t.addPeerFn
+	t.m.Unlock()
+	if add != nil {
+		add(peer)
+	}
+}
+
+// 在连接上开始PEX，返回的函数在连接关闭时调用。
+// outgoing表示连接由我们发起，对方的地址即为其监听地址
+func (t *Torrent) startPex(c *PeerConn, outgoing bool) func() {
+	p := &pexConn{
+		sent:  make(map[string]pexPeer),
+		ready: make(chan struct{}),
+	}
+	if outgoing && c.peer != nil {
+		peer := pexPeer{ip: c.peer.Ip, port: c.peer.Port, flags: PexOutgoing}
+		if c.complete() {
+			peer.flags |= PexSeed
+		}
+		p.addr = peer.key()
+		t.peerConnected(peer)
+	}
+	c.pex = p
+	ctx, cancel := context.WithCancel(context.Background())
+	go t.runPex(ctx, c, p)
+	return func() {
+		cancel()
+		p.mu.Lock()
+		addr := p.addr
+		p.mu.Unlock()
+		if addr != "" {
+			t.peerDisconnected(addr)
+		}
+	}
+}
+
+// 收到对方的扩展握手后立即发送一次当前的peer列表，之后每PexInterval发送一次变化
+func (t *Torrent) runPex(ctx context.Context, c *PeerConn, p *pexConn) {
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		return
+	}
+	tk := time.NewTicker(PexInterval)
+	defer tk.Stop()
+	for {
+		err := t.sendPex(c, p)
+		if err != nil {
+			return
+		}
+		select {
+		case <-tk.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 发送自上次以来加入和断开的peer，不包括对方自己
+func (t *Torrent) sendPex(c *PeerConn, p *pexConn) error {
+	t.m.Lock()
+	live := make(map[string]pexPeer, len(t.live))
+	for addr, peer := range t.live {
+		live[addr] = peer
+	}
+	t.m.Unlock()
+
+	p.mu.Lock()
+	id := p.id
+	delete(live, p.addr)
+	msg := pexMsg{}
+	added, dropped := 0, 0
+	for addr, peer := range live {
+		if _, ok := p.sent[addr]; ok || added >= PexMaxPeers {
+			continue
+		}
+		msg.add(peer)
+		p.sent[addr] = peer
+		added++
+	}
+	for addr, peer := range p.sent {
+		if _, ok := live[addr]; ok || dropped >= PexMaxPeers {
+			continue
+		}
+		msg.drop(peer)
+		delete(p.sent, addr)
+		dropped++
+	}
+	p.mu.Unlock()
+	if added+dropped == 0 {
+		return nil
+	}
+	_, err := c.WriteMessage(newBencodedExtendedMessage(id, msg, nil))
+	return err
+}
@@ -0,0 +1,129 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 只处理扩展消息，直到连接关闭
+func serveExtended(c *PeerConn) {
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msg != nil && msg.ID == MsgExtended {
+			c.handleExtended(msg.Payload)
+		}
+	}
+}
+
+func TestPexMessage(t *testing.T) {
+	v4 := pexPeer{ip: net.IPv4(10, 0, 0, 1), port: 6881, flags: PexSeed | PexOutgoing}
+	v6 := pexPeer{ip: net.ParseIP("2001:db8::1"), port: 51413, flags: PexUTP}
+	msg := pexMsg{}
+	msg.add(v4)
+	msg.add(v6)
+	msg.drop(pexPeer{ip: net.IPv4(10, 0, 0, 2), port: 1})
+	assert.Len(t, msg.Added, PeerLen)
+	assert.Len(t, msg.Added6, peer6Len)
+	assert.Len(t, msg.Dropped, PeerLen)
+
+	raw := newBencodedExtendedMessage(1, msg, nil)
+	got := new(pexMsg)
+	_, err := parseBencodedPayload(raw.Payload[1:], got)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, *got)
+	added, err := got.added()
+	assert.NoError(t, err)
+	if assert.Len(t, added, 2) {
+		assert.Equal(t, v4.key(), added[0].key())
+		assert.Equal(t, v4.flags, added[0].flags)
+		assert.Equal(t, v6.key(), added[1].key())
+		assert.Equal(t, v6.flags, added[1].flags)
+	}
+
+	_, err = (&pexMsg{Added: "short"}).added()
+	assert.Error(t, err)
+}
+
+func TestPexDiscoversPeers(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 4*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	assert.NoError(t, seeder.verifyPieces())
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一个peer在握手中告知监听端口，做种方将其记为已连接
+	first := newTorrent(tf, util.GeneratePeerID("first"))
+	fl, err := first.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := first.connect(peerFromAddr(t, l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	assert.NoError(t, first.startExtensions(c1))
+	defer first.startPex(c1, true)()
+	go serveExtended(c1)
+	assert.Eventually(t, func() bool {
+		seeder.m.Lock()
+		defer seeder.m.Unlock()
+		_, ok := seeder.live[fl.Addr().String()]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 第二个peer只知道做种方，通过PEX发现第一个peer
+	second := newTorrent(tf, util.GeneratePeerID("second"))
+	found := make(chan *PeerInfo, 4)
+	second.addPeerFn = func(peer *PeerInfo) { found <- peer }
+	c2, err := second.connect(peerFromAddr(t, l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	assert.NoError(t, second.startExtensions(c2))
+	defer second.startPex(c2, true)()
+	go serveExtended(c2)
+	select {
+	case peer := <-found:
+		assert.Equal(t, fl.Addr().String(), net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port))))
+	case <-ctx.Done():
+		t.Fatal("no peer discovered through pex")
+	}
+
+	// 一分钟内的第二条消息被忽略
+	c2.pex.mu.Lock()
+	id := c2.pex.id
+	c2.pex.mu.Unlock()
+	msg := pexMsg{}
+	msg.add(pexPeer{ip: net.IPv4(10, 0, 0, 1), port: 6881})
+	assert.NoError(t, (&pexExtension{t: second}).OnMessage(c2, newBencodedExtendedMessage(id, msg, nil).Payload[1:]))
+	select {
+	case peer := <-found:
+		t.Fatal("rate limit not applied, discovered", peer.Ip)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPrivateTorrentDisablesPex(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, MaxBlockSize)
+	tf.Private = true
+	tor := newTorrent(tf, util.GeneratePeerID("private"))
+	assert.Equal(t, byte(0), tor.extensions.ID(UtPex))
+	tf.Private = false
+	tor = newTorrent(tf, util.GeneratePeerID("public"))
+	assert.NotEqual(t, byte(0), tor.extensions.ID(UtPex))
+}
@@ -0,0 +1,288 @@
+package net
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 分片的下载状态
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	piecePending
+	pieceDone
+)
+
+// PiecePicker decides which piece a peer downloads next. It counts how many
+// connected peers have each piece, from their bitfields and have messages,
+// and hands out the rarest missing piece the peer has, breaking ties randomly.
+// Pieces given a deadline are handed out first, the earliest deadline first,
+// then pieces of higher priority. Skipped pieces are only handed out once
+// given a deadline.
+type PiecePicker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+	// 分片的期限，零值表示没有期限
+	deadline []time.Time
+	priority []Priority
+	done     int
+	pending  int
+	// 跳过的、尚未下载的分片数
+	skipped int
+	rand    *rand.Rand
+}
+
+// NewPiecePicker creates a picker for a torrent of numPieces pieces, none of
+// which are downloaded yet
+func NewPiecePicker(numPieces int) *PiecePicker {
+	return &PiecePicker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+		deadline:     make([]time.Time, numPieces),
+		priority:     make([]Priority, numPieces),
+		rand:         rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// AddPeer counts the pieces of a newly connected peer
+func (p *PiecePicker) AddPeer(field Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if field.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// RemovePeer stops counting the pieces of a disconnected peer, field must
+// hold the pieces added by AddPeer and Have
+func (p *PiecePicker) RemovePeer(field Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if field.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+// Have counts a piece a connected peer announced after its bitfield
+func (p *PiecePicker) Have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Availability is the number of connected peers having the piece
+func (p *PiecePicker) Availability(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.availability[index]
+}
+
+// SetDeadline sets the time by which a piece is wanted, the zero time
+// removes the deadline
+func (p *PiecePicker) SetDeadline(index int, deadline time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.deadline) {
+		p.deadline[index] = deadline
+	}
+}
+
+// ClearDeadlines removes the deadlines of all pieces
+func (p *PiecePicker) ClearDeadlines() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.deadline)
+}
+
+// SetPriority sets the priority of a piece, PriorityNormal by default
+func (p *PiecePicker) SetPriority(index int, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.priority) {
+		return
+	}
+	if p.state[index] == pieceMissing {
+		if p.priority[index] == PrioritySkip {
+			p.skipped--
+		}
+		if priority == PrioritySkip {
+			p.skipped++
+		}
+	}
+	p.priority[index] = priority
+}
+
+// Wanted is the number of pieces to download, including those already
+// downloaded. Skipped pieces are not wanted unless downloaded anyway.
+func (p *PiecePicker) Wanted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.state) - p.skipped
+}
+
+// Overdue returns the pieces in field being downloaded whose deadline has
+// passed, nil when there are none. They may be requested from several peers.
+func (p *PiecePicker) Overdue(field Bitfield, now time.Time) Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var late Bitfield
+	for i, st := range p.state {
+		if st != piecePending || p.deadline[i].IsZero() || p.deadline[i].After(now) || !field.HasPiece(i) {
+			continue
+		}
+		if late == nil {
+			late = NewBitfield(len(p.state))
+		}
+		late.SetPiece(i)
+	}
+	return late
+}
+
+// 分片是否正在下载并且已经错过期限
+func (p *PiecePicker) late(index int, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state[index] == piecePending && !p.deadline[index].IsZero() && !p.deadline[index].After(now)
+}
+
+// Pick reserves the missing piece with the earliest deadline among those in
+// field, or the rarest one when none of them has a deadline. It returns
+// false when the peer has none of the pieces still needed.
+func (p *PiecePicker) Pick(field Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if picked := p.pickUrgent(field); picked >= 0 {
+		p.reserve(picked)
+		return picked, true
+	}
+	picked, ties := -1, 0
+	for i, st := range p.state {
+		if st != pieceMissing || p.priority[i] == PrioritySkip || !field.HasPiece(i) {
+			continue
+		}
+		switch {
+		case picked < 0 || p.priority[i] > p.priority[picked] ||
+			p.priority[i] == p.priority[picked] && p.availability[i] < p.availability[picked]:
+			picked, ties = i, 1
+		case p.priority[i] == p.priority[picked] && p.availability[i] == p.availability[picked]:
+			// 蓄水池抽样，在可用性相同的分片中等概率选择
+			ties++
+			if p.rand.Intn(ties) == 0 {
+				picked = i
+			}
+		}
+	}
+	if picked < 0 {
+		return 0, false
+	}
+	p.reserve(picked)
+	return picked, true
+}
+
+// 将缺失的分片标记为正在下载
+func (p *PiecePicker) reserve(index int) {
+	if p.priority[index] == PrioritySkip {
+		p.skipped--
+	}
+	p.state[index] = piecePending
+	p.pending++
+}
+
+// 期限最早的缺失分片，期限相同时选择序号小的，没有时返回-1
+func (p *PiecePicker) pickUrgent(field Bitfield) int {
+	picked := -1
+	for i, st := range p.state {
+		if st != pieceMissing || p.deadline[i].IsZero() || !field.HasPiece(i) {
+			continue
+		}
+		if picked < 0 || p.deadline[i].Before(p.deadline[picked]) {
+			picked = i
+		}
+	}
+	return picked
+}
+
+// 从第一个缺失的分片开始，最多n个还没有下载完成、也没有跳过的分片
+func (p *PiecePicker) nextWanted(n int) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var wanted []int
+	for i, st := range p.state {
+		if len(wanted) == n {
+			break
+		}
+		if st != pieceDone && p.priority[i] != PrioritySkip {
+			wanted = append(wanted, i)
+		}
+	}
+	return wanted
+}
+
+// Interesting reports whether field has a piece that is not downloaded yet
+// and not skipped
+func (p *PiecePicker) Interesting(field Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, st := range p.state {
+		if st != pieceDone && (p.priority[i] != PrioritySkip || !p.deadline[i].IsZero()) && field.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Done marks a picked piece as downloaded and verified
+func (p *PiecePicker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.state[index] {
+	case piecePending:
+		p.pending--
+		p.state[index] = pieceDone
+		p.done++
+	case pieceMissing:
+		if p.priority[index] == PrioritySkip {
+			p.skipped--
+		}
+		p.state[index] = pieceDone
+		p.done++
+	}
+}
+
+// Abort returns a picked piece that could not be downloaded, so it can be
+// picked again
+func (p *PiecePicker) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == piecePending {
+		p.state[index] = pieceMissing
+		p.pending--
+		if p.priority[index] == PrioritySkip {
+			p.skipped++
+		}
+	}
+}
+
+// Complete reports whether every piece not skipped is downloaded
+func (p *PiecePicker) Complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done+p.skipped == len(p.state)
+}
+
+// Endgame reports whether every piece not yet downloaded is being
+// downloaded, from then on blocks are requested from several peers
+func (p *PiecePicker) Endgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done+p.skipped < len(p.state) && p.done+p.pending+p.skipped == len(p.state)
+}
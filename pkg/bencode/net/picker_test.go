@@ -0,0 +1,197 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func bitfieldOf(pieces int, indexes ...int) Bitfield {
+	field := NewBitfield(pieces)
+	for _, i := range indexes {
+		field.SetPiece(i)
+	}
+	return field
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	p := NewPiecePicker(4)
+	all := fullBitfield(4)
+	p.AddPeer(all)
+	p.AddPeer(bitfieldOf(4, 0, 1, 3))
+	p.AddPeer(bitfieldOf(4, 0, 3))
+	p.Have(1)
+	assert.Equal(t, []int{3, 3, 1, 3}, []int{p.Availability(0), p.Availability(1), p.Availability(2), p.Availability(3)})
+
+	// 只选择对方拥有的分片
+	_, ok := p.Pick(NewBitfield(4))
+	assert.False(t, ok)
+	index, ok := p.Pick(all)
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+	// 已选择的分片不会再次选出，放弃后可以重新选择
+	index, _ = p.Pick(bitfieldOf(4, 0, 2))
+	assert.Equal(t, 0, index)
+	p.Abort(0)
+	index, _ = p.Pick(bitfieldOf(4, 0, 2))
+	assert.Equal(t, 0, index)
+
+	p.RemovePeer(all)
+	assert.Equal(t, 0, p.Availability(2))
+	for _, i := range []int{0, 2} {
+		p.Done(i)
+	}
+	assert.False(t, p.Complete())
+	for {
+		index, ok := p.Pick(all)
+		if !ok {
+			break
+		}
+		p.Done(index)
+	}
+	assert.True(t, p.Complete())
+}
+
+// 可用性相同时随机选择
+func TestPiecePickerRandomTies(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		p := NewPiecePicker(8)
+		p.AddPeer(fullBitfield(8))
+		index, ok := p.Pick(fullBitfield(8))
+		assert.True(t, ok)
+		seen[index] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+// 启动只拥有部分分片的做种方
+func startPartialSeeder(t *testing.T, ctx context.Context, tf *TorrentFile, data []byte, pieces ...int) *PeerInfo {
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	for _, i := range pieces {
+		seeder.bitfield.SetPiece(i)
+	}
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peerFromAddr(t, l.Addr().String())
+}
+
+// 每个peer只下载自己拥有的分片
+func TestDownloadFromPartialPeers(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 8*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{
+		startPartialSeeder(t, ctx, tf, data, 0, 1, 2, 3),
+		startPartialSeeder(t, ctx, tf, data, 3, 4, 5, 6, 7),
+		startPartialSeeder(t, ctx, tf, data),
+	}
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+	assert.True(t, leecher.picker.Complete())
+}
+
+// 有期限的分片按期限先后选择，不再考虑稀有度；错过期限的分片可以重复请求
+func TestPiecePickerDeadlines(t *testing.T) {
+	p := NewPiecePicker(6)
+	all := fullBitfield(6)
+	p.AddPeer(all)
+	p.AddPeer(bitfieldOf(6, 0, 1, 2, 3, 4))
+	now := time.Now()
+	p.SetDeadline(4, now.Add(time.Second))
+	p.SetDeadline(3, now.Add(2*time.Second))
+	p.SetDeadline(1, now.Add(time.Second))
+
+	var order []int
+	for i := 0; i < 3; i++ {
+		index, ok := p.Pick(all)
+		assert.True(t, ok)
+		order = append(order, index)
+	}
+	assert.Equal(t, []int{1, 4, 3}, order)
+	// 其余的分片按稀有度选择
+	index, _ := p.Pick(all)
+	assert.Equal(t, 5, index)
+
+	assert.Nil(t, p.Overdue(all, now))
+	late := p.Overdue(bitfieldOf(6, 1, 3), now.Add(time.Second))
+	assert.Equal(t, bitfieldOf(6, 1), late)
+	p.Done(1)
+	assert.Equal(t, bitfieldOf(6, 3, 4), p.Overdue(all, now.Add(time.Minute)))
+
+	p.ClearDeadlines()
+	assert.Nil(t, p.Overdue(all, now.Add(time.Minute)))
+}
+
+// 顺序下载模式下仍能下载完整的数据，下载过程中可以移动优先范围
+func TestDownloadPriorityRange(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 8*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{
+		startPartialSeeder(t, ctx, tf, data, 0, 1, 2, 3),
+		peerFromAddr(t, startTestSeeder(t, ctx, tf, data)),
+	}
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	leecher.SetPriorityRange(0, len(tf.PieceSHA), 0)
+	go leecher.SetPriorityRange(4, 6, time.Millisecond)
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+}
+
+// 顺序下载只为第一个缺失分片开始的窗口设置期限，窗口随分片完成向后移动并跳过不下载的分片
+func TestSequentialWindow(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 20*MaxBlockSize)
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	leecher.m.Lock()
+	leecher.picker = NewPiecePicker(len(tf.PieceSHA))
+	leecher.m.Unlock()
+	withDeadline := func() []int {
+		leecher.picker.mu.Lock()
+		defer leecher.picker.mu.Unlock()
+		var pieces []int
+		for index, deadline := range leecher.picker.deadline {
+			if !deadline.IsZero() {
+				pieces = append(pieces, index)
+			}
+		}
+		return pieces
+	}
+	leecher.SetSequential(true)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, withDeadline())
+
+	// 窗口之外的分片按稀有度选择
+	leecher.picker.SetPriority(3, PrioritySkip)
+	leecher.picker.Done(1)
+	leecher.advanceWindow()
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, withDeadline())
+	leecher.picker.Done(0)
+	leecher.advanceWindow()
+	assert.Equal(t, []int{2, 4, 5, 6, 7, 8, 9, 10}, withDeadline())
+	leecher.SetSequential(false)
+	assert.Empty(t, withDeadline())
+
+	// 顺序下载仍能下载完整的数据
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	leecher = newTorrent(tf, util.GeneratePeerID("leecher"))
+	leecher.SetSequential(true)
+	buf, err := downloadToMemory(ctx, leecher, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, buf)
+}
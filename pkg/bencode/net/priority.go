@@ -0,0 +1,172 @@
+package net
+
+import (
+	"fmt"
+	"time"
+)
+
+// Priority is the download priority of a file or piece
+type Priority int
+
+const (
+	// PrioritySkip does not download a file, except pieces it shares with
+	// files that are downloaded
+	PrioritySkip Priority = iota - 2
+	PriorityLow
+	// PriorityNormal is the default priority
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// DefaultPieceDeadline is the time allowed for each piece of a priority
+// range in sequential mode
+const DefaultPieceDeadline = time.Second
+
+// SequentialWindow is the number of pieces from the first missing one that
+// sequential mode asks for before all others
+const SequentialWindow = 8
+
+// 优先下载的分片范围，第begin个分片的期限为start，之后每个分片晚perPiece
+type priorityRange struct {
+	begin, end int
+	start      time.Time
+	perPiece   time.Duration
+}
+
+// 顺序下载的窗口：第一个缺失的分片期限为start，之后每个分片晚DefaultPieceDeadline
+type sequentialWindow struct {
+	pieces []int
+	start  time.Time
+}
+
+// 将begin和end限制在种子的分片范围内
+func (t *Torrent) newPriorityRange(begin, end int, perPiece time.Duration) priorityRange {
+	return priorityRange{
+		begin:    max(begin, 0),
+		end:      min(end, len(t.PieceSHA)),
+		start:    time.Now(),
+		perPiece: perPiece,
+	}
+}
+
+// 将范围内分片的期限合并到deadlines中，多个范围包含同一个分片时取最早的期限
+func (p priorityRange) mergeInto(deadlines []time.Time) {
+	for index := p.begin; index < p.end; index++ {
+		deadline := p.start.Add(time.Duration(index-p.begin) * p.perPiece)
+		if deadlines[index].IsZero() || deadline.Before(deadlines[index]) {
+			deadlines[index] = deadline
+		}
+	}
+}
+
+// SetPriorityRange asks for the pieces from begin up to end, exclusive,
+// before all others. The piece at begin is due now and each following one
+// perPiece later, pieces still missing when due are requested from several
+// peers at once. The remaining pieces are downloaded rarest first. A new
+// range replaces the previous one, an empty range removes it. The ranges of
+// open Readers are kept besides it. It may be called before or while
+// downloading, for example as a playback cursor moves.
+func (t *Torrent) SetPriorityRange(begin, end int, perPiece time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.priority = t.newPriorityRange(begin, end, perPiece)
+	t.applyPriority()
+}
+
+// SetSequential turns sequential mode on or off. In sequential mode the
+// first SequentialWindow missing pieces, skipped ones left out, are due
+// DefaultPieceDeadline apart and downloaded before the others, the window
+// moves forward as pieces complete. The pieces after it are still downloaded
+// rarest first, so that a slow link does not request every piece from
+// several peers.
+func (t *Torrent) SetSequential(on bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.sequential = on
+	t.window = sequentialWindow{}
+	if on {
+		t.moveWindow()
+	} else {
+		t.applyPriority()
+	}
+}
+
+// 有分片完成时移动顺序下载的窗口
+func (t *Torrent) advanceWindow() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.moveWindow()
+}
+
+// 将顺序下载的窗口移动到第一个缺失的分片，窗口的位置变化时重新计算期限，调用时持有t.m
+func (t *Torrent) moveWindow() {
+	if !t.sequential || t.picker == nil {
+		return
+	}
+	pieces := t.picker.nextWanted(SequentialWindow)
+	if len(pieces) > 0 && len(t.window.pieces) > 0 && pieces[0] == t.window.pieces[0] {
+		return
+	}
+	t.window = sequentialWindow{pieces: pieces, start: time.Now()}
+	t.applyPriority()
+}
+
+// 设置Reader自己的优先范围，不影响其他Reader和SetPriorityRange设置的范围
+func (t *Torrent) setReadRange(r *Reader, begin, end int, perPiece time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.readRanges == nil {
+		t.readRanges = make(map[*Reader]priorityRange)
+	}
+	t.readRanges[r] = t.newPriorityRange(begin, end, perPiece)
+	t.applyPriority()
+}
+
+// Reader关闭时移除它的优先范围
+func (t *Torrent) removeReadRange(r *Reader) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if _, ok := t.readRanges[r]; !ok {
+		return
+	}
+	delete(t.readRanges, r)
+	t.applyPriority()
+}
+
+// 将所有优先范围设置到picker中，调用时持有t.m
+func (t *Torrent) applyPriority() {
+	if t.picker == nil {
+		return
+	}
+	deadlines := make([]time.Time, len(t.PieceSHA))
+	t.priority.mergeInto(deadlines)
+	for i, index := range t.window.pieces {
+		deadline := t.window.start.Add(time.Duration(i) * DefaultPieceDeadline)
+		if deadlines[index].IsZero() || deadline.Before(deadlines[index]) {
+			deadlines[index] = deadline
+		}
+	}
+	for _, p := range t.readRanges {
+		p.mergeInto(deadlines)
+	}
+	t.picker.ClearDeadlines()
+	for index, deadline := range deadlines {
+		if !deadline.IsZero() {
+			t.picker.SetDeadline(index, deadline)
+		}
+	}
+}
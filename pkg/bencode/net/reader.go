@@ -0,0 +1,266 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"io"
+	"sync"
+)
+
+// ReadAhead is the number of pieces after the read position a Reader asks
+// for before they are read
+const ReadAhead = 4
+
+var (
+	// ErrReaderClosed is returned by reads on a closed Reader
+	ErrReaderClosed = errors.New("reader closed")
+	// ErrDownloadFinished is returned by NewReader once Download has
+	// returned and its storage is closed
+	ErrDownloadFinished = errors.New("download finished")
+)
+
+// 下载过程中打开的存储，供Reader读取，由t.m保护
+type readable struct {
+	st      storage.Torrent
+	readers int
+	// Download已经返回，err为它返回的错误。最后一个Reader关闭时关闭存储
+	finished bool
+	err      error
+	// 有分片完成或者状态变化时关闭并替换
+	changed chan struct{}
+}
+
+// 下载开始写入存储，唤醒等待的Reader
+func (t *Torrent) startReading(st storage.Torrent) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.reading.st = st
+	t.notifyReadersLocked()
+}
+
+// 通知Reader有新的分片完成
+func (t *Torrent) notifyReaders() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.notifyReadersLocked()
+}
+
+func (t *Torrent) notifyReadersLocked() {
+	close(t.reading.changed)
+	t.reading.changed = make(chan struct{})
+}
+
+// 下载结束，没有Reader时关闭存储并返回关闭的错误
+func (t *Torrent) finishReading(err error) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	r := &t.reading
+	r.finished, r.err = true, err
+	t.notifyReadersLocked()
+	if r.readers > 0 || r.st == nil {
+		return nil
+	}
+	st := r.st
+	r.st = nil
+	return st.Close()
+}
+
+// 分片是否已经可以读取
+func (t *Torrent) pieceReady(index int) bool {
+	t.m.Lock()
+	st := t.reading.st
+	t.m.Unlock()
+	return st != nil && st.Piece(index).Completed()
+}
+
+// 等待分片下载并校验完成，返回可以读取它的存储
+func (t *Torrent) waitPiece(index int, closed <-chan struct{}) (storage.Torrent, error) {
+	for {
+		t.m.Lock()
+		r := t.reading
+		t.m.Unlock()
+		if r.st != nil && r.st.Piece(index).Completed() {
+			return r.st, nil
+		}
+		if r.finished {
+			if r.err == nil {
+				r.err = fmt.Errorf("piece #%d was not downloaded", index)
+			}
+			return nil, r.err
+		}
+		select {
+		case <-r.changed:
+		case <-closed:
+			return nil, ErrReaderClosed
+		}
+	}
+}
+
+// Reader reads one file of a torrent while it downloads. Reads block until
+// the pieces they cover are downloaded and verified, and ask for those
+// pieces and the ReadAhead pieces after them before all others.
+type Reader struct {
+	t      *Torrent
+	name   string
+	offset int64
+	length int64
+
+	mu  sync.Mutex
+	pos int64
+	// 最近一次设置优先范围时读取的分片
+	piece int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewReader returns a Reader of the file at fileIndex, 0 for a single-file
+// torrent. It may be created before Download is called, and keeps the data
+// readable after Download returns until it is closed.
+func (t *Torrent) NewReader(fileIndex int) (*Reader, error) {
+	files := t.fileList()
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("no file #%d in torrent", fileIndex)
+	}
+	f := files[fileIndex]
+	r := &Reader{t: t, name: f.Path, offset: f.Offset, length: f.Length, piece: -1, closed: make(chan struct{})}
+	err := t.retain()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 增加存储的使用者，存储在最后一个使用者释放且下载结束后关闭
+func (t *Torrent) retain() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.reading.finished && t.reading.st == nil {
+		return ErrDownloadFinished
+	}
+	t.reading.readers++
+	return nil
+}
+
+func (t *Torrent) release() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.reading.readers--
+	if t.reading.readers == 0 && t.reading.finished && t.reading.st != nil {
+		st := t.reading.st
+		t.reading.st = nil
+		return st.Close()
+	}
+	return nil
+}
+
+// Name is the path of the file in the torrent, parts separated by '/'
+func (r *Reader) Name() string {
+	return r.name
+}
+
+// Size is the length of the file
+func (r *Reader) Size() int64 {
+	return r.length
+}
+
+// Read reads from the current position, waiting for the data to download
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isClosed() {
+		return 0, ErrReaderClosed
+	}
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	n, err := r.readPiece(p, r.pos, true)
+	r.pos += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at off, waiting for the data to download. It
+// does not change the position used by Read.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if r.isClosed() {
+		return 0, ErrReaderClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	read := 0
+	for read < len(p) {
+		if off+int64(read) >= r.length {
+			return read, io.EOF
+		}
+		n, err := r.readPiece(p[read:], off+int64(read), false)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Seek sets the position of the next Read
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.pos, fmt.Errorf("seek to negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close unblocks pending reads. The storage is closed with the last Reader
+// once Download has returned.
+func (r *Reader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.t.removeReadRange(r)
+		err = r.t.release()
+	})
+	return err
+}
+
+func (r *Reader) isClosed() bool {
+	select {
+	case <-r.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 读取文件中off处所在的分片中的数据，最多读到分片或文件的末尾。
+// sequential为true时将该Reader的优先范围移动到该分片
+func (r *Reader) readPiece(p []byte, off int64, sequential bool) (int, error) {
+	t := r.t
+	abs := r.offset + off
+	index := int(abs / int64(t.PieceLength))
+	begin := abs - int64(index)*int64(t.PieceLength)
+	n := int(min(int64(len(p)), int64(t.calculatePieceSize(index))-begin, r.length-off))
+	if sequential && index != r.piece {
+		r.piece = index
+		t.setReadRange(r, index, index+1+ReadAhead, DefaultPieceDeadline)
+	} else if !sequential && !t.pieceReady(index) {
+		t.setReadRange(r, index, index+1, 0)
+	}
+	st, err := t.waitPiece(index, r.closed)
+	if err != nil {
+		return 0, err
+	}
+	return st.Piece(index).ReadAt(p[:n], begin)
+}
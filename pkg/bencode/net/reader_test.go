@@ -0,0 +1,160 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+// 在下载开始前创建Reader，边下载边读取第二个文件
+func TestReaderStreamsFile(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 6*MaxBlockSize+100)
+	tf.files = []metainfo.FileInfo{
+		{Length: MaxBlockSize + 7, Path: []string{"a"}},
+		{Length: 4 * MaxBlockSize, Path: []string{"dir", "b"}},
+		{Length: MaxBlockSize + 93, Path: []string{"c"}},
+	}
+	tf.Storage = storage.NewMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	tr, err := tf.NewTorrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.NewReader(3)
+	assert.Error(t, err)
+	r, err := tr.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "dir/b", r.Name())
+	assert.Equal(t, int64(4*MaxBlockSize), r.Size())
+	want := data[MaxBlockSize+7 : 5*MaxBlockSize+7]
+
+	done := make(chan error, 1)
+	go func() { done <- tr.Download(ctx, t.TempDir()) }()
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, r)
+	assert.NoError(t, err)
+	assert.Equal(t, want, buf.Bytes())
+
+	// 下载结束后仍然可以读取，直到Reader关闭
+	assert.NoError(t, <-done)
+	pos, err := r.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4*MaxBlockSize-10), pos)
+	tail, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, want[len(want)-10:], tail)
+	part := make([]byte, MaxBlockSize+20)
+	n, err := r.ReadAt(part, MaxBlockSize-10)
+	assert.NoError(t, err)
+	assert.Equal(t, len(part), n)
+	assert.Equal(t, want[MaxBlockSize-10:2*MaxBlockSize+10], part)
+	n, err = r.ReadAt(part, int64(len(want)-5))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 5, n)
+
+	assert.NoError(t, r.Close())
+	_, err = r.Read(part)
+	assert.ErrorIs(t, err, ErrReaderClosed)
+	_, err = tr.NewReader(0)
+	assert.ErrorIs(t, err, ErrDownloadFinished)
+}
+
+// 关闭Reader会结束正在等待数据的读取，下载失败时读取返回下载的错误
+func TestReaderUnblocks(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	tf.Storage = storage.NewMemory()
+	tr, err := tf.NewTorrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tr.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, r.Close())
+	assert.ErrorIs(t, <-read, ErrReaderClosed)
+
+	r, err = tr.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() {
+		_, err := r.ReadAt(make([]byte, 10), MaxBlockSize)
+		read <- err
+	}()
+	assert.ErrorIs(t, tr.Download(ctx, t.TempDir()), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-read, context.DeadlineExceeded)
+}
+
+// 每个Reader有自己的优先范围，不会覆盖其他Reader和SetPriorityRange设置的范围
+func TestReaderPriorityRanges(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 10*MaxBlockSize)
+	tf.Storage = storage.NewMemory()
+	tr, err := tf.NewTorrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.m.Lock()
+	tr.picker = NewPiecePicker(len(tf.PieceSHA))
+	tr.m.Unlock()
+	tr.SetPriorityRange(8, 10, time.Hour)
+	withDeadline := func() []int {
+		tr.picker.mu.Lock()
+		defer tr.picker.mu.Unlock()
+		var pieces []int
+		for index, deadline := range tr.picker.deadline {
+			if !deadline.IsZero() {
+				pieces = append(pieces, index)
+			}
+		}
+		return pieces
+	}
+
+	read := make(chan error, 2)
+	first, err := tr.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = first.Seek(2*MaxBlockSize, io.SeekStart)
+	assert.NoError(t, err)
+	go func() {
+		_, err := first.Read(make([]byte, 10))
+		read <- err
+	}()
+	second, err := tr.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, err := second.Read(make([]byte, 10))
+		read <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]int{0, 1, 2, 3, 4, 5, 6, 8, 9}, withDeadline())
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, first.Close())
+	assert.ErrorIs(t, <-read, ErrReaderClosed)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 8, 9}, withDeadline())
+	assert.NoError(t, second.Close())
+	assert.ErrorIs(t, <-read, ErrReaderClosed)
+	assert.Equal(t, []int{8, 9}, withDeadline())
+}
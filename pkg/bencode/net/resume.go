@@ -0,0 +1,259 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/model"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ResumeInterval is how often the resume file is saved while downloading
+const ResumeInterval = 30 * time.Second
+
+// ResumeData is the saved state of a download, it lets an interrupted
+// download continue from the pieces it already has. Fields are declared in
+// the sorted order of their keys.
+type ResumeData struct {
+	Downloaded int64        `bencode:"downloaded"`
+	Files      []ResumeFile `bencode:"files,omitempty"`
+	InfoHash   string       `bencode:"info hash"`
+	// Peers are the peers seen, in compact form
+	Peers string `bencode:"peers,omitempty"`
+	// Pieces is the bitfield of the completed pieces
+	Pieces   string `bencode:"pieces"`
+	Uploaded int64  `bencode:"uploaded"`
+}
+
+// ResumeFile is the size and modification time of a file of the torrent
+// when the resume data was saved
+type ResumeFile struct {
+	Length int64  `bencode:"length"`
+	Mtime  int64  `bencode:"mtime"`
+	Path   string `bencode:"path"`
+}
+
+// LoadResume reads a resume file, it returns nil and no error when the file
+// does not exist
+func LoadResume(path string) (*ResumeData, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := new(ResumeData)
+	err = model.UnmarshalBen(bytes.NewReader(raw), r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Save writes the resume data to path, replacing the previous file only
+// once the new one is complete
+func (r *ResumeData) Save(path string) error {
+	var buf bytes.Buffer
+	if model.MarshalBen(&buf, r) <= 0 {
+		return model.ErrEncode
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// 记录当前的下载状态：已完成的分片、文件的状态、见过的peer和传输量
+func (t *Torrent) resumeData(st storage.Torrent) (*ResumeData, error) {
+	// 先写回数据再记录，避免恢复时信任还没有落盘的分片
+	if s, ok := st.(storage.Syncer); ok {
+		err := s.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pieces := NewBitfield(len(t.PieceSHA))
+	for index := range t.PieceSHA {
+		if st.Piece(index).Completed() {
+			pieces.SetPiece(index)
+		}
+	}
+	r := &ResumeData{
+		Downloaded: t.downloaded.Load(),
+		InfoHash:   string(t.InfoSHA[:]),
+		Pieces:     string(pieces),
+		Uploaded:   t.uploaded.Load(),
+	}
+	files, err := currentFiles(st)
+	if err != nil {
+		return nil, err
+	}
+	r.Files = files
+	t.m.Lock()
+	for _, p := range t.Peers {
+		if p.Ip.To4() != nil {
+			r.Peers += pexPeer{ip: p.Ip, port: p.Port}.compact()
+		}
+	}
+	t.m.Unlock()
+	return r, nil
+}
+
+// 从恢复数据中标记已完成的分片。所在文件的长度和修改时间都与记录一致的分片直接信任，
+// 其余记录为完成的分片重新校验。返回记录中见过的peer
+func (t *Torrent) resume(r *ResumeData, st storage.Torrent, info []ResumeFile) ([]*PeerInfo, error) {
+	if r.InfoHash != string(t.InfoSHA[:]) {
+		return nil, errors.New("resume data belongs to another torrent")
+	}
+	pieces := Bitfield(r.Pieces)
+	if len(pieces) != len(NewBitfield(len(t.PieceSHA))) {
+		return nil, fmt.Errorf("resume data has %d bytes of pieces, expected %d", len(pieces), len(NewBitfield(len(t.PieceSHA))))
+	}
+	changed := changedFiles(r.Files, info)
+	trusted, rechecked := 0, 0
+	for index, hash := range t.PieceSHA {
+		if !pieces.HasPiece(index) {
+			continue
+		}
+		piece := st.Piece(index)
+		if t.pieceTouches(index, changed) {
+			buf := make([]byte, t.calculatePieceSize(index))
+			_, err := piece.ReadAt(buf, 0)
+			if err != nil || checkIntegrity(&pieceWork{index, hash, len(buf)}, buf) != nil {
+				continue
+			}
+			rechecked++
+		} else {
+			trusted++
+		}
+		err := piece.MarkComplete()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.downloaded.Add(r.Downloaded)
+	t.uploaded.Add(r.Uploaded)
+	log.Printf("resumed %d pieces, %d of them rechecked\n", trusted+rechecked, rechecked)
+	return buildPeerInfo([]byte(r.Peers)), nil
+}
+
+// 与记录相比发生了变化的文件，返回每个文件在种子数据中的范围。
+// 记录或存储中没有文件状态时（例如内存存储）无法判断，认为所有文件都变化了
+func changedFiles(saved, now []ResumeFile) [][2]int64 {
+	if len(saved) == 0 || len(now) == 0 {
+		return [][2]int64{{0, math.MaxInt64}}
+	}
+	var changed [][2]int64
+	var offset int64
+	for i, f := range now {
+		if i >= len(saved) || saved[i] != f {
+			changed = append(changed, [2]int64{offset, offset + f.Length})
+		}
+		offset += f.Length
+	}
+	return changed
+}
+
+// 分片是否与变化了的文件有重叠
+func (t *Torrent) pieceTouches(index int, changed [][2]int64) bool {
+	begin, end := t.calculateBoundsForPiece(index)
+	for _, r := range changed {
+		if int64(begin) < r[1] && r[0] < int64(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// 存储中各个文件当前的状态，尚未创建的文件长度和修改时间都为0
+func currentFiles(st storage.Torrent) ([]ResumeFile, error) {
+	fs, ok := st.(storage.FileStater)
+	if !ok {
+		return nil, nil
+	}
+	states, err := fs.FileStates()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]ResumeFile, len(states))
+	for i, s := range states {
+		files[i] = ResumeFile{Length: s.Length, Path: s.Path}
+		if !s.ModTime.IsZero() {
+			files[i].Mtime = s.ModTime.UnixNano()
+		}
+	}
+	return files, nil
+}
+
+// 读取恢复文件并标记已完成的分片，恢复文件不存在时什么也不做
+func (t *Torrent) loadResume(tf *TorrentFile, st storage.Torrent) error {
+	r, err := LoadResume(tf.ResumeFile)
+	if err != nil || r == nil {
+		return err
+	}
+	files, err := currentFiles(st)
+	if err != nil {
+		return err
+	}
+	peers, err := t.resume(r, st, files)
+	if err != nil {
+		return err
+	}
+	tf.peers = append(tf.peers, peers...)
+	return nil
+}
+
+// 下载期间每ResumeInterval保存一次恢复文件，返回的函数停止定期保存并做最后一次保存
+func (t *Torrent) saveResumePeriodically(path string, st storage.Torrent) (stop func() error) {
+	save := func() error {
+		r, err := t.resumeData(st)
+		if err != nil {
+			return err
+		}
+		return r.Save(path)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tk := time.NewTicker(ResumeInterval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				err := save()
+				if err != nil {
+					log.Println("save resume file:", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() error {
+		cancel()
+		<-done
+		return save()
+	}
+}
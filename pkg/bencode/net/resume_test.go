@@ -0,0 +1,129 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	r := &ResumeData{
+		Downloaded: 1 << 40,
+		Files:      []ResumeFile{{Length: 3, Mtime: time.Now().UnixNano(), Path: "a"}, {Length: 0, Path: "b"}},
+		InfoHash:   string(make([]byte, SHALEN)),
+		Peers:      "\x7f\x00\x00\x01\x1a\xe1",
+		Pieces:     "\xa0\x00",
+		Uploaded:   42,
+	}
+	path := filepath.Join(t.TempDir(), "t.resume")
+	assert.NoError(t, r.Save(path))
+	got, err := LoadResume(path)
+	assert.NoError(t, err)
+	assert.Equal(t, r, got)
+
+	got, err = LoadResume(filepath.Join(t.TempDir(), "missing"))
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+// 重新打开存储并读取恢复文件，返回完成的分片
+func resumedPieces(t *testing.T, tf *TorrentFile, dir string) []bool {
+	tr := newTorrent(tf, util.GeneratePeerID("resume"))
+	st, err := tf.openStorage(storage.NewFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	assert.NoError(t, tr.loadResume(tf, st))
+	done := make([]bool, len(tf.PieceSHA))
+	for index := range done {
+		done[index] = st.Piece(index).Completed()
+	}
+	return done
+}
+
+// 完成的下载保存恢复文件，再次下载时不需要peer；文件修改时间变化后重新校验
+func TestResumeDownload(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 4*MaxBlockSize+5)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	dir := t.TempDir()
+	tf.ResumeFile = filepath.Join(dir, tf.FileName+".resume")
+	assert.NoError(t, tf.DownloadToFile(dir, 10*time.Second))
+
+	r, err := LoadResume(tf.ResumeFile)
+	assert.NoError(t, err)
+	if r == nil {
+		t.Fatal("no resume file saved")
+	}
+	assert.Equal(t, string(tf.InfoSHA[:]), r.InfoHash)
+	assert.Equal(t, "\xf8", r.Pieces)
+	assert.Equal(t, int64(len(data)), r.Downloaded)
+	assert.Len(t, r.Files, 1)
+	assert.Equal(t, int64(len(data)), r.Files[0].Length)
+	assert.Len(t, r.Peers, 6)
+
+	// 所有分片都已完成，不连接peer也能结束
+	tf.peers = nil
+	assert.NoError(t, tf.DownloadToFile(dir, time.Second))
+
+	// 修改时间没有变化的文件直接信任
+	path := filepath.Join(dir, tf.FileName)
+	mtime := time.Unix(0, r.Files[0].Mtime)
+	corrupt := append([]byte(nil), data...)
+	corrupt[MaxBlockSize+1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+	assert.Equal(t, []bool{true, true, true, true, true}, resumedPieces(t, tf, dir))
+
+	// 修改时间变化后重新校验，损坏的分片需要重新下载
+	later := mtime.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	assert.Equal(t, []bool{true, false, true, true, true}, resumedPieces(t, tf, dir))
+}
+
+// 属于其他种子的恢复文件不会标记任何分片
+func TestResumeOtherTorrent(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, 2*MaxBlockSize)
+	dir := t.TempDir()
+	tf.ResumeFile = filepath.Join(dir, "other.resume")
+	r := &ResumeData{InfoHash: string(make([]byte, SHALEN)), Pieces: "\xc0"}
+	assert.NoError(t, r.Save(tf.ResumeFile))
+	tr := newTorrent(tf, util.GeneratePeerID("resume"))
+	st, err := tf.openStorage(storage.NewFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	assert.Error(t, tr.loadResume(tf, st))
+	assert.False(t, st.Piece(0).Completed())
+}
+
+// 没有文件状态的存储无法判断数据是否变化，记录的分片都重新校验
+func TestResumeWithoutFileStates(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 3*MaxBlockSize)
+	r := &ResumeData{InfoHash: string(tf.InfoSHA[:]), Pieces: "\xe0"}
+	tr := newTorrent(tf, util.GeneratePeerID("resume"))
+	st, err := storage.NewMemory().OpenTorrent(tf.info(), tf.InfoSHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.resume(r, st, nil)
+	assert.NoError(t, err)
+	for index := range tf.PieceSHA {
+		assert.False(t, st.Piece(index).Completed())
+	}
+
+	st = memoryStorage(t, tf, data)
+	_, err = tr.resume(r, st, nil)
+	assert.NoError(t, err)
+	for index := range tf.PieceSHA {
+		assert.True(t, st.Piece(index).Completed())
+	}
+}
@@ -0,0 +1,230 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"log"
+	"net"
+	"time"
+)
+
+// AnnounceRetry is how long to wait before retrying a failed tracker announce
+const AnnounceRetry = time.Minute
+
+// 在addr上接收其他peer的连接并为其提供分片数据，ctx结束时关闭监听
+func (t *Torrent) listen(ctx context.Context, addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := l.Addr().(*net.TCPAddr); ok {
+		t.port = tcp.Port
+	}
+	context.AfterFunc(ctx, func() { l.Close() })
+	t.choker.start(ctx)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go t.handleIncoming(ctx, conn)
+		}
+	}()
+	return l, nil
+}
+
+// 完成被动握手后进入上传循环，直到连接出错或ctx结束
+func (t *Torrent) handleIncoming(ctx context.Context, conn net.Conn) {
+	if t.banned(conn.RemoteAddr()) {
+		conn.Close()
+		return
+	}
+	res, err := acceptHandShake(conn, t.InfoSHA, t.PeerID)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	peer := new(PeerInfo)
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer.Ip = addr.IP
+		peer.Port = uint16(addr.Port)
+	}
+	c := &PeerConn{
+		Conn:       conn,
+		Choked:     true,
+		BitField:   NewBitfield(len(t.PieceSHA)),
+		peer:       peer,
+		peerId:     res.peerID,
+		infoSHA:    t.InfoSHA,
+		reserved:   res.reserved,
+		numPieces:  len(t.PieceSHA),
+		maxMessage: t.maxMessage,
+		amChoking:  true,
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	err = t.upload(c)
+	if err != nil {
+		log.Println("stop uploading to", conn.RemoteAddr(), err)
+	}
+}
+
+// 发送本地位图后在当前协程中读取并处理对方的消息，为其request返回对应的分片数据
+func (t *Torrent) upload(c *PeerConn) error {
+	err := t.sendBitfield(c)
+	if err != nil {
+		return err
+	}
+	err = t.startExtensions(c)
+	if err != nil {
+		return err
+	}
+	defer t.startPex(c, false)()
+	t.choker.add(c)
+	defer t.choker.remove(c)
+	err = t.grantAllowedFast(c)
+	if err != nil {
+		return err
+	}
+	return t.readLoop(c)
+}
+
+// 拥有全部分片且对方支持快速扩展时用HaveAll代替位图
+func (t *Torrent) sendBitfield(c *PeerConn) error {
+	t.m.Lock()
+	field := append(Bitfield(nil), t.bitfield...)
+	t.m.Unlock()
+	msg := NewBitfieldMessage(field)
+	if c.supportsFast() && field.Equal(fullBitfield(len(t.PieceSHA))) {
+		msg = NewHaveAllMessage()
+	}
+	_, err := c.WriteMessage(msg)
+	return err
+}
+
+// 本地是否拥有分片，下载时分片写入存储之后才算拥有
+func (t *Torrent) hasPiece(index int) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.bitfield.HasPiece(index)
+}
+
+// 将已经写入存储的分片标记为拥有，并通知正在下载的连接的对方，之后可以上传给他们
+func (t *Torrent) addPiece(index int) {
+	t.m.Lock()
+	t.bitfield.SetPiece(index)
+	conns := make([]*PeerConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.m.Unlock()
+	// 不读取的对方不会阻塞写入分片的协程
+	for _, c := range conns {
+		go c.SendHave(index)
+	}
+}
+
+// 返回可以读取分片的存储，本地没有该分片时返回nil
+func (t *Torrent) pieceStorage(index int) storage.Torrent {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.storage == nil || !t.bitfield.HasPiece(index) {
+		return nil
+	}
+	return t.storage
+}
+
+func (t *Torrent) sendBlock(c *PeerConn, msg *Message) error {
+	index, begin, length, err := ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	_, granted := c.grantedFast[index]
+	st := t.pieceStorage(index)
+	if st == nil || (c.choking() && !granted) {
+		if c.supportsFast() {
+			_, err = c.WriteMessage(NewRejectMessage(index, begin, length))
+		}
+		return err
+	}
+	if length <= 0 || length > MaxBlockSize || begin < 0 || begin+length > t.calculatePieceSize(index) {
+		return fmt.Errorf("invalid request for piece #%d: begin %d length %d", index, begin, length)
+	}
+	block := make([]byte, length)
+	_, err = st.Piece(index).ReadAt(block, int64(begin))
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteMessage(NewPieceMessage(index, begin, block))
+	if err != nil {
+		return err
+	}
+	t.uploaded.Add(int64(length))
+	c.uploaded.Add(int64(length))
+	return nil
+}
+
+// 并行校验本地数据中的分片，通过校验的分片标记为已拥有，有分片不匹配时返回错误
+func (t *Torrent) verifyPieces() error {
+	good, err := t.recheck(context.Background(), t.storage, 0, nil)
+	if err != nil {
+		return err
+	}
+	bad := -1
+	for index := range t.PieceSHA {
+		if !good.HasPiece(index) {
+			if bad < 0 {
+				bad = index
+			}
+			continue
+		}
+		err = t.storage.Piece(index).MarkComplete()
+		if err != nil {
+			return err
+		}
+		t.addPiece(index)
+	}
+	if bad >= 0 {
+		return fmt.Errorf("Index %d failed integrity check", bad)
+	}
+	return nil
+}
+
+// 做种时定期向tracker汇报，首次汇报completed事件，ctx结束时汇报stopped。
+// 没有tracker时（只通过DHT或LSD做种）只等待ctx结束
+func (t *Torrent) seedAnnounce(ctx context.Context, tf *TorrentFile, port int) {
+	if len(tf.trackers()) == 0 && len(tf.TracerUrl) == 0 {
+		<-ctx.Done()
+		return
+	}
+	event := EventCompleted
+	for {
+		wait := AnnounceRetry
+		trsp, _, err := tf.announce(t.PeerID, announceParams{
+			port:     port,
+			uploaded: int(t.uploaded.Load()),
+			event:    event,
+		})
+		if err != nil {
+			log.Println("announce failed:", err)
+		} else {
+			event = ""
+			if trsp.Interval > 0 {
+				wait = time.Duration(trsp.Interval) * time.Second
+			}
+		}
+		select {
+		case <-ctx.Done():
+			tf.announce(t.PeerID, announceParams{
+				port:     port,
+				uploaded: int(t.uploaded.Load()),
+				event:    EventStopped,
+			})
+			return
+		case <-time.After(wait):
+		}
+	}
+}
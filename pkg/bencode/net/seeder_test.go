@@ -0,0 +1,178 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 构造一个内存中的种子，数据长度不是分片长度的整数倍
+func newTestTorrentFile(t *testing.T, pieceLen, length int) (*TorrentFile, []byte) {
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := &TorrentFile{FileName: "data.bin", FileLen: length, PieceLen: pieceLen}
+	for begin := 0; begin < length; begin += pieceLen {
+		tf.PieceSHA = append(tf.PieceSHA, sha1.Sum(data[begin:min(begin+pieceLen, length)]))
+	}
+	tf.InfoSHA = sha1.Sum([]byte(t.Name()))
+	return tf, data
+}
+
+func peerFromAddr(t *testing.T, addr string) *PeerInfo {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &PeerInfo{Ip: net.ParseIP(host), Port: uint16(p)}
+}
+
+// 写入了完整数据的内存存储
+func memoryStorage(t *testing.T, tf *TorrentFile, data []byte) storage.Torrent {
+	st, err := storage.NewMemory().OpenTorrent(tf.info(), tf.InfoSHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for begin := 0; begin < len(data); begin += tf.PieceLen {
+		_, err = st.Piece(begin/tf.PieceLen).WriteAt(data[begin:min(begin+tf.PieceLen, len(data))], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return st
+}
+
+// 下载到内存存储中，返回下载的全部数据
+func downloadToMemory(ctx context.Context, tr *Torrent, tf *TorrentFile) ([]byte, error) {
+	st, err := storage.NewMemory().OpenTorrent(tf.info(), tf.InfoSHA)
+	if err != nil {
+		return nil, err
+	}
+	err = tr.download(ctx, tf, st)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, tf.FileLen)
+	for index := range tf.PieceSHA {
+		if !st.Piece(index).Completed() {
+			return nil, fmt.Errorf("piece #%d not marked complete", index)
+		}
+		piece := make([]byte, tr.calculatePieceSize(index))
+		_, err = st.Piece(index).ReadAt(piece, 0)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, piece...)
+	}
+	return buf, nil
+}
+
+func TestSeedServesPieces(t *testing.T) {
+	tf, data := newTestTorrentFile(t, 2*MaxBlockSize+100, 5*MaxBlockSize)
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	assert.NoError(t, seeder.verifyPieces())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := seeder.listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := peerFromAddr(t, l.Addr().String())
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	c, err := NewConn(peer, tf.InfoSHA, leecher.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.startReader(c)()
+	assert.NoError(t, c.SendInterested())
+
+	got := make([]byte, 0, len(data))
+	for index, hash := range tf.PieceSHA {
+		assert.True(t, c.HasPiece(index))
+		pw := &pieceWork{index, hash, seeder.calculatePieceSize(index)}
+		buf, err := attemptDownloadPiece(c, pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, checkIntegrity(pw, buf))
+		got = append(got, buf...)
+	}
+	assert.Equal(t, data, got)
+	assert.Equal(t, int64(len(data)), seeder.uploaded.Load())
+}
+
+func TestVerifyPiecesMismatch(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 3*MaxBlockSize)
+	data[MaxBlockSize+1] ^= 0xff
+	seeder := newTorrent(tf, util.GeneratePeerID("seeder"))
+	seeder.storage = memoryStorage(t, tf, data)
+	assert.Error(t, seeder.verifyPieces())
+	assert.True(t, seeder.bitfield.HasPiece(0))
+	assert.False(t, seeder.bitfield.HasPiece(1))
+}
+
+// 下载时分片写入存储后向所有连接发送have，之后可以上传给unchoke的peer
+func TestDownloadingServesWrittenPieces(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 3*MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("leecher"))
+	st, err := storage.NewMemory().OpenTorrent(tf.info(), tf.InfoSHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.storage = st
+	c, _, msgs := newPipeConn(t, tr)
+	c.reserved[fastByte] |= fastBit
+	c.amChoking = false
+	tr.addConn(c)
+
+	// 还没有写入的分片被拒绝
+	req := NewRequestMessage(1, 0, MaxBlockSize)
+	assert.NoError(t, tr.sendBlock(c, &req))
+	assert.Equal(t, MsgReject, nextMessage(t, msgs).ID)
+
+	_, err = st.Piece(1).WriteAt(data[MaxBlockSize:2*MaxBlockSize], 0)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Piece(1).MarkComplete())
+	tr.addPiece(1)
+	msg := nextMessage(t, msgs)
+	assert.Equal(t, MsgHave, msg.ID)
+	index, err := GetHaveIndex(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, index)
+
+	assert.NoError(t, tr.sendBlock(c, &req))
+	msg = nextMessage(t, msgs)
+	assert.Equal(t, MsgPiece, msg.ID)
+	assert.Equal(t, data[MaxBlockSize:2*MaxBlockSize], msg.Payload[8:])
+	assert.Equal(t, int64(MaxBlockSize), tr.uploaded.Load())
+}
+
+// 没有tracker时不汇报，也不会每隔AnnounceRetry记录一次失败
+func TestSeedAnnounceWithoutTracker(t *testing.T) {
+	tf, _ := newTestTorrentFile(t, MaxBlockSize, MaxBlockSize)
+	tr := newTorrent(tf, util.GeneratePeerID("seeder"))
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tr.seedAnnounce(ctx, tf, 6881)
+	// 恢复输出之后其他测试留下的协程不再写入logs
+	log.SetOutput(os.Stderr)
+	assert.NotContains(t, logs.String(), "announce failed")
+}
@@ -1,14 +1,19 @@
 package net
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha1"
+	"errors"
 	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/dht"
+	"github.com/shoggothforever/torcore/pkg/bencode/lsd"
+	"github.com/shoggothforever/torcore/pkg/bencode/magnet"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
 	"github.com/shoggothforever/torcore/pkg/bencode/model"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
 	"github.com/shoggothforever/torcore/pkg/bencode/util"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,25 +32,54 @@ const (
 )
 
 type TorrentFile struct {
-	Announce  string
-	InfoSHA   [SHALEN]byte
-	FileName  string
-	FileLen   int
-	PieceLen  int
-	PieceSHA  [][SHALEN]byte
-	TracerUrl string
-}
-
-type benInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
-}
-
-type benTorrent struct {
-	Announce string  `bencode:"announce"`
-	Info     benInfo `bencode:"info"`
+	Announce     string
+	AnnounceList [][]string
+	InfoSHA      [SHALEN]byte
+	FileName     string
+	FileLen      int
+	PieceLen     int
+	PieceSHA     [][SHALEN]byte
+	WebSeeds     []string
+	TracerUrl    string
+	// 私有种子只能通过tracker获取peer，不使用PEX等其他方式 (BEP 27)
+	Private bool
+	// 编码后的info字典，用于通过ut_metadata提供给其他peer
+	infoBytes []byte
+	// Extensions are extra BEP 10 extensions offered to every peer of the torrent
+	Extensions []Extension
+	// DHT is used to find peers alongside the trackers when set, it is not
+	// used for private torrents
+	DHT *dht.Server
+	// LSD finds peers on the local network when set, it is not used for
+	// private torrents
+	LSD *lsd.Service
+	// UploadSlots is the number of peers unchoked at the same time, 0 means
+	// DefaultUploadSlots
+	UploadSlots int
+	// PeerTimeout is how long a peer may stay silent before its connection is
+	// closed, 0 means DefaultPeerTimeout
+	PeerTimeout time.Duration
+	// MaxMessageLen bounds the length of the messages peers may send, 0
+	// means MaxMessageLen. Bitfields may always cover every piece
+	MaxMessageLen int
+	// Storage keeps the piece data, nil means plain files below the
+	// directory given to DownloadToFile or Seed
+	Storage storage.Storage
+	// Port is the TCP port Download accepts peer connections on while
+	// downloading, 0 means any free port
+	Port int
+	// ResumeFile is where DownloadToFile saves its progress, a download
+	// started again with the same file continues from the saved pieces.
+	// Empty means no resume file
+	ResumeFile string
+	// 多文件种子中的文件，单文件种子为空
+	files []metainfo.FileInfo
+	// Select are the indices of the files to download, the others are
+	// skipped. It is set from the so parameter of a magnet link, nil means
+	// every file
+	Select []int
+	// 开始下载时直接连接的peers，例如magnet链接中的x.pe
+	peers []*PeerInfo
 }
 
 type TrackerResp struct {
@@ -53,88 +87,130 @@ type TrackerResp struct {
 	Peers    string `bencode:"peers"`
 }
 
-func (bi *benInfo) hash() ([SHALEN]byte, error) {
-	var buf bytes.Buffer
-	model.MarshalBen(&buf, *bi)
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
-}
-
-func (bi *benInfo) splitPieceSHA() ([][SHALEN]byte, error) {
-	buf := []byte(bi.Pieces)
-	numHashes := len(buf) / SHALEN
-	hashes := make([][SHALEN]byte, numHashes)
-	for i := 0; i < numHashes; i++ {
-		copy(hashes[i][:], buf[i*SHALEN:min((i+1)*SHALEN, len(buf))])
-	}
-	return hashes, nil
-}
-func (bt *benTorrent) toTorrentFile() (*TorrentFile, error) {
-	infoHash, err := bt.Info.hash()
-	if err != nil {
-		return nil, err
-	}
+func toTorrentFile(mi *metainfo.MetaInfo) (*TorrentFile, error) {
+	infoHash := mi.InfoHash()
 	fmt.Println("calc info hash ", infoHash)
-	PieceSHA, err := bt.Info.splitPieceSHA()
+	PieceSHA, err := mi.Info.PieceHashes()
 	if err != nil {
 		return nil, err
 	}
 	//fmt.Println("calc piece hashed  ", PieceSHA)
 	t := &TorrentFile{
-		Announce: bt.Announce,
-		InfoSHA:  infoHash,
-		PieceSHA: PieceSHA,
-		PieceLen: bt.Info.PieceLength,
-		FileLen:  bt.Info.Length,
-		FileName: bt.Info.Name,
+		Announce:     mi.Announce,
+		AnnounceList: mi.AnnounceList,
+		InfoSHA:      infoHash,
+		PieceSHA:     PieceSHA,
+		PieceLen:     mi.Info.PieceLength,
+		FileLen:      mi.Info.TotalLength(),
+		FileName:     mi.Info.Name,
+		WebSeeds:     mi.UrlList,
+		Private:      mi.Info.Private != 0,
+		infoBytes:    mi.InfoBytes,
+		files:        mi.Info.Files,
 	}
 	return t, nil
 }
 func UnmarshalTorrentFile(r io.Reader) (*TorrentFile, error) {
-	bt := new(benTorrent)
-	err := model.UnmarshalBen(r, bt)
+	mi, err := metainfo.Load(r)
 	if err != nil {
 		return nil, err
 	}
-	//fmt.Printf("\n%+v\n", *bt)
-	return bt.toTorrentFile()
+	return toTorrentFile(mi)
+}
+
+// tracker汇报事件
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
 
+// 向tracker汇报的下载状态
+type announceParams struct {
+	port       int
+	uploaded   int
+	downloaded int
+	left       int
+	event      string
+}
+
+// 所有tracker地址，announce在前，announce-list按层级顺序去重
+func (tf *TorrentFile) trackers() []string {
+	var urls []string
+	seen := make(map[string]struct{})
+	add := func(u string) {
+		if _, ok := seen[u]; ok || len(u) == 0 {
+			return
+		}
+		seen[u] = struct{}{}
+		urls = append(urls, u)
+	}
+	add(tf.Announce)
+	for _, tier := range tf.AnnounceList {
+		for _, u := range tier {
+			add(u)
+		}
+	}
+	return urls
 }
 
 // 获取资源追踪站点网址信息
-func (tf *TorrentFile) buildTrackerUrl(peerID [IDLEN]byte) (string, error) {
+func (tf *TorrentFile) buildTrackerUrl(announce string, peerID [IDLEN]byte, p announceParams) (string, error) {
 	if len(tf.TracerUrl) != 0 {
 		return tf.TracerUrl, nil
 	}
-	base, err := url.Parse(tf.Announce)
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
 	params := url.Values{
 		"info_hash":  []string{string(tf.InfoSHA[:])},
 		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{PeerPort},
-		"downloaded": []string{"0"},
-		"uploaded":   []string{"0"},
+		"port":       []string{strconv.Itoa(p.port)},
+		"downloaded": []string{strconv.Itoa(p.downloaded)},
+		"uploaded":   []string{strconv.Itoa(p.uploaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(tf.FileLen)},
+		"left":       []string{strconv.Itoa(p.left)},
+	}
+	if len(p.event) != 0 {
+		params.Set("event", p.event)
 	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-// 从种子文件获取peers信息，可能需要定时调用来更新peers信息
-func (tf *TorrentFile) getPeers(peerID [IDLEN]byte) ([]*PeerInfo, error) {
-	url, err := tf.buildTrackerUrl(peerID)
-	if err != nil {
-		fmt.Println("failed to build tracker url: ", err.Error())
-		return nil, err
+// 依次向各个tracker汇报，返回第一个成功响应的tracker给出的peers
+func (tf *TorrentFile) announce(peerID [IDLEN]byte, p announceParams) (*TrackerResp, []*PeerInfo, error) {
+	trackers := tf.trackers()
+	if len(tf.TracerUrl) != 0 {
+		trackers = []string{tf.TracerUrl}
 	}
+	if len(trackers) == 0 {
+		return nil, nil, errors.New("torrent has no tracker")
+	}
+	var lastErr error
+	for _, tracker := range trackers {
+		url, err := tf.buildTrackerUrl(tracker, peerID, p)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		trsp, err := requestTracker(url)
+		if err != nil {
+			fmt.Println("failed to announce to tracker: ", err.Error())
+			lastErr = err
+			continue
+		}
+		return trsp, buildPeerInfo([]byte(trsp.Peers)), nil
+	}
+	return nil, nil, lastErr
+}
+
+func requestTracker(url string) (*TrackerResp, error) {
 	fmt.Println("get tracker url " + url)
 	cli := &http.Client{Timeout: 15 * time.Second}
 	resp, err := cli.Get(url)
 	if err != nil {
-		fmt.Println("failed to connect to Tracker: ", err.Error())
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -143,20 +219,43 @@ func (tf *TorrentFile) getPeers(peerID [IDLEN]byte) ([]*PeerInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return buildPeerInfo([]byte(trsp.Peers)), nil
+	return trsp, nil
+}
+
+// 从种子文件获取peers信息，可能需要定时调用来更新peers信息
+func (tf *TorrentFile) getPeers(peerID [IDLEN]byte, port int) ([]*PeerInfo, error) {
+	_, peers, err := tf.announce(peerID, announceParams{port: port, left: tf.FileLen})
+	if err != nil {
+		fmt.Println("failed to get peers from tracker: ", err.Error())
+		return nil, err
+	}
+	return peers, nil
+}
+
+// 存储所需的种子信息
+func (tf *TorrentFile) info() *metainfo.Info {
+	info := &metainfo.Info{Name: tf.FileName, PieceLength: tf.PieceLen, Files: tf.files}
+	if len(tf.files) == 0 {
+		info.Length = tf.FileLen
+	}
+	return info
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
+// 打开种子的存储，未指定Storage时使用fallback
+func (tf *TorrentFile) openStorage(fallback storage.Storage) (storage.Torrent, error) {
+	st := tf.Storage
+	if st == nil {
+		st = fallback
+	}
+	return st.OpenTorrent(tf.info(), tf.InfoSHA)
+}
+
+// DownloadToFile downloads a torrent into its files below path, or into
+// tf.Storage when set. Every piece is written as soon as it is verified.
 func (tf *TorrentFile) DownloadToFile(path string, maxTime time.Duration) error {
-	peerID := util.GeneratePeerID("dsm")
-	torrent := Torrent{
-		PeerID:      peerID,
-		InfoSHA:     tf.InfoSHA,
-		PieceSHA:    tf.PieceSHA,
-		PieceLength: tf.PieceLen,
-		Length:      tf.FileLen,
-		Name:        tf.FileName,
-		mp:          make(map[string]struct{}),
+	torrent, err := tf.NewTorrent()
+	if err != nil {
+		return err
 	}
 	ctx := context.Background()
 	var cancel context.CancelFunc
@@ -164,25 +263,99 @@ func (tf *TorrentFile) DownloadToFile(path string, maxTime time.Duration) error
 		ctx, cancel = context.WithTimeout(context.Background(), maxTime)
 		defer cancel()
 	}
-	buf, err := torrent.download(ctx, tf)
+	return torrent.Download(ctx, path)
+}
+
+// NewTorrent prepares a download of the torrent, priorities may be set on it
+// before and while Download runs
+func (tf *TorrentFile) NewTorrent() (*Torrent, error) {
+	torrent := newTorrent(tf, util.GeneratePeerID("dsm"))
+	err := torrent.registerExtensions(tf.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	return torrent, nil
+}
+
+// Download downloads the torrent into its files below path, or into
+// tf.Storage when set, until it is complete or ctx is done. A Torrent is
+// downloaded only once.
+func (t *Torrent) Download(ctx context.Context, path string) error {
+	tf := t.tf
+	st, err := tf.openStorage(storage.NewFile(path))
+	if err != nil {
+		t.finishReading(err)
+		return err
+	}
+	stop := func() error { return nil }
+	if tf.ResumeFile != "" {
+		err = t.loadResume(tf, st)
+		if err != nil {
+			// 恢复文件损坏或属于其他种子时从头下载
+			log.Println("ignore resume file:", err)
+		}
+		stop = t.saveResumePeriodically(tf.ResumeFile, st)
+	}
+	t.startReading(st)
+	err = t.download(ctx, tf, st)
+	// 无论下载是否完成都保存进度，在关闭存储之前写回数据
+	if saveErr := stop(); saveErr != nil {
+		log.Println("save resume file:", saveErr)
+	}
+	// 还有Reader在读取时由最后关闭的Reader关闭存储
+	closeErr := t.finishReading(err)
 	if err != nil {
 		return err
 	}
-	fmt.Println("finish downloading")
-	fname := path + tf.FileName
-	outFile, err := os.Create(fname)
+	log.Println("finish downloading ", tf.FileName)
+	return closeErr
+}
+
+// Seed verifies the complete data of the torrent found in dir, announces
+// completion to the trackers and serves it to other peers until ctx is done
+func (tf *TorrentFile) Seed(ctx context.Context, dir string, port int) error {
+	st, err := tf.openStorage(storage.NewFileReadOnly(dir))
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	torrent := newTorrent(tf, util.GeneratePeerID("dsm"))
+	torrent.storage = st
+	err = torrent.registerExtensions(tf.Extensions)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
+	err = torrent.verifyPieces()
 	if err != nil {
 		return err
 	}
-	log.Println("finish downloading ", fname)
+	log.Println("verified all pieces of ", tf.FileName)
+	l, err := torrent.listen(ctx, net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	log.Println("seeding on ", l.Addr())
+	if tf.DHT != nil && !tf.Private {
+		go torrent.dhtPeers(ctx, tf.DHT)
+	}
+	if tf.LSD != nil && !tf.Private {
+		defer tf.LSD.Watch(torrent.InfoSHA, torrent.port, torrent.lsdPeer)()
+	}
+	torrent.seedAnnounce(ctx, tf, torrent.port)
 	return nil
 }
 
+// Magnet builds a magnet link for the torrent
+func (tf *TorrentFile) Magnet() *magnet.Magnet {
+	return &magnet.Magnet{
+		InfoHash:    tf.InfoSHA,
+		HasInfoHash: true,
+		Name:        tf.FileName,
+		Trackers:    tf.trackers(),
+		WebSeeds:    tf.WebSeeds,
+	}
+}
+
 // Open parses a torrent file
 func Open(path string) (*TorrentFile, error) {
 	file, err := os.Open(path)
@@ -190,12 +363,5 @@ func Open(path string) (*TorrentFile, error) {
 		return nil, err
 	}
 	defer file.Close()
-
-	bt := new(benTorrent)
-	err = model.UnmarshalBen(file, bt)
-	if err != nil {
-		return nil, err
-	}
-	//fmt.Printf("\n%+v\n", *bt)
-	return bt.toTorrentFile()
+	return UnmarshalTorrentFile(file)
 }
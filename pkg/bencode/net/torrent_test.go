@@ -1,9 +1,16 @@
 package net
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestParseTorrentFile(t *testing.T) {
@@ -44,3 +51,44 @@ func TestParseTorrentFile(t *testing.T) {
 //	}
 //	fmt.Println(peers)
 //}
+
+// 分片校验后直接写入文件中对应的位置
+func TestDownloadToFile(t *testing.T) {
+	tf, data := newTestTorrentFile(t, 2*MaxBlockSize, 9*MaxBlockSize+7)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	dir := t.TempDir() + string(filepath.Separator)
+	assert.NoError(t, tf.DownloadToFile(dir, 10*time.Second))
+	got, err := os.ReadFile(filepath.Join(dir, tf.FileName))
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+// 写入总是失败的存储
+type failingData struct{ err error }
+
+func (d failingData) ReadAt(p []byte, off int64) (int, error) {
+	return 0, d.err
+}
+
+func (d failingData) WriteAt(p []byte, off int64) (int, error) {
+	return 0, d.err
+}
+
+func (d failingData) Close() error {
+	return nil
+}
+
+// 写入失败时停止下载并返回写入的错误
+func TestDownloadWriteError(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 4*MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tf.peers = []*PeerInfo{peerFromAddr(t, startTestSeeder(t, ctx, tf, data))}
+	leecher := newTorrent(tf, util.GeneratePeerID("leecher"))
+	diskFull := errors.New("disk full")
+	err := leecher.download(ctx, tf, storage.NewTorrent(tf.info(), failingData{diskFull}))
+	assert.ErrorIs(t, err, diskFull)
+	assert.NoError(t, ctx.Err())
+}
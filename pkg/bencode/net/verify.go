@@ -0,0 +1,147 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/shoggothforever/torcore/pkg/bencode/storage"
+	"github.com/shoggothforever/torcore/pkg/bencode/util"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// VerifyResult is the outcome of checking data against a torrent
+type VerifyResult struct {
+	// Pieces has the pieces whose data matched their hash
+	Pieces Bitfield
+	// Files are the files of the torrent in order
+	Files []FileCheck
+	// Bad is the number of pieces that did not match
+	Bad int
+	// 校验结果对应的恢复数据，文件缺失时不记录文件状态
+	resume *ResumeData
+}
+
+// FileCheck is the completeness of one file of a torrent
+type FileCheck struct {
+	// Path is relative to the torrent, parts separated by '/'
+	Path   string
+	Length int
+	// Pieces is the number of pieces covering the file, Good how many of
+	// them matched
+	Pieces int
+	Good   int
+}
+
+// Complete reports whether every piece covering the file matched
+func (f FileCheck) Complete() bool {
+	return f.Good == f.Pieces
+}
+
+// Complete reports whether every piece of the torrent matched
+func (r *VerifyResult) Complete() bool {
+	return r.Bad == 0
+}
+
+// SaveResume writes the matched pieces as a resume file, a download given
+// the same resume file continues from them instead of starting over
+func (r *VerifyResult) SaveResume(path string) error {
+	return r.resume.Save(path)
+}
+
+// Verify hashes the content found below dir against the torrent using
+// workers goroutines, 0 means one per CPU. Missing or short files only make
+// their pieces fail. progress, when not nil, is called after each piece.
+func (tf *TorrentFile) Verify(ctx context.Context, dir string, workers int, progress func(checked, total int)) (*VerifyResult, error) {
+	st, err := tf.openStorage(storage.NewFileExisting(dir))
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	t := newTorrent(tf, util.GeneratePeerID("dsm"))
+	good, err := t.recheck(ctx, st, workers, progress)
+	if err != nil {
+		return nil, err
+	}
+	r := &VerifyResult{Pieces: good}
+	r.resume = &ResumeData{InfoHash: string(t.InfoSHA[:]), Pieces: string(good)}
+	// 有文件缺失时不记录文件状态，恢复时会重新校验记录的分片
+	files, err := currentFiles(st)
+	if err == nil && !slices.ContainsFunc(files, func(f ResumeFile) bool { return f.Mtime == 0 }) {
+		r.resume.Files = files
+	}
+	for index := range t.PieceSHA {
+		if !good.HasPiece(index) {
+			r.Bad++
+		}
+	}
+	info := tf.info()
+	infoFiles := info.Files
+	if len(infoFiles) == 0 {
+		infoFiles = []metainfo.FileInfo{{Length: info.Length, Path: []string{info.Name}}}
+	}
+	offset := 0
+	for _, f := range infoFiles {
+		fc := FileCheck{Path: strings.Join(f.Path, "/"), Length: f.Length}
+		if f.Length > 0 {
+			for index := offset / t.PieceLength; index <= (offset+f.Length-1)/t.PieceLength; index++ {
+				fc.Pieces++
+				if good.HasPiece(index) {
+					fc.Good++
+				}
+			}
+		}
+		r.Files = append(r.Files, fc)
+		offset += f.Length
+	}
+	return r, nil
+}
+
+// 用workers个协程并行校验存储中的所有分片，返回校验通过的分片
+func (t *Torrent) recheck(ctx context.Context, st storage.Torrent, workers int, progress func(checked, total int)) (Bitfield, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	good := NewBitfield(len(t.PieceSHA))
+	indexes := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	checked := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, t.PieceLength)
+			for index := range indexes {
+				pw := &pieceWork{index, t.PieceSHA[index], t.calculatePieceSize(index)}
+				_, err := st.Piece(index).ReadAt(buf[:pw.length], 0)
+				ok := err == nil && checkIntegrity(pw, buf[:pw.length]) == nil
+				mu.Lock()
+				if ok {
+					good.SetPiece(index)
+				}
+				checked++
+				if progress != nil {
+					progress(checked, len(t.PieceSHA))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for index := range t.PieceSHA {
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("verify interrupted: %w", err)
+	}
+	return good, nil
+}
@@ -0,0 +1,77 @@
+package net
+
+import (
+	"context"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 三个文件的种子：第一个文件完整，第二个文件中有一个字节被修改，第三个文件缺失
+func TestVerify(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 6*MaxBlockSize)
+	tf.files = []metainfo.FileInfo{
+		{Length: 2 * MaxBlockSize, Path: []string{"a"}},
+		{Length: 3*MaxBlockSize - 10, Path: []string{"sub", "b"}},
+		{Length: MaxBlockSize + 10, Path: []string{"c"}},
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, tf.FileName)
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "a"), data[:2*MaxBlockSize], 0644))
+	b := append([]byte(nil), data[2*MaxBlockSize:5*MaxBlockSize-10]...)
+	b[MaxBlockSize+3] ^= 0xff
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "sub", "b"), b, 0644))
+
+	var calls atomic.Int64
+	r, err := tf.Verify(context.Background(), dir, 3, func(checked, total int) {
+		calls.Add(1)
+		assert.Equal(t, 6, total)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), calls.Load())
+	assert.False(t, r.Complete())
+	assert.Equal(t, 3, r.Bad)
+	assert.Equal(t, Bitfield{0xe0}, r.Pieces)
+	assert.Equal(t, []FileCheck{
+		{Path: "a", Length: 2 * MaxBlockSize, Pieces: 2, Good: 2},
+		{Path: "sub/b", Length: 3*MaxBlockSize - 10, Pieces: 3, Good: 1},
+		{Path: "c", Length: MaxBlockSize + 10, Pieces: 2, Good: 0},
+	}, r.Files)
+	assert.True(t, r.Files[0].Complete())
+	assert.False(t, r.Files[2].Complete())
+	// 校验不会创建缺失的文件，有文件缺失时恢复数据不记录文件状态
+	_, err = os.Stat(filepath.Join(root, "c"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Nil(t, r.resume.Files)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "sub", "b"), data[2*MaxBlockSize:5*MaxBlockSize-10], 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "c"), data[5*MaxBlockSize-10:], 0644))
+	r, err = tf.Verify(context.Background(), dir, 0, nil)
+	assert.NoError(t, err)
+	assert.True(t, r.Complete())
+	assert.Len(t, r.resume.Files, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tf.Verify(ctx, dir, 1, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// 校验结果保存为恢复文件后，下载直接使用已有的数据
+func TestVerifySaveResume(t *testing.T) {
+	tf, data := newTestTorrentFile(t, MaxBlockSize, 3*MaxBlockSize)
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, tf.FileName), data, 0644))
+	r, err := tf.Verify(context.Background(), dir, 0, nil)
+	assert.NoError(t, err)
+	tf.ResumeFile = filepath.Join(dir, tf.FileName+".resume")
+	assert.NoError(t, r.SaveResume(tf.ResumeFile))
+	assert.Equal(t, []bool{true, true, true}, resumedPieces(t, tf, dir))
+	// 所有分片都已完成，不需要peer
+	assert.NoError(t, tf.DownloadToFile(dir, time.Second))
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrPath is returned for a torrent whose name or file paths would leave
+// the storage directory
+var ErrPath = errors.New("unsafe file path in torrent")
+
+// File stores torrents as plain files below a directory: a single-file
+// torrent as dir/name, a multi-file torrent as dir/name/path...
+type File struct {
+	dir      string
+	readOnly bool
+	// 只读时允许文件缺失或长度不符
+	partial bool
+}
+
+// NewFile stores torrents below dir. Existing files are sized when a torrent
+// is opened, missing ones are created on their first write, so files whose
+// pieces are never written are not created.
+func NewFile(dir string) *File {
+	return &File{dir: dir}
+}
+
+// NewFileReadOnly serves existing complete content below dir, for seeding.
+// Opening fails when a file is missing or has the wrong size.
+func NewFileReadOnly(dir string) *File {
+	return &File{dir: dir, readOnly: true}
+}
+
+// NewFileExisting reads whatever content exists below dir without creating
+// or changing any file, for checking data. Pieces covering a missing or
+// short file fail to read.
+func NewFileExisting(dir string) *File {
+	return &File{dir: dir, readOnly: true, partial: true}
+}
+
+// OpenTorrent opens, or creates and sizes, the files of the torrent
+func (s *File) OpenTorrent(info *metainfo.Info, infoHash [metainfo.HashLen]byte) (Torrent, error) {
+	spans, err := fileSpans(s.dir, info)
+	if err != nil {
+		return nil, err
+	}
+	data := &files{spans: spans, fds: make([]*os.File, len(spans)), lazy: !s.readOnly}
+	for i, span := range spans {
+		if data.lazy && span.length > 0 {
+			// 可写时只打开已经存在的文件，其余的在第一次写入时创建
+			_, err = os.Stat(span.path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+		}
+		data.fds[i], err = openFile(span, s.readOnly, s.partial)
+		if s.partial && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	return NewTorrent(info, data), nil
+}
+
+// 打开文件，可写时创建并设置为种子中的长度，只读时除非partial否则检查长度
+func openFile(span fileSpan, readOnly, partial bool) (*os.File, error) {
+	if readOnly {
+		fd, err := os.Open(span.path)
+		if err != nil {
+			return nil, err
+		}
+		if partial {
+			return fd, nil
+		}
+		st, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		if st.Size() != span.length {
+			fd.Close()
+			return nil, fmt.Errorf("%s has size %d, expected %d", span.path, st.Size(), span.length)
+		}
+		return fd, nil
+	}
+	err := os.MkdirAll(filepath.Dir(span.path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(span.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := fd.Stat()
+	if err == nil && st.Size() != span.length {
+		err = fd.Truncate(span.length)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
+// 种子中的一个文件，以及它在种子数据中的位置
+type fileSpan struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// 按种子中的顺序列出文件，路径中不能有..等离开目录的部分
+func fileSpans(dir string, info *metainfo.Info) ([]fileSpan, error) {
+	if !safePart(info.Name) {
+		return nil, fmt.Errorf("%w: %q", ErrPath, info.Name)
+	}
+	root := filepath.Join(dir, info.Name)
+	if len(info.Files) == 0 {
+		return []fileSpan{{path: root, length: int64(info.Length)}}, nil
+	}
+	spans := make([]fileSpan, len(info.Files))
+	var offset int64
+	for i, f := range info.Files {
+		if len(f.Path) == 0 {
+			return nil, fmt.Errorf("%w: empty path", ErrPath)
+		}
+		for _, part := range f.Path {
+			if !safePart(part) {
+				return nil, fmt.Errorf("%w: %q", ErrPath, strings.Join(f.Path, "/"))
+			}
+		}
+		spans[i] = fileSpan{
+			path:   filepath.Join(append([]string{root}, f.Path...)...),
+			offset: offset,
+			length: int64(f.Length),
+		}
+		offset += int64(f.Length)
+	}
+	return spans, nil
+}
+
+func safePart(part string) bool {
+	return part != "" && part != "." && part != ".." &&
+		!strings.ContainsAny(part, `/\`) && !filepath.IsAbs(part)
+}
+
+// 将种子数据中从off开始的n个字节按文件切分，依次处理每一段。
+// fn的参数为文件序号、文件内的偏移，以及该段在[0, n)中的范围
+func eachSpan(spans []fileSpan, off int64, n int, fn func(i int, fileOff int64, from, to int) error) error {
+	end := off + int64(n)
+	for i, span := range spans {
+		begin := max(off, span.offset)
+		stop := min(end, span.offset+span.length)
+		if begin >= stop {
+			continue
+		}
+		err := fn(i, begin-span.offset, int(begin-off), int(stop-off))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 由多个文件组成的种子数据
+type files struct {
+	spans []fileSpan
+	// 尚未打开的文件为nil，lazy时在第一次写入时创建
+	mu   sync.Mutex
+	fds  []*os.File
+	lazy bool
+}
+
+// 第i个文件，create为true时创建尚未创建的文件
+func (d *files) fd(i int, create bool) (*os.File, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fds[i] == nil && create && d.lazy {
+		fd, err := openFile(d.spans[i], false, false)
+		if err != nil {
+			return nil, err
+		}
+		d.fds[i] = fd
+	}
+	if d.fds[i] == nil {
+		return nil, fmt.Errorf("%s: %w", d.spans[i].path, os.ErrNotExist)
+	}
+	return d.fds[i], nil
+}
+
+func (d *files) ReadAt(b []byte, off int64) (int, error) {
+	err := eachSpan(d.spans, off, len(b), func(i int, fileOff int64, from, to int) error {
+		fd, err := d.fd(i, false)
+		if err != nil {
+			return err
+		}
+		_, err = fd.ReadAt(b[from:to], fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *files) WriteAt(b []byte, off int64) (int, error) {
+	err := eachSpan(d.spans, off, len(b), func(i int, fileOff int64, from, to int) error {
+		fd, err := d.fd(i, true)
+		if err != nil {
+			return err
+		}
+		_, err = fd.WriteAt(b[from:to], fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *files) FileStates() ([]FileState, error) {
+	return fileStates(d.spans)
+}
+
+func (d *files) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, fd := range d.fds {
+		if fd != nil {
+			errs = append(errs, fd.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 按种子中的顺序读取各个文件的长度和修改时间，尚未创建的文件长度为0
+func fileStates(spans []fileSpan) ([]FileState, error) {
+	states := make([]FileState, len(spans))
+	for i, span := range spans {
+		st, err := os.Stat(span.path)
+		if errors.Is(err, os.ErrNotExist) {
+			states[i] = FileState{Path: span.path}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		states[i] = FileState{Path: span.path, Length: st.Size(), ModTime: st.ModTime()}
+	}
+	return states, nil
+}
+
+func (d *files) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, fd := range d.fds {
+		if fd != nil {
+			errs = append(errs, fd.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
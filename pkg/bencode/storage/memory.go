@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"sync"
+)
+
+// Memory keeps the data of torrents in memory. Opening the same torrent
+// again returns the data written before.
+type Memory struct {
+	mu       sync.Mutex
+	torrents map[[metainfo.HashLen]byte]memData
+}
+
+// NewMemory creates an empty in-memory storage
+func NewMemory() *Memory {
+	return &Memory{torrents: make(map[[metainfo.HashLen]byte]memData)}
+}
+
+// OpenTorrent returns the data kept for infoHash, allocating it on first use
+func (m *Memory) OpenTorrent(info *metainfo.Info, infoHash [metainfo.HashLen]byte) (Torrent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.torrents[infoHash]
+	if !ok || len(data) != info.TotalLength() {
+		data = make(memData, info.TotalLength())
+		m.torrents[infoHash] = data
+	}
+	return NewTorrent(info, data), nil
+}
+
+// 内存中的种子数据，分片的边界由torrent检查
+type memData []byte
+
+func (d memData) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, d[off:]), nil
+}
+
+func (d memData) WriteAt(b []byte, off int64) (int, error) {
+	return copy(d[off:], b), nil
+}
+
+func (d memData) Close() error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+)
+
+// Mmap stores torrents in memory mapped files, which this platform does not
+// support, opening a torrent always fails
+type Mmap struct {
+	dir string
+}
+
+// NewMmap stores torrents below dir using memory mapped files
+func NewMmap(dir string) *Mmap {
+	return &Mmap{dir: dir}
+}
+
+// OpenTorrent fails, memory mapped files are not supported on this platform
+func (s *Mmap) OpenTorrent(info *metainfo.Info, infoHash [metainfo.HashLen]byte) (Torrent, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
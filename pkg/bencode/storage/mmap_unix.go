@@ -0,0 +1,102 @@
+//go:build unix
+
+package storage
+
+import (
+	"errors"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"sync"
+	"syscall"
+)
+
+// Mmap stores torrents in the same files as File, but reads and writes
+// pieces through shared memory mappings of the files
+type Mmap struct {
+	dir string
+}
+
+// NewMmap stores torrents below dir using memory mapped files
+func NewMmap(dir string) *Mmap {
+	return &Mmap{dir: dir}
+}
+
+// OpenTorrent creates and sizes the files of the torrent and maps them
+func (s *Mmap) OpenTorrent(info *metainfo.Info, infoHash [metainfo.HashLen]byte) (Torrent, error) {
+	spans, err := fileSpans(s.dir, info)
+	if err != nil {
+		return nil, err
+	}
+	data := &mmapData{spans: spans, maps: make([][]byte, len(spans))}
+	for i, span := range spans {
+		if span.length == 0 {
+			continue
+		}
+		fd, err := openFile(span, false, false)
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+		// 映射建立后关闭文件不影响映射
+		data.maps[i], err = syscall.Mmap(int(fd.Fd()), 0, int(span.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		fd.Close()
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	return NewTorrent(info, data), nil
+}
+
+// 映射到内存中的各个文件。读写持有读锁，关闭时等待正在进行的读写结束，
+// 之后的读写返回ErrClosed，不会访问已经解除的映射
+type mmapData struct {
+	spans  []fileSpan
+	mu     sync.RWMutex
+	maps   [][]byte
+	closed bool
+}
+
+func (d *mmapData) ReadAt(b []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return 0, ErrClosed
+	}
+	eachSpan(d.spans, off, len(b), func(i int, fileOff int64, from, to int) error {
+		copy(b[from:to], d.maps[i][fileOff:])
+		return nil
+	})
+	return len(b), nil
+}
+
+func (d *mmapData) WriteAt(b []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return 0, ErrClosed
+	}
+	eachSpan(d.spans, off, len(b), func(i int, fileOff int64, from, to int) error {
+		copy(d.maps[i][fileOff:], b[from:to])
+		return nil
+	})
+	return len(b), nil
+}
+
+func (d *mmapData) FileStates() ([]FileState, error) {
+	return fileStates(d.spans)
+}
+
+// 解除映射，修改由系统写回文件
+func (d *mmapData) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	var errs []error
+	for i, m := range d.maps {
+		if m != nil {
+			errs = append(errs, syscall.Munmap(m))
+			d.maps[i] = nil
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,169 @@
+// Package storage keeps the piece data of torrents. The content of a torrent
+// is the concatenation of its files, backends map piece offsets onto plain
+// files, memory mapped files, memory or any store of their own.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"io"
+	"sync"
+	"time"
+)
+
+// Storage opens the data of torrents, one Storage may serve several torrents
+type Storage interface {
+	// OpenTorrent opens the data of the torrent described by info
+	OpenTorrent(info *metainfo.Info, infoHash [metainfo.HashLen]byte) (Torrent, error)
+}
+
+// Torrent is the data of one opened torrent
+type Torrent interface {
+	// Piece returns the data of the piece at index
+	Piece(index int) Piece
+	Close() error
+}
+
+// Piece is the data of one piece, offsets of ReadAt and WriteAt are relative
+// to the start of the piece
+type Piece interface {
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete records that the piece is written and verified
+	MarkComplete() error
+	// Completed reports whether the piece was marked complete
+	Completed() bool
+}
+
+// Data reads and writes the whole content of a torrent by offset
+type Data interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// FileState is the size and modification time of one file of a torrent, a
+// file not created yet has zero size and time
+type FileState struct {
+	Path    string
+	Length  int64
+	ModTime time.Time
+}
+
+// FileStater is implemented by torrents kept in files. Comparing the states
+// with those saved earlier tells which files changed in between.
+type FileStater interface {
+	FileStates() ([]FileState, error)
+}
+
+// Syncer is implemented by torrents that buffer writes, Sync makes every
+// completed write durable
+type Syncer interface {
+	Sync() error
+}
+
+// ErrPieceBounds is returned for a write past the end of a piece
+var ErrPieceBounds = errors.New("write beyond the end of the piece")
+
+// ErrClosed is returned by reads and writes of a torrent after it is closed
+var ErrClosed = errors.New("storage closed")
+
+// 在整个种子的数据上按分片读写，完成状态保存在内存中
+type torrent struct {
+	data        Data
+	pieceLength int64
+	length      int64
+
+	mu       sync.Mutex
+	complete []bool
+}
+
+// NewTorrent builds a Torrent over data holding the content of the torrent
+// described by info. Completion is only kept in memory.
+func NewTorrent(info *metainfo.Info, data Data) Torrent {
+	length := int64(info.TotalLength())
+	pieceLength := int64(info.PieceLength)
+	numPieces := 0
+	if pieceLength > 0 {
+		numPieces = int((length + pieceLength - 1) / pieceLength)
+	}
+	return &torrent{
+		data:        data,
+		pieceLength: pieceLength,
+		length:      length,
+		complete:    make([]bool, numPieces),
+	}
+}
+
+func (t *torrent) Piece(index int) Piece {
+	begin := int64(index) * t.pieceLength
+	return &piece{
+		t:      t,
+		index:  index,
+		begin:  begin,
+		length: max(0, min(t.pieceLength, t.length-begin)),
+	}
+}
+
+// FileStates reports the files of the data, nil when it is not kept in files
+func (t *torrent) FileStates() ([]FileState, error) {
+	if fs, ok := t.data.(FileStater); ok {
+		return fs.FileStates()
+	}
+	return nil, nil
+}
+
+// Sync flushes the data when it buffers writes
+func (t *torrent) Sync() error {
+	if s, ok := t.data.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (t *torrent) Close() error {
+	return t.data.Close()
+}
+
+type piece struct {
+	t      *torrent
+	index  int
+	begin  int64
+	length int64
+}
+
+func (p *piece) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off > p.length {
+		return 0, fmt.Errorf("read at offset %d of piece #%d", off, p.index)
+	}
+	n := int(min(int64(len(b)), p.length-off))
+	n, err := p.t.data.ReadAt(b[:n], p.begin+off)
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (p *piece) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.length {
+		return 0, ErrPieceBounds
+	}
+	return p.t.data.WriteAt(b, p.begin+off)
+}
+
+func (p *piece) MarkComplete() error {
+	p.t.mu.Lock()
+	defer p.t.mu.Unlock()
+	if p.index < 0 || p.index >= len(p.t.complete) {
+		return fmt.Errorf("no piece #%d", p.index)
+	}
+	p.t.complete[p.index] = true
+	return nil
+}
+
+func (p *piece) Completed() bool {
+	p.t.mu.Lock()
+	defer p.t.mu.Unlock()
+	return p.index >= 0 && p.index < len(p.t.complete) && p.t.complete[p.index]
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/shoggothforever/torcore/pkg/bencode/metainfo"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 三个文件的种子，分片跨越文件边界，最后一个分片较短
+func testInfo() *metainfo.Info {
+	return &metainfo.Info{
+		Name:        "multi",
+		PieceLength: 16,
+		Files: []metainfo.FileInfo{
+			{Length: 10, Path: []string{"a.txt"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 30, Path: []string{"sub", "b.bin"}},
+		},
+	}
+}
+
+// 逐个分片写入数据，标记完成后读回
+func writePieces(t *testing.T, st Torrent, info *metainfo.Info, data []byte) {
+	for i := 0; i*info.PieceLength < len(data); i++ {
+		begin := i * info.PieceLength
+		end := min(begin+info.PieceLength, len(data))
+		p := st.Piece(i)
+		n, err := p.WriteAt(data[begin:end], 0)
+		assert.NoError(t, err)
+		assert.Equal(t, end-begin, n)
+		assert.False(t, p.Completed())
+		assert.NoError(t, p.MarkComplete())
+		assert.True(t, st.Piece(i).Completed())
+	}
+}
+
+func readAll(t *testing.T, st Torrent, info *metainfo.Info) []byte {
+	var got []byte
+	for i := 0; i*info.PieceLength < info.TotalLength(); i++ {
+		buf := make([]byte, info.PieceLength)
+		n, err := st.Piece(i).ReadAt(buf, 0)
+		if n < len(buf) {
+			assert.ErrorIs(t, err, io.EOF)
+		}
+		got = append(got, buf[:n]...)
+	}
+	return got
+}
+
+func TestBackendsRoundTrip(t *testing.T) {
+	backends := map[string]func(dir string) Storage{
+		"memory": func(string) Storage { return NewMemory() },
+		"file":   func(dir string) Storage { return NewFile(dir) },
+	}
+	if runtime.GOOS != "windows" {
+		backends["mmap"] = func(dir string) Storage { return NewMmap(dir) }
+	}
+	info := testInfo()
+	data := make([]byte, info.TotalLength())
+	rand.Read(data)
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newStorage(dir)
+			st, err := s.OpenTorrent(info, [metainfo.HashLen]byte{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writePieces(t, st, info, data)
+			assert.Equal(t, data, readAll(t, st, info))
+
+			_, err = st.Piece(2).WriteAt(make([]byte, 9), 0)
+			assert.ErrorIs(t, err, ErrPieceBounds)
+			buf := make([]byte, 4)
+			_, err = st.Piece(0).ReadAt(buf, 14)
+			assert.ErrorIs(t, err, io.EOF)
+			assert.Equal(t, data[14:16], buf[:2])
+			assert.NoError(t, st.Close())
+
+			// 重新打开后数据仍在
+			st, err = s.OpenTorrent(info, [metainfo.HashLen]byte{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, data, readAll(t, st, info))
+			assert.NoError(t, st.Close())
+		})
+	}
+}
+
+// 文件按种子中的路径存放，可以直接使用
+func TestFileLayout(t *testing.T) {
+	info := testInfo()
+	data := make([]byte, info.TotalLength())
+	rand.Read(data)
+	dir := t.TempDir()
+	st, err := NewFile(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePieces(t, st, info, data)
+	assert.NoError(t, st.Close())
+
+	a, err := os.ReadFile(filepath.Join(dir, "multi", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, data[:10], a)
+	empty, err := os.ReadFile(filepath.Join(dir, "multi", "empty"))
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+	b, err := os.ReadFile(filepath.Join(dir, "multi", "sub", "b.bin"))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data[10:], b))
+
+	// 只读打开要求文件完整存在
+	st, err = NewFileReadOnly(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, readAll(t, st, info))
+	_, err = st.Piece(0).WriteAt([]byte{1}, 0)
+	assert.Error(t, err)
+	assert.NoError(t, st.Close())
+	assert.NoError(t, os.Truncate(filepath.Join(dir, "multi", "a.txt"), 5))
+	_, err = NewFileReadOnly(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	assert.Error(t, err)
+
+	// 检查数据时允许文件缺失或过短，只有覆盖它们的分片无法读取
+	assert.NoError(t, os.Remove(filepath.Join(dir, "multi", "sub", "b.bin")))
+	st, err = NewFileExisting(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Piece(0).ReadAt(make([]byte, 16), 0)
+	assert.Error(t, err)
+	_, err = st.Piece(2).ReadAt(make([]byte, 8), 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.NoError(t, st.Close())
+	_, err = os.Stat(filepath.Join(dir, "multi", "sub", "b.bin"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// 只写入一个文件的分片时不创建其他文件，分片跨越文件边界时创建两边的文件
+func TestFileCreatesOnWrite(t *testing.T) {
+	info := &metainfo.Info{
+		Name:        "lazy",
+		PieceLength: 16,
+		Files: []metainfo.FileInfo{
+			{Length: 16, Path: []string{"a"}},
+			{Length: 20, Path: []string{"b"}},
+			{Length: 12, Path: []string{"c"}},
+		},
+	}
+	dir := t.TempDir()
+	st, err := NewFile(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Piece(0).WriteAt(make([]byte, 16), 0)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "lazy", "b"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = st.Piece(1).ReadAt(make([]byte, 16), 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = st.Piece(2).WriteAt([]byte("boundary........"), 0)
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "lazy", "b"))
+	assert.NoError(t, err)
+	assert.Len(t, b, 20)
+	assert.Equal(t, []byte("boun"), b[16:])
+	c, err := os.ReadFile(filepath.Join(dir, "lazy", "c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("dary........"), c)
+	assert.NoError(t, st.Close())
+
+	// 重新打开时已经存在的文件仍可读取
+	st, err = NewFile(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_, err = st.Piece(2).ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("boundary........"), buf)
+	assert.NoError(t, st.Close())
+}
+
+func TestFileRejectsUnsafePaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, info := range []*metainfo.Info{
+		{Name: "..", PieceLength: 16, Length: 1},
+		{Name: "ok", PieceLength: 16, Files: []metainfo.FileInfo{{Length: 1, Path: []string{"..", "escape"}}}},
+		{Name: "ok", PieceLength: 16, Files: []metainfo.FileInfo{{Length: 1, Path: []string{"a/../../escape"}}}},
+		{Name: "ok", PieceLength: 16, Files: []metainfo.FileInfo{{Length: 1}}},
+	} {
+		_, err := NewFile(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+		assert.ErrorIs(t, err, ErrPath)
+	}
+}
+
+// 文件存储报告各个文件的长度和修改时间，内存存储没有文件状态
+func TestFileStates(t *testing.T) {
+	info := testInfo()
+	dir := t.TempDir()
+	st, err := NewFile(dir).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	// 还没有写入的文件尚未创建
+	states, err := st.(FileStater).FileStates()
+	assert.NoError(t, err)
+	assert.Len(t, states, 3)
+	assert.Equal(t, FileState{Path: filepath.Join(dir, "multi", "a.txt")}, states[0])
+	assert.NoError(t, st.(Syncer).Sync())
+
+	data := make([]byte, info.TotalLength())
+	writePieces(t, st, info, data)
+	states, err = st.(FileStater).FileStates()
+	assert.NoError(t, err)
+	for i, f := range info.Files {
+		assert.Equal(t, int64(f.Length), states[i].Length)
+		assert.Equal(t, filepath.Join(append([]string{dir, "multi"}, f.Path...)...), states[i].Path)
+		assert.False(t, states[i].ModTime.IsZero())
+	}
+	assert.NoError(t, st.(Syncer).Sync())
+
+	mem, err := NewMemory().OpenTorrent(info, [metainfo.HashLen]byte{})
+	assert.NoError(t, err)
+	states, err = mem.(FileStater).FileStates()
+	assert.NoError(t, err)
+	assert.Nil(t, states)
+}
+
+// 关闭映射时正在进行的读取完成后才解除映射，之后的读写返回ErrClosed
+func TestMmapCloseWhileReading(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mmap storage is not supported on windows")
+	}
+	info := testInfo()
+	data := make([]byte, info.TotalLength())
+	rand.Read(data)
+	st, err := NewMmap(t.TempDir()).OpenTorrent(info, [metainfo.HashLen]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePieces(t, st, info, data)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, info.PieceLength)
+			for {
+				n, err := st.Piece(1).ReadAt(buf, 0)
+				if err != nil {
+					assert.ErrorIs(t, err, ErrClosed)
+					return
+				}
+				assert.Equal(t, data[16:16+n], buf[:n])
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, st.Close())
+	wg.Wait()
+	_, err = st.Piece(0).WriteAt(data[:4], 0)
+	assert.ErrorIs(t, err, ErrClosed)
+}